@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+)
+
+var defaultBakeFiles = []string{"docker-bake.json", "docker-bake.hcl"}
+
+func newCmdBake() *cobra.Command {
+	cmdBake := &cobra.Command{
+		Use:   "bake [targets...]",
+		Short: "Print checksums of docker buildx bake targets",
+		Long: "Print the checksum of each target in a bake file, and a " +
+			"combined checksum of each group. The default group is used if " +
+			"no target is given. Build args, labels and platforms from flags " +
+			"are used as defaults for every target.",
+		Run: handlerBake,
+	}
+	cmdBake.Flags().String(
+		"bake-file",
+		"",
+		fmt.Sprintf("bake file to read, %v by default", defaultBakeFiles),
+	)
+	cmdBake.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdBake
+}
+
+type bakeResult struct {
+	Targets map[string]string `json:"targets"`
+	Groups  map[string]string `json:"groups,omitempty"`
+}
+
+func handlerBake(cmd *cobra.Command, args []string) {
+	path := must(cmd.Flags().GetString("bake-file"))
+	if path == "" {
+		path = must(findBakeFile())
+	}
+
+	file := must(parseBakeFile(path))
+
+	if len(args) == 0 {
+		args = []string{"default"}
+	}
+
+	res := bakeResult{Targets: map[string]string{}, Groups: map[string]string{}}
+	base := loadConfig(cmd, ".")
+	base.Cache = openSharedCache(base)
+
+	for _, name := range args {
+		targets := must(file.resolve(name, nil))
+
+		sums := map[string]string{}
+		for _, target := range targets {
+			sum, ok := res.Targets[target]
+			if !ok {
+				config := must(file.config(target, filepath.Dir(path), base))
+				sum = must(checksum.CalculateDockerfileChecksum(config))
+				res.Targets[target] = sum
+			}
+			sums[target] = sum
+		}
+
+		if _, ok := file.groups[name]; ok {
+			res.Groups[name] = must(checksum.CombineChecksums(base.Algorithm(), sums))
+		}
+	}
+
+	must0(base.Cache.Save())
+
+	displayChecksums(cmd, base, res.Targets)
+	displayChecksums(cmd, base, res.Groups)
+	printOutput(cmd, res, func(out io.Writer) {
+		targets := maps.Keys(res.Targets)
+		sort.Strings(targets)
+		for _, target := range targets {
+			fmt.Fprintln(out, target, res.Targets[target])
+		}
+
+		groups := maps.Keys(res.Groups)
+		sort.Strings(groups)
+		for _, group := range groups {
+			fmt.Fprintln(out, group, res.Groups[group])
+		}
+	})
+}
+
+func findBakeFile() (string, error) {
+	for _, path := range defaultBakeFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf("no bake file found, tried %v", defaultBakeFiles)
+}
+
+type bakeGroup struct {
+	Name    string   `hcl:"name,label"`
+	Targets []string `hcl:"targets"`
+
+	Remain hcl.Body `hcl:",remain"`
+}
+
+type bakeTarget struct {
+	Name       string            `hcl:"name,label"`
+	Inherits   []string          `hcl:"inherits,optional"`
+	Context    *string           `hcl:"context,optional"`
+	Dockerfile *string           `hcl:"dockerfile,optional"`
+	Target     *string           `hcl:"target,optional"`
+	Args       map[string]string `hcl:"args,optional"`
+	Labels     map[string]string `hcl:"labels,optional"`
+	Platforms  []string          `hcl:"platforms,optional"`
+	Contexts   map[string]string `hcl:"contexts,optional"`
+
+	// Remain holds attributes that don't affect the checksum, e.g. tags.
+	Remain hcl.Body `hcl:",remain"`
+}
+
+type bakeFile struct {
+	groups  map[string]bakeGroup
+	targets map[string]bakeTarget
+}
+
+// parseBakeFile parses a bake file in HCL or JSON. Variables are set from
+// environment variables of the same name, or their defaults. Functions are
+// not supported.
+func parseBakeFile(path string) (*bakeFile, error) {
+	parser := hclparse.NewParser()
+
+	var (
+		f     *hcl.File
+		diags hcl.Diagnostics
+	)
+	if filepath.Ext(path) == ".json" {
+		f, diags = parser.ParseJSONFile(path)
+	} else {
+		f, diags = parser.ParseHCLFile(path)
+	}
+	if diags.HasErrors() {
+		return nil, errors.Wrap(diags, "parse bake file")
+	}
+
+	content, body, diags := f.Body.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{Type: "variable", LabelNames: []string{"name"}},
+		},
+	})
+	if diags.HasErrors() {
+		return nil, errors.Wrap(diags, "parse bake file")
+	}
+
+	ctx := &hcl.EvalContext{Variables: map[string]cty.Value{}}
+	for _, block := range content.Blocks {
+		name := block.Labels[0]
+
+		if value, ok := os.LookupEnv(name); ok {
+			ctx.Variables[name] = cty.StringVal(value)
+			continue
+		}
+
+		attrs, diags := block.Body.JustAttributes()
+		if diags.HasErrors() {
+			return nil, errors.Wrapf(diags, "parse variable %s", name)
+		}
+
+		value := cty.StringVal("")
+		if attr, ok := attrs["default"]; ok {
+			value, diags = attr.Expr.Value(nil)
+			if diags.HasErrors() {
+				return nil, errors.Wrapf(diags, "parse variable %s", name)
+			}
+		}
+		ctx.Variables[name] = value
+	}
+
+	var decoded struct {
+		Groups  []bakeGroup  `hcl:"group,block"`
+		Targets []bakeTarget `hcl:"target,block"`
+
+		Remain hcl.Body `hcl:",remain"`
+	}
+	if diags := gohcl.DecodeBody(body, ctx, &decoded); diags.HasErrors() {
+		return nil, errors.Wrap(diags, "parse bake file")
+	}
+
+	file := &bakeFile{
+		groups:  map[string]bakeGroup{},
+		targets: map[string]bakeTarget{},
+	}
+	for _, group := range decoded.Groups {
+		file.groups[group.Name] = group
+	}
+	for _, target := range decoded.Targets {
+		file.targets[target.Name] = target
+	}
+
+	return file, nil
+}
+
+// resolve returns names of targets in a group or target, sorted.
+func (f *bakeFile) resolve(name string, visited map[string]bool) ([]string, error) {
+	if visited[name] {
+		return nil, errors.Errorf("group %s includes itself", name)
+	}
+
+	group, ok := f.groups[name]
+	if !ok {
+		if _, ok := f.targets[name]; !ok {
+			return nil, errors.Errorf("no target or group named %s", name)
+		}
+		return []string{name}, nil
+	}
+
+	if visited == nil {
+		visited = map[string]bool{}
+	}
+	visited[name] = true
+	defer delete(visited, name)
+
+	set := map[string]bool{}
+	for _, member := range group.Targets {
+		targets, err := f.resolve(member, visited)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			set[target] = true
+		}
+	}
+
+	targets := maps.Keys(set)
+	sort.Strings(targets)
+	return targets, nil
+}
+
+// target returns the target with inherited fields merged in.
+func (f *bakeFile) target(name string, visited map[string]bool) (bakeTarget, error) {
+	if visited[name] {
+		return bakeTarget{}, errors.Errorf("target %s inherits itself", name)
+	}
+
+	t, ok := f.targets[name]
+	if !ok {
+		return bakeTarget{}, errors.Errorf("no target named %s", name)
+	}
+
+	if visited == nil {
+		visited = map[string]bool{}
+	}
+	visited[name] = true
+	defer delete(visited, name)
+
+	var res bakeTarget
+	for _, parent := range t.Inherits {
+		p, err := f.target(parent, visited)
+		if err != nil {
+			return bakeTarget{}, err
+		}
+		res = mergeBakeTarget(res, p)
+	}
+
+	return mergeBakeTarget(res, t), nil
+}
+
+// mergeBakeTarget returns base overridden by fields set in t.
+func mergeBakeTarget(base, t bakeTarget) bakeTarget {
+	base.Name = t.Name
+	if t.Context != nil {
+		base.Context = t.Context
+	}
+	if t.Dockerfile != nil {
+		base.Dockerfile = t.Dockerfile
+	}
+	if t.Target != nil {
+		base.Target = t.Target
+	}
+	if t.Platforms != nil {
+		base.Platforms = t.Platforms
+	}
+	base.Args = mergeMap(base.Args, t.Args)
+	base.Labels = mergeMap(base.Labels, t.Labels)
+	base.Contexts = mergeMap(base.Contexts, t.Contexts)
+	return base
+}
+
+func mergeMap(base, m map[string]string) map[string]string {
+	if base == nil && m == nil {
+		return nil
+	}
+	res := maps.Clone(base)
+	if res == nil {
+		res = map[string]string{}
+	}
+	maps.Copy(res, m)
+	return res
+}
+
+// config returns the checksum config for a target. Paths in the bake file
+// are relative to dir.
+func (f *bakeFile) config(
+	name, dir string,
+	base checksum.Config,
+) (checksum.Config, error) {
+	t, err := f.target(name, nil)
+	if err != nil {
+		return checksum.Config{}, err
+	}
+
+	context := "."
+	if t.Context != nil {
+		context = *t.Context
+	}
+
+	config := base
+	config.Workdir = contextDir(joinRelative(dir, context))
+	config.Dockerfile = defaultDockerfile(config.Workdir)
+	if t.Dockerfile != nil {
+		config.Dockerfile = joinRelative(config.Workdir, *t.Dockerfile)
+	}
+	config.BuildArgs = mergeMap(base.BuildArgs, t.Args)
+	config.Labels = mergeMap(base.Labels, t.Labels)
+	if t.Target != nil {
+		config.Target = *t.Target
+	}
+	if t.Platforms != nil {
+		config.Platforms = t.Platforms
+	}
+
+	config.BuildContexts = map[string]string{}
+	for key, value := range mergeMap(base.BuildContexts, t.Contexts) {
+		config.BuildContexts[key] = joinRelative(dir, value)
+	}
+
+	return config, nil
+}
+
+// joinRelative joins path to dir, unless path is absolute, a URL or a git
+// repository.
+func joinRelative(dir, path string) string {
+	if filepath.IsAbs(path) || strings.Contains(path, "://") || checksum.IsGitURL(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+)
+
+func newCmdBatch() *cobra.Command {
+	cmdBatch := &cobra.Command{
+		Use:   "batch <spec>",
+		Short: "Print checksums of many dockerfiles in one run",
+		Long: "Calculate checksums of every target in a YAML or JSON spec " +
+			"concurrently, sharing digests of files between targets. The spec " +
+			"is a list of targets with a name, context, dockerfile, args, " +
+			"contexts, labels, platforms and target. Paths are relative to the " +
+			"spec, except the dockerfile, which is relative to the context. " +
+			"Flags are used as defaults for every target.",
+		Args: cobra.ExactArgs(1),
+		Run:  handlerBatch,
+	}
+	cmdBatch.Flags().Int("jobs", runtime.NumCPU(), "number of checksums to calculate at once")
+	cmdBatch.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdBatch
+}
+
+type batchTarget struct {
+	// Name defaults to the context.
+	Name       string            `yaml:"name"`
+	Context    string            `yaml:"context"`
+	Dockerfile string            `yaml:"dockerfile"`
+	Args       map[string]string `yaml:"args"`
+	Contexts   map[string]string `yaml:"contexts"`
+	Labels     map[string]string `yaml:"labels"`
+	Platforms  []string          `yaml:"platforms"`
+	Target     string            `yaml:"target"`
+}
+
+func handlerBatch(cmd *cobra.Command, args []string) {
+	path := args[0]
+	targets := must(readBatchSpec(path))
+	dir := filepath.Dir(path)
+
+	base := loadConfig(cmd, ".")
+	base.Cache = openSharedCache(base)
+
+	sums := make([]string, len(targets))
+
+	var g errgroup.Group
+	g.SetLimit(must(cmd.Flags().GetInt("jobs")))
+	for i, target := range targets {
+		i, target := i, target
+		g.Go(func() error {
+			contexts := map[string]string{}
+			for name, context := range target.Contexts {
+				contexts[name] = joinRelative(dir, context)
+			}
+
+			config := checksumRequest{
+				Context:       joinRelative(dir, target.Context),
+				Dockerfile:    target.Dockerfile,
+				BuildArgs:     target.Args,
+				BuildContexts: contexts,
+				Labels:        target.Labels,
+				Platforms:     target.Platforms,
+				Target:        target.Target,
+			}.config(base)
+
+			sum, err := checksum.CalculateDockerfileChecksum(config)
+			if err != nil {
+				return errors.Wrapf(err, "target %s", target.Name)
+			}
+			sums[i] = displayChecksum(cmd, config, sum)
+			return nil
+		})
+	}
+	must0(g.Wait())
+
+	must0(base.Cache.Save())
+
+	res := map[string]string{}
+	for i, target := range targets {
+		res[target.Name] = sums[i]
+	}
+
+	printOutput(cmd, res, func(out io.Writer) {
+		for i, target := range targets {
+			fmt.Fprintln(out, target.Name, sums[i])
+		}
+	})
+}
+
+// readBatchSpec reads targets from a batch spec, with default names set.
+func readBatchSpec(path string) ([]batchTarget, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read batch spec")
+	}
+
+	var targets []batchTarget
+	if err := yaml.Unmarshal(content, &targets); err != nil {
+		return nil, errors.Wrap(err, "parse batch spec")
+	}
+
+	names := map[string]bool{}
+	for i := range targets {
+		target := &targets[i]
+		if target.Context == "" {
+			return nil, errors.Errorf("target %d has no context", i)
+		}
+		if target.Name == "" {
+			target.Name = target.Context
+		}
+		if names[target.Name] {
+			return nil, errors.Errorf("duplicate target %s", target.Name)
+		}
+		names[target.Name] = true
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func newCmdBench() *cobra.Command {
+	cmdBench := &cobra.Command{
+		Use:   "bench <context>",
+		Short: "Time the checksum of a context with a cold and a warm cache",
+		Long: "Calculate the checksum of a context --runs times with an empty " +
+			"cache, then as many times with the cache the cold runs filled, " +
+			"and report how long they took and the throughput. Flags are " +
+			"used for every run, so hash algorithms, concurrency and cache " +
+			"settings can be compared on the same sources. Caches of the " +
+			"runs are temporary, the remote cache is only used by warm runs, " +
+			"and there are no warm runs with --no-cache.",
+		Args: cobra.ExactArgs(1),
+		Run:  handlerBench,
+	}
+	cmdBench.Flags().Int("runs", 5, "number of runs with a cold and with a warm cache")
+	cmdBench.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdBench
+}
+
+// benchResult is the output of bench.
+type benchResult struct {
+	Checksum string `json:"checksum"`
+	// Files and Bytes are the number and total size of the source files.
+	Files int        `json:"files"`
+	Bytes int64      `json:"bytes"`
+	Cold  benchRuns  `json:"cold"`
+	Warm  *benchRuns `json:"warm,omitempty"`
+}
+
+// benchRuns are the times of runs with the same cache, in nanoseconds.
+type benchRuns struct {
+	Runs   int           `json:"runs"`
+	Mean   time.Duration `json:"mean"`
+	Stddev time.Duration `json:"stddev"`
+	Min    time.Duration `json:"min"`
+	Max    time.Duration `json:"max"`
+	// BytesPerSecond is the size of the source files over Mean, whether
+	// they're read or found in the cache.
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+}
+
+func handlerBench(cmd *cobra.Command, args []string) {
+	config := loadConfig(cmd, args[0])
+	runs := must(cmd.Flags().GetInt("runs"))
+	if runs < 1 {
+		must0(usageErrorf("--runs must be at least 1"))
+	}
+
+	dir := must(os.MkdirTemp("", "dockerfile-source-checksum-bench"))
+	defer os.RemoveAll(dir)
+
+	var res benchResult
+	run := func(config checksum.Config) time.Duration {
+		start := time.Now()
+		r := must(checksum.Calculate(config))
+		elapsed := time.Since(start)
+
+		if res.Checksum == "" {
+			res.Checksum = r.Checksum
+			res.Files = len(r.Files)
+			for _, file := range r.Files {
+				res.Bytes += file.Size
+			}
+		} else if r.Checksum != res.Checksum {
+			must0(errors.New("the checksum changed between runs, sources are being written"))
+		}
+		return elapsed
+	}
+
+	// Every cold run has a cache of its own, and warm runs use the last one.
+	cached := config.CacheDir != ""
+	cold := make([]time.Duration, runs)
+	for i := range cold {
+		c := config
+		c.RemoteCache = ""
+		if cached {
+			c.CacheDir = filepath.Join(dir, fmt.Sprint(i))
+		}
+		cold[i] = run(c)
+	}
+	res.Cold = newBenchRuns(cold, res.Bytes)
+
+	if cached {
+		warm := make([]time.Duration, runs)
+		for i := range warm {
+			c := config
+			c.CacheDir = filepath.Join(dir, fmt.Sprint(runs-1))
+			warm[i] = run(c)
+		}
+		runs := newBenchRuns(warm, res.Bytes)
+		res.Warm = &runs
+	}
+
+	res.Checksum = displayChecksum(cmd, config, res.Checksum)
+	printOutput(cmd, res, func(out io.Writer) {
+		fmt.Fprintln(out, "checksum:", res.Checksum)
+		fmt.Fprintf(out, "sources: %d files, %s\n", res.Files, units.HumanSize(float64(res.Bytes)))
+		fmt.Fprintln(out, "cold:", res.Cold)
+		if res.Warm != nil {
+			fmt.Fprintln(out, "warm:", res.Warm)
+		}
+	})
+}
+
+// newBenchRuns returns the statistics of the times of runs over sources of
+// size bytes.
+func newBenchRuns(times []time.Duration, bytes int64) benchRuns {
+	res := benchRuns{Runs: len(times), Min: times[0], Max: times[0]}
+	var total time.Duration
+	for _, t := range times {
+		total += t
+		res.Min = min(res.Min, t)
+		res.Max = max(res.Max, t)
+	}
+	res.Mean = total / time.Duration(len(times))
+
+	// The sample standard deviation, 0 for a single run.
+	if len(times) > 1 {
+		var squares float64
+		for _, t := range times {
+			d := float64(t - res.Mean)
+			squares += d * d
+		}
+		res.Stddev = time.Duration(math.Sqrt(squares / float64(len(times)-1)))
+	}
+
+	if res.Mean > 0 {
+		res.BytesPerSecond = float64(bytes) / res.Mean.Seconds()
+	}
+	return res
+}
+
+// String returns the statistics on a line, e.g. "5 runs, mean 1.2s ± 30ms,
+// min 1.1s, max 1.3s, 40MB/s".
+func (r benchRuns) String() string {
+	round := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	return fmt.Sprintf(
+		"%d runs, mean %s ± %s, min %s, max %s, %s/s",
+		r.Runs,
+		round(r.Mean),
+		round(r.Stddev),
+		round(r.Min),
+		round(r.Max),
+		units.HumanSize(r.BytesPerSecond),
+	)
+}
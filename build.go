@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"sort"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/maps"
+)
+
+// checksumLabel is the image label set to the checksum by build.
+const checksumLabel = "org.opencontainers.source-checksum"
+
+// defaultTagTemplate is the template of image tags for checksums.
+const defaultTagTemplate = "src-{{ .Checksum }}"
+
+func newCmdBuild() *cobra.Command {
+	cmdBuild := &cobra.Command{
+		Use:   "build <context> [-- docker build args...]",
+		Short: "Run docker buildx build with the checksum as a label",
+		Long: "Calculate the checksum, then run docker buildx build for the " +
+			"context with the checksum in the " + checksumLabel + " label. " +
+			"The dockerfile, build args, contexts, labels, platforms and target " +
+			"are passed to docker as well. Args after -- are passed to docker " +
+			"as is.",
+		Args:         argsWithCommand(cobra.ExactArgs(1)),
+		RunE:         handlerBuild,
+		SilenceUsage: true,
+	}
+	cmdBuild.Flags().String(
+		"repo",
+		"",
+		"also tag the image as <repo>:<tag>",
+	)
+	cmdBuild.Flags().String(
+		"tag",
+		defaultTagTemplate,
+		"Go template of the image tag, e.g. {{ .Short 12 }}",
+	)
+	cmdBuild.Flags().String("docker", "docker", "docker command to run")
+	return cmdBuild
+}
+
+func handlerBuild(cmd *cobra.Command, args []string) error {
+	config := loadConfig(cmd, args[0])
+
+	var extra []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		extra = args[dash:]
+	}
+
+	sum := must(checksum.CalculateDockerfileChecksum(config))
+	logger.Debug("run docker build", "checksum", sum)
+
+	var image string
+	if repo := must(cmd.Flags().GetString("repo")); repo != "" {
+		image = repo + ":" + must(renderTag(must(cmd.Flags().GetString("tag")), config, sum))
+	}
+
+	dockerArgs := dockerBuildArgs(
+		config,
+		cmd.Flags().Changed("platform"),
+		sum,
+		image,
+	)
+	dockerArgs = append(dockerArgs, extra...)
+	dockerArgs = append(dockerArgs, config.Workdir)
+
+	c := exec.CommandContext(
+		cmd.Context(), must(cmd.Flags().GetString("docker")), dockerArgs...,
+	)
+	c.Stdin = os.Stdin
+	if config.DockerfileContent != nil {
+		c.Stdin = bytes.NewReader(config.DockerfileContent)
+	}
+	c.Stdout = cmd.OutOrStdout()
+	c.Stderr = cmd.ErrOrStderr()
+	return c.Run()
+}
+
+// dockerBuildArgs returns args of docker buildx build for config, without
+// the context. The image is tagged if it's not empty. Platforms are only passed if they're set explicitly, so
+// docker picks its own default otherwise.
+func dockerBuildArgs(
+	config checksum.Config,
+	withPlatforms bool,
+	sum, image string,
+) []string {
+	args := []string{"buildx", "build", "-f", config.Dockerfile}
+
+	addMap := func(flag string, m map[string]string) {
+		keys := maps.Keys(m)
+		sort.Strings(keys)
+		for _, key := range keys {
+			args = append(args, flag, key+"="+m[key])
+		}
+	}
+
+	addMap("--build-arg", config.BuildArgs)
+	addMap("--build-context", config.BuildContexts)
+	addMap("--label", config.Labels)
+	args = append(args, "--label", checksumLabel+"="+sum)
+
+	if withPlatforms {
+		for _, platform := range config.Platforms {
+			args = append(args, "--platform", platform)
+		}
+	}
+
+	if config.Target != "" {
+		args = append(args, "--target", config.Target)
+	}
+
+	if image != "" {
+		args = append(args, "-t", image)
+	}
+
+	return args
+}
+
+// renderTag returns the image tag for a checksum from a template.
+func renderTag(text string, config checksum.Config, sum string) (string, error) {
+	return renderTemplate(text, newChecksumResult(config, config.Algorithm(), sum))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// buildArgsValue is the value of --build-arg. It's a stringToString flag,
+// except that a KEY without a value takes the value of the environment
+// variable, or is skipped if it's not set, as in docker build.
+type buildArgsValue map[string]string
+
+func (v buildArgsValue) Set(s string) error {
+	records, err := csv.NewReader(strings.NewReader(s)).Read()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		key, value, ok := strings.Cut(record, "=")
+		if !ok {
+			if value, ok = os.LookupEnv(key); !ok {
+				continue
+			}
+		}
+		v[key] = value
+	}
+	return nil
+}
+
+// Type is the type of a stringToString flag, so viper reads it as a map.
+func (v buildArgsValue) Type() string {
+	return "stringToString"
+}
+
+// String formats v as a stringToString flag does.
+func (v buildArgsValue) String() string {
+	records := make([]string, 0, len(v))
+	for key, value := range v {
+		records = append(records, key+"="+value)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	must0(w.Write(records))
+	w.Flush()
+	return "[" + strings.TrimSpace(buf.String()) + "]"
+}
+
+// readBuildArgFiles reads build args from env files, with later files
+// overriding earlier ones.
+func readBuildArgFiles(paths []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, path := range paths {
+		if err := readBuildArgFile(path, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// readBuildArgFile reads KEY=VALUE lines of an env file into args. Blank
+// lines and lines starting with # are skipped, and quotes around a value are
+// removed, as in env files of docker compose.
+func readBuildArgFile(path string, args map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "read build arg file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return errors.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		args[key] = unquote(strings.TrimSpace(value))
+	}
+
+	return errors.Wrap(scanner.Err(), "read build arg file")
+}
+
+// unquote removes matching single or double quotes around s.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
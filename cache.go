@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func newCmdCache() *cobra.Command {
+	cmdCache := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the cache of file digests",
+	}
+
+	cmdStats := &cobra.Command{
+		Use:   "stats",
+		Short: "Print the number of entries and the size of the cache",
+		Args:  cobra.NoArgs,
+		Run:   handlerCacheStats,
+	}
+	cmdStats.Flags().StringP("output", "o", "text", "output format: text or json")
+
+	cmdPrune := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove cached digests of files that changed or no longer exist",
+		Args:  cobra.NoArgs,
+		Run:   handlerCachePrune,
+	}
+	cmdPrune.Flags().Duration(
+		"older-than",
+		0,
+		"also remove digests cached longer ago than this, e.g. 720h",
+	)
+
+	cmdClear := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove every cached digest",
+		Args:  cobra.NoArgs,
+		Run:   handlerCacheClear,
+	}
+
+	cmdCache.AddCommand(cmdStats, cmdPrune, cmdClear)
+	return cmdCache
+}
+
+// openCache opens the cache in --cache-dir, or the default cache directory.
+func openCache(cmd *cobra.Command) *checksum.DigestCache {
+	config := loadConfig(cmd, ".")
+	if config.CacheDir == "" {
+		must0(errors.New("no cache directory, caching is disabled"))
+	}
+	return must(checksum.OpenDigestCache(config.CacheDir))
+}
+
+func handlerCacheStats(cmd *cobra.Command, args []string) {
+	stats := must(openCache(cmd).Stats())
+
+	printOutput(cmd, stats, func(out io.Writer) {
+		fmt.Fprintln(out, "path", stats.Path)
+		fmt.Fprintln(out, "entries", stats.Entries)
+		fmt.Fprintln(out, "size", stats.Size)
+		if stats.Entries > 0 {
+			fmt.Fprintln(out, "oldest", stats.Oldest.Format(time.RFC3339))
+			fmt.Fprintln(out, "newest", stats.Newest.Format(time.RFC3339))
+		}
+	})
+}
+
+func handlerCachePrune(cmd *cobra.Command, args []string) {
+	olderThan := must(cmd.Flags().GetDuration("older-than"))
+	removed := must(openCache(cmd).Prune(olderThan))
+	fmt.Fprintln(cmd.OutOrStdout(), "removed", removed)
+}
+
+func handlerCacheClear(cmd *cobra.Command, args []string) {
+	must0(openCache(cmd).Clear())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// errChanged is returned when sources have changed, so the process exits
+// with a non-zero status.
+var errChanged = errors.New("sources changed")
+
+func newCmdChanged() *cobra.Command {
+	cmdChanged := &cobra.Command{
+		Use:   "changed <context>",
+		Short: "Check whether sources changed between git refs",
+		Long: "Print files used by the dockerfile that changed in git between " +
+			"--since and --until, or the worktree if --until is not given, " +
+			"and exit with a non-zero status if there's any. The context must " +
+			"be in a git repository, and untracked files are not checked.",
+		Args:          cobra.ExactArgs(1),
+		RunE:          handlerChanged,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmdChanged.Flags().String("since", "", "git ref to compare from")
+	cmdChanged.Flags().String("until", "", "git ref to compare to, the worktree by default")
+	cmdChanged.Flags().StringP("output", "o", "text", "output format: text or json")
+	cmdChanged.MarkFlagRequired("since")
+	return cmdChanged
+}
+
+type changedResult struct {
+	Changed bool     `json:"changed"`
+	Files   []string `json:"files"`
+}
+
+func handlerChanged(cmd *cobra.Command, args []string) error {
+	config := loadConfig(cmd, args[0])
+
+	files := must(checksum.ChangedFiles(
+		config,
+		must(cmd.Flags().GetString("since")),
+		must(cmd.Flags().GetString("until")),
+	))
+
+	res := changedResult{Changed: len(files) > 0, Files: files}
+	printOutput(cmd, res, func(out io.Writer) {
+		for _, file := range files {
+			fmt.Fprintln(out, file)
+		}
+	})
+
+	if res.Changed {
+		return errChanged
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+// commonPlatforms are completed for --platform, as any platform can be
+// given.
+var commonPlatforms = []string{
+	"linux/amd64",
+	"linux/arm64",
+	"linux/arm/v7",
+	"linux/arm/v6",
+	"linux/386",
+	"linux/ppc64le",
+	"linux/s390x",
+	"linux/riscv64",
+	"windows/amd64",
+}
+
+// registerCompletions completes values of flags of the root command in the
+// completion command cobra adds.
+func registerCompletions(cmd *cobra.Command) {
+	for flag, values := range map[string][]string{
+		"hash":     checksum.HashAlgorithms,
+		"platform": commonPlatforms,
+	} {
+		must0(cmd.RegisterFlagCompletionFunc(flag, completeList(values)))
+	}
+
+	for flag, values := range map[string][]string{
+		"log-format":      {"text", "json"},
+		"progress":        {progressNone, progressAuto, progressPlain, progressTTY},
+		"large-file-mode": {checksum.LargeFileContent, checksum.LargeFileMetadata, checksum.LargeFileChunked},
+		"remote-add":      {checksum.RemoteAddHead, checksum.RemoteAddFetch, checksum.RemoteAddOff},
+		"depfile-format":  depfileFormats,
+	} {
+		must0(cmd.RegisterFlagCompletionFunc(flag, cobra.FixedCompletions(
+			values, cobra.ShellCompDirectiveNoFileComp,
+		)))
+	}
+}
+
+// completeList completes the last of values separated by commas, leaving
+// out values that are already given.
+func completeList(values []string) func(
+	*cobra.Command, []string, string,
+) ([]string, cobra.ShellCompDirective) {
+	return func(
+		_ *cobra.Command, _ []string, toComplete string,
+	) ([]string, cobra.ShellCompDirective) {
+		var given []string
+		if i := strings.LastIndex(toComplete, ","); i >= 0 {
+			given = strings.Split(toComplete[:i], ",")
+		}
+		prefix := strings.Join(append(given, ""), ",")
+
+		var res []string
+	values:
+		for _, value := range values {
+			for _, g := range given {
+				if g == value {
+					continue values
+				}
+			}
+			res = append(res, prefix+value)
+		}
+		return res, cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveNoSpace
+	}
+}
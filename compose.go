@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var defaultComposeFiles = []string{
+	"compose.yaml",
+	"compose.yml",
+	"docker-compose.yml",
+	"docker-compose.yaml",
+}
+
+func newCmdCompose() *cobra.Command {
+	cmdCompose := &cobra.Command{
+		Use:   "compose [services...]",
+		Short: "Print checksums of services in a compose file",
+		Long: "Print the checksum of each service with a build section in a " +
+			"compose file, and a combined checksum of the project. All services " +
+			"are used if none is given. Build args, labels and platforms from " +
+			"flags are used as defaults for every service.",
+		Run: handlerCompose,
+	}
+	cmdCompose.Flags().String(
+		"compose-file",
+		"",
+		fmt.Sprintf("compose file to read, %v by default", defaultComposeFiles),
+	)
+	cmdCompose.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdCompose
+}
+
+type composeResult struct {
+	Name     string            `json:"name"`
+	Services map[string]string `json:"services"`
+	Project  string            `json:"project"`
+}
+
+func handlerCompose(cmd *cobra.Command, args []string) {
+	path := must(cmd.Flags().GetString("compose-file"))
+	if path == "" {
+		path = must(findComposeFile())
+	}
+
+	project := must(parseComposeFile(path))
+
+	services := args
+	if len(services) == 0 {
+		for name, service := range project.Services {
+			if service.Build != nil {
+				services = append(services, name)
+			}
+		}
+	}
+	sort.Strings(services)
+
+	res := composeResult{Name: project.Name, Services: map[string]string{}}
+	base := loadConfig(cmd, ".")
+	base.Cache = openSharedCache(base)
+
+	for _, name := range services {
+		config := must(project.config(name, filepath.Dir(path), base))
+		res.Services[name] = must(checksum.CalculateDockerfileChecksum(config))
+	}
+
+	must0(base.Cache.Save())
+
+	res.Project = must(checksum.CombineChecksums(base.Algorithm(), res.Services))
+
+	displayChecksums(cmd, base, res.Services)
+	res.Project = displayChecksum(cmd, base, res.Project)
+	printOutput(cmd, res, func(out io.Writer) {
+		for _, name := range services {
+			fmt.Fprintln(out, name, res.Services[name])
+		}
+		fmt.Fprintln(out, res.Name, res.Project)
+	})
+}
+
+func findComposeFile() (string, error) {
+	for _, path := range defaultComposeFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf(
+		"no compose file found, tried %v", defaultComposeFiles,
+	)
+}
+
+type composeProject struct {
+	Name     string                    `yaml:"name"`
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Build *composeBuild `yaml:"build"`
+}
+
+type composeBuild struct {
+	Context            string         `yaml:"context"`
+	Dockerfile         string         `yaml:"dockerfile"`
+	Target             string         `yaml:"target"`
+	Args               composeMapping `yaml:"args"`
+	Labels             composeMapping `yaml:"labels"`
+	Platforms          []string       `yaml:"platforms"`
+	AdditionalContexts composeMapping `yaml:"additional_contexts"`
+}
+
+// UnmarshalYAML accepts the short syntax, where build is the context.
+func (b *composeBuild) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&b.Context)
+	}
+
+	type plain composeBuild
+	return node.Decode((*plain)(b))
+}
+
+// composeMapping is a mapping that can also be written as a list of
+// KEY=VALUE.
+type composeMapping map[string]string
+
+func (m *composeMapping) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return node.Decode((*map[string]string)(m))
+	}
+
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+
+	*m = composeMapping{}
+	for _, item := range list {
+		key, value, _ := strings.Cut(item, "=")
+		(*m)[key] = value
+	}
+	return nil
+}
+
+// parseComposeFile parses a compose file, with variables interpolated from
+// the environment. The project name defaults to the name of the directory
+// of the compose file.
+func parseComposeFile(path string) (*composeProject, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read compose file")
+	}
+
+	interpolated, err := interpolate(string(content), os.LookupEnv)
+	if err != nil {
+		return nil, errors.Wrap(err, "interpolate compose file")
+	}
+
+	var project composeProject
+	if err := yaml.Unmarshal([]byte(interpolated), &project); err != nil {
+		return nil, errors.Wrap(err, "parse compose file")
+	}
+
+	if project.Name == "" {
+		dir, err := filepath.Abs(filepath.Dir(path))
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve compose file")
+		}
+		project.Name = filepath.Base(dir)
+	}
+
+	return &project, nil
+}
+
+var interpolation = regexp.MustCompile(
+	`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?[-?])([^}]*))?\}|\$([A-Za-z_][A-Za-z0-9_]*)`,
+)
+
+// interpolate replaces variables in s as compose does, supporting $VAR,
+// ${VAR}, ${VAR:-default}, ${VAR-default}, ${VAR:?error}, ${VAR?error} and
+// $$ for a literal $.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var err error
+	res := interpolation.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		groups := interpolation.FindStringSubmatch(match)
+		name, op, arg := groups[1], groups[2], groups[3]
+		if name == "" {
+			name = groups[4]
+		}
+
+		value, ok := lookup(name)
+		unset := !ok || (strings.HasPrefix(op, ":") && value == "")
+
+		switch {
+		case unset && strings.HasSuffix(op, "-"):
+			return arg
+		case unset && strings.HasSuffix(op, "?"):
+			err = errors.Errorf("required variable %s is missing: %s", name, arg)
+		}
+		return value
+	})
+	return res, err
+}
+
+// config returns the checksum config for a service. Paths in the compose
+// file are relative to dir.
+func (p *composeProject) config(
+	name, dir string,
+	base checksum.Config,
+) (checksum.Config, error) {
+	service, ok := p.Services[name]
+	if !ok {
+		return checksum.Config{}, errors.Errorf("no service named %s", name)
+	}
+	if service.Build == nil {
+		return checksum.Config{}, errors.Errorf("service %s has no build", name)
+	}
+
+	build := service.Build
+
+	context := build.Context
+	if context == "" {
+		context = "."
+	}
+
+	config := base
+	config.Workdir = contextDir(joinRelative(dir, context))
+	config.Dockerfile = defaultDockerfile(config.Workdir)
+	if build.Dockerfile != "" {
+		config.Dockerfile = joinRelative(config.Workdir, build.Dockerfile)
+	}
+	config.BuildArgs = mergeMap(base.BuildArgs, build.Args)
+	config.Labels = mergeMap(base.Labels, build.Labels)
+	if build.Target != "" {
+		config.Target = build.Target
+	}
+	if build.Platforms != nil {
+		config.Platforms = build.Platforms
+	}
+
+	config.BuildContexts = map[string]string{}
+	contexts := mergeMap(base.BuildContexts, build.AdditionalContexts)
+	for key, value := range contexts {
+		config.BuildContexts[key] = joinRelative(dir, value)
+	}
+
+	return config, nil
+}
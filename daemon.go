@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func newCmdDaemon() *cobra.Command {
+	cmdDaemon := &cobra.Command{
+		Use:   "daemon [contexts...]",
+		Short: "Keep checksums of contexts up to date and answer queries",
+		Long: "Watch each context, the current directory by default, and keep " +
+			"its checksum up to date, only reading files that changed. " +
+			"Queries are answered on a unix socket, so `daemon query <context>` " +
+			"returns the checksum right away. Contexts are queried by the " +
+			"path they're given with. Flags are used for every context.",
+		Run: handlerDaemon,
+	}
+	cmdDaemon.PersistentFlags().String(
+		"socket",
+		"",
+		"unix socket to answer queries on, daemon.sock in the cache directory by default",
+	)
+	cmdDaemon.Flags().Duration(
+		"debounce",
+		200*time.Millisecond,
+		"time to wait for changes to settle before recalculating",
+	)
+	addPprofFlag(cmdDaemon)
+
+	cmdQuery := &cobra.Command{
+		Use:   "query <context>",
+		Short: "Print the checksum of a context from the daemon",
+		Args:  cobra.ExactArgs(1),
+		Run:   handlerDaemonQuery,
+	}
+	cmdDaemon.AddCommand(cmdQuery)
+
+	return cmdDaemon
+}
+
+// daemonSocket returns the path of the socket of the daemon.
+func daemonSocket(cmd *cobra.Command) (string, error) {
+	if path := must(cmd.Flags().GetString("socket")); path != "" {
+		return path, nil
+	}
+	dir := defaultCacheDir()
+	if dir == "" {
+		return "", errors.New("no cache directory for the socket, set --socket")
+	}
+	return filepath.Join(dir, "daemon.sock"), nil
+}
+
+func handlerDaemon(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	debounce := must(cmd.Flags().GetDuration("debounce"))
+	servePprof(cmd)
+
+	targets := map[string]*daemonTarget{}
+	for _, context := range args {
+		config := loadConfig(cmd, context)
+		config.Cache = openSharedCache(config)
+
+		target := &daemonTarget{config: config}
+		must0(target.start(debounce))
+		defer target.stop()
+		targets[context] = target
+	}
+
+	path := must(daemonSocket(cmd))
+	must0(os.MkdirAll(filepath.Dir(path), 0o755))
+	// A socket left by a daemon that didn't exit cleanly can't be listened
+	// on again.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		must0(errors.Errorf("a daemon is already listening on %s", path))
+	}
+	os.Remove(path)
+
+	listener := must(net.Listen("unix", path))
+	logger.Info("answer queries", "path", path)
+
+	// Closing the listener removes the socket.
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		must0(err)
+		go serveDaemonConn(conn, targets)
+	}
+}
+
+// serveDaemonConn answers queries of a connection, one per line. A query is
+// answered with the checksum, or error and the error message.
+func serveDaemonConn(conn net.Conn, targets map[string]*daemonTarget) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command, name, _ := strings.Cut(scanner.Text(), " ")
+
+		var (
+			sum string
+			err error
+		)
+		if target, ok := targets[name]; command != "query" {
+			err = errors.Errorf("unknown command %s", command)
+		} else if !ok {
+			err = errors.Errorf("unknown context %s", name)
+		} else {
+			sum, err = target.checksum()
+		}
+
+		if err != nil {
+			fmt.Fprintln(conn, "error", strings.ReplaceAll(err.Error(), "\n", " "))
+		} else {
+			fmt.Fprintln(conn, sum)
+		}
+	}
+}
+
+// daemonTarget keeps the checksum of a context up to date.
+type daemonTarget struct {
+	config  checksum.Config
+	watcher *fsnotify.Watcher
+
+	mu  sync.Mutex
+	res *checksum.Result
+	err error
+	// pending are paths that changed since the checksum was calculated.
+	pending []string
+}
+
+// start calculates the checksum and recalculates it once changes settle for
+// debounce.
+func (t *daemonTarget) start(debounce time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	t.watcher = watcher
+
+	t.err = recoverError(func() (err error) {
+		t.res, err = checksum.Calculate(t.config)
+		return err
+	})
+	if t.err != nil {
+		logger.Error("calculate checksum", "path", t.config.Workdir, "error", t.err)
+	}
+	t.watch()
+
+	go func() {
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				logger.Debug("source changed", "event", event)
+				t.changed(event.Name)
+				timer.Reset(debounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("watch sources", "error", err)
+			case <-timer.C:
+				t.mu.Lock()
+				t.update()
+				t.mu.Unlock()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *daemonTarget) stop() {
+	t.watcher.Close()
+}
+
+// watch adds sources to the watcher, including new directories.
+func (t *daemonTarget) watch() {
+	if err := recoverError(func() error { return watchSources(t.watcher, t.config) }); err != nil {
+		logger.Warn("watch sources", "error", err)
+	}
+}
+
+func (t *daemonTarget) changed(path string) {
+	path = resultPath(t.config, path)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, path)
+}
+
+// resultPath returns a changed path as it's keyed in a result, relative to
+// the context it's in and prefixed with the name of a named context and a
+// colon. A path in none of the contexts changes everything.
+func resultPath(config checksum.Config, path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "."
+	}
+
+	roots := localContexts(config)
+	roots[""] = config.Workdir
+
+	res, longest := ".", -1
+	for name, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil || len(root) <= longest {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		res, longest = filepath.ToSlash(rel), len(root)
+		if name != "" {
+			// The root of a named context changes everything in it.
+			if rel == "." {
+				res = "."
+			} else {
+				res = name + ":" + res
+			}
+		}
+	}
+	return res
+}
+
+// update recalculates the checksum if there are pending changes. It's
+// called with mu held.
+func (t *daemonTarget) update() {
+	if len(t.pending) == 0 && t.err == nil {
+		return
+	}
+
+	// A panic of a broken context is its error, so the other contexts are
+	// still answered.
+	t.err = recoverError(func() (err error) {
+		if t.res == nil {
+			t.res, err = checksum.Calculate(t.config)
+			return err
+		}
+		return t.res.Update(t.pending)
+	})
+	// Changes are kept until they're used, as a failed update leaves the
+	// result as it was.
+	if t.err == nil {
+		t.pending = nil
+		t.err = t.config.Cache.Save()
+	}
+	t.watch()
+
+	if t.err != nil {
+		logger.Error("calculate checksum", "path", t.config.Workdir, "error", t.err)
+	}
+}
+
+// recoverError returns the error fn returns or panics with.
+func recoverError(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+	return fn()
+}
+
+// checksum returns the checksum, first applying pending changes so it's
+// never out of date.
+func (t *daemonTarget) checksum() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.update()
+	if t.err != nil {
+		return "", t.err
+	}
+	return newChecksumResult(t.config, t.res.Algorithm, t.res.Checksum).Prefixed(), nil
+}
+
+func handlerDaemonQuery(cmd *cobra.Command, args []string) {
+	conn := must(net.Dial("unix", must(daemonSocket(cmd))))
+	defer conn.Close()
+
+	fmt.Fprintln(conn, "query", args[0])
+
+	reply := must(bufio.NewReader(conn).ReadString('\n'))
+	reply = strings.TrimSuffix(reply, "\n")
+	if message, ok := strings.CutPrefix(reply, "error "); ok {
+		must0(errors.New(message))
+	}
+	if must(cmd.Flags().GetBool("raw")) {
+		reply = reply[strings.LastIndex(reply, ":")+1:]
+	}
+	fmt.Fprint(cmd.OutOrStdout(), reply)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+)
+
+// dependencies are the dockerfile and source files of calculations, as
+// paths to read them at.
+type dependencies map[string]bool
+
+// collectDependencies adds every file written to the hash by calculations
+// with config to the returned dependencies.
+func collectDependencies(config *checksum.Config) dependencies {
+	deps := dependencies{}
+	dir := config.Workdir
+	config.OnInput = func(in checksum.Input) {
+		switch in.Kind {
+		case checksum.InputDockerfile:
+			if in.Path != "-" {
+				deps[in.Path] = true
+			}
+		case checksum.InputContext:
+			dir = in.Path
+		case checksum.InputFile:
+			deps[filepath.Join(dir, filepath.FromSlash(in.Path))] = true
+		}
+	}
+	return deps
+}
+
+// sorted returns the paths of the dependencies in order.
+func (deps dependencies) sorted() []string {
+	paths := make([]string, 0, len(deps))
+	for path := range deps {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// makeDepfile returns a Makefile fragment with deps as prerequisites of
+// target, as gcc -MD -MP writes it: every dependency also gets an empty
+// rule, so make doesn't fail when one is removed.
+func makeDepfile(target string, deps dependencies) string {
+	var b strings.Builder
+	b.WriteString(ninjaDepfile(target, deps))
+	for _, path := range deps.sorted() {
+		b.WriteString("\n" + escapeMake(path) + ":\n")
+	}
+	return b.String()
+}
+
+// ninjaDepfile returns a depfile for Ninja, which has the syntax of a
+// Makefile but only takes the rule of target.
+func ninjaDepfile(target string, deps dependencies) string {
+	var b strings.Builder
+	b.WriteString(escapeMake(target) + ":")
+	for _, path := range deps.sorted() {
+		b.WriteString(" \\\n  " + escapeMake(path))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// ninjaDyndep returns a Ninja dyndep file adding deps as implicit inputs of
+// target.
+func ninjaDyndep(target string, deps dependencies) string {
+	var b strings.Builder
+	b.WriteString("ninja_dyndep_version = 1\n")
+	b.WriteString("build " + escapeNinja(target) + ": dyndep |")
+	for _, path := range deps.sorted() {
+		b.WriteString(" $\n    " + escapeNinja(path))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+var depfileFormats = []string{"make", "ninja", "dyndep"}
+
+// formatDepfile returns the depfile of target in one of depfileFormats.
+func formatDepfile(format, target string, deps dependencies) (string, error) {
+	switch format {
+	case "make":
+		return makeDepfile(target, deps), nil
+	case "ninja":
+		return ninjaDepfile(target, deps), nil
+	case "dyndep":
+		return ninjaDyndep(target, deps), nil
+	default:
+		return "", errors.Errorf("unknown depfile format %s", format)
+	}
+}
+
+var makeEscaper = strings.NewReplacer(" ", `\ `, "#", `\#`, "$", "$$")
+
+// escapeMake escapes a path in a rule of a Makefile.
+func escapeMake(path string) string {
+	return makeEscaper.Replace(filepath.ToSlash(path))
+}
+
+var ninjaEscaper = strings.NewReplacer(" ", "$ ", ":", "$:", "$", "$$")
+
+// escapeNinja escapes a path in a build statement of a Ninja file.
+func escapeNinja(path string) string {
+	return ninjaEscaper.Replace(filepath.ToSlash(path))
+}
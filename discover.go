@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdDiscover() *cobra.Command {
+	cmdDiscover := &cobra.Command{
+		Use:   "discover [dir]",
+		Short: "Print checksums of every dockerfile in a directory",
+		Long: "Find dockerfiles under a directory, the current directory by " +
+			"default, and print the checksum of each, using the directory of " +
+			"the dockerfile as the build context. Build args, labels and " +
+			"platforms from flags are used for every dockerfile.",
+		Args: cobra.MaximumNArgs(1),
+		Run:  handlerDiscover,
+	}
+	cmdDiscover.Flags().StringSlice(
+		"pattern",
+		[]string{
+			"Dockerfile", "*.Dockerfile", "Dockerfile.*",
+			"Containerfile", "*.Containerfile", "Containerfile.*",
+		},
+		"file name patterns of dockerfiles",
+	)
+	cmdDiscover.Flags().StringSlice(
+		"skip-dir",
+		[]string{".git", "node_modules"},
+		"names of directories to skip",
+	)
+	cmdDiscover.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdDiscover
+}
+
+func handlerDiscover(cmd *cobra.Command, args []string) {
+	root := "."
+	if len(args) > 0 {
+		root = args[0]
+	}
+
+	patterns := must(cmd.Flags().GetStringSlice("pattern"))
+	skipDirs := must(cmd.Flags().GetStringSlice("skip-dir"))
+
+	dockerfiles := must(findDockerfiles(root, patterns, skipDirs))
+
+	base := loadConfig(cmd, root)
+	base.Cache = openSharedCache(base)
+
+	sums := map[string]string{}
+	for _, dockerfile := range dockerfiles {
+		config := base
+		config.Dockerfile = dockerfile
+		config.Workdir = filepath.Dir(dockerfile)
+		sums[dockerfile] = must(checksum.CalculateDockerfileChecksum(config))
+	}
+
+	must0(base.Cache.Save())
+
+	displayChecksums(cmd, base, sums)
+	printOutput(cmd, sums, func(out io.Writer) {
+		for _, dockerfile := range dockerfiles {
+			fmt.Fprintln(out, dockerfile, sums[dockerfile])
+		}
+	})
+}
+
+// findDockerfiles returns files under root with names matching any of
+// patterns, in lexical order.
+func findDockerfiles(root string, patterns, skipDirs []string) ([]string, error) {
+	skip := map[string]bool{}
+	for _, dir := range skipDirs {
+		skip[dir] = true
+	}
+
+	var dockerfiles []string
+	err := filepath.WalkDir(root, func(
+		path string, d fs.DirEntry, err error,
+	) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if path != root && skip[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Dockerfile.dockerignore is an ignore file, not a dockerfile.
+		if strings.HasSuffix(d.Name(), ".dockerignore") ||
+			strings.HasSuffix(d.Name(), ".containerignore") {
+			return nil
+		}
+
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, d.Name()); ok {
+				dockerfiles = append(dockerfiles, path)
+				break
+			}
+		}
+		return nil
+	})
+
+	return dockerfiles, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// errImageNotFound is returned when there's no image for the checksum, so
+// the process exits with a non-zero status.
+var errImageNotFound = errors.New("image not found")
+
+func newCmdExists() *cobra.Command {
+	cmdExists := &cobra.Command{
+		Use:   "exists <context>",
+		Short: "Check whether an image with the checksum tag exists",
+		Long: "Calculate the checksum and check whether --image is in the " +
+			"registry with the checksum tag. The image is printed and the exit " +
+			"status is zero if it exists, so a build can be skipped. " +
+			"Credentials are read from the docker config.",
+		Args:          cobra.ExactArgs(1),
+		RunE:          handlerExists,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmdExists.Flags().String("image", "", "image repository to look up")
+	cmdExists.Flags().String(
+		"tag",
+		defaultTagTemplate,
+		"Go template of the image tag, e.g. {{ .Short 12 }}",
+	)
+	cmdExists.Flags().StringP("output", "o", "text", "output format: text or json")
+	cmdExists.MarkFlagRequired("image")
+	return cmdExists
+}
+
+type existsResult struct {
+	Image  string `json:"image"`
+	Exists bool   `json:"exists"`
+}
+
+func handlerExists(cmd *cobra.Command, args []string) error {
+	config := loadConfig(cmd, args[0])
+
+	sum := must(checksum.CalculateDockerfileChecksum(config))
+	tag := must(renderTag(must(cmd.Flags().GetString("tag")), config, sum))
+
+	ref := must(name.ParseReference(
+		must(cmd.Flags().GetString("image")) + ":" + tag,
+	))
+
+	res := existsResult{Image: ref.String(), Exists: must(imageExists(ref))}
+	printOutput(cmd, res, func(out io.Writer) {
+		if res.Exists {
+			fmt.Fprintln(out, res.Image)
+		}
+	})
+
+	if !res.Exists {
+		return errImageNotFound
+	}
+	return nil
+}
+
+// imageExists reports whether the registry has a manifest for ref.
+func imageExists(ref name.Reference) (bool, error) {
+	_, err := remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "look up %s", ref)
+	}
+	return true, nil
+}
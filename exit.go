@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"runtime/debug"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the binary, so scripts can tell changed inputs from
+// failures.
+const (
+	exitOK = 0
+	// exitError is any failure without a more specific code.
+	exitError = 1
+	// exitUsage is an unknown command, bad flags or arguments.
+	exitUsage = 2
+	// exitMismatch is a checksum that doesn't match: --verify, an out of
+	// date lockfile, changed sources, or no image with the checksum.
+	exitMismatch = 3
+	// exitMissingSource is a missing dockerfile, or a missing source in
+	// strict mode.
+	exitMissingSource = 4
+	// exitParse is a dockerfile that can't be parsed.
+	exitParse = 5
+)
+
+// usageError is an error in how the binary is called.
+type usageError struct{ error }
+
+func (e usageError) Unwrap() error { return e.error }
+
+// usageErrorf returns a usageError with a formatted message.
+func usageErrorf(format string, args ...any) error {
+	return usageError{errors.Errorf(format, args...)}
+}
+
+// runError is an error of a handler, as opposed to an error cobra returns
+// before running it, which is a usage error.
+type runError struct{ error }
+
+func (e runError) Unwrap() error { return e.error }
+
+// execute runs cmd and returns the exit code.
+func execute(cmd *cobra.Command) int {
+	catchErrors(cmd)
+	return exitCode(cmd.Execute())
+}
+
+// catchErrors makes handlers of cmd and its subcommands return errors they
+// panic with, instead of crashing, and marks their errors as runErrors.
+func catchErrors(cmd *cobra.Command) {
+	for _, sub := range cmd.Commands() {
+		catchErrors(sub)
+	}
+	if cmd.Run == nil && cmd.RunE == nil {
+		return
+	}
+
+	run, runE := cmd.Run, cmd.RunE
+	cmd.Run = nil
+	cmd.RunE = func(cmd *cobra.Command, args []string) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				// Errors a handler returns may be printed by itself, but it
+				// doesn't know about these.
+				cmd.SilenceErrors = false
+				err = panicError(r)
+			}
+			if err != nil {
+				cmd.SilenceUsage = true
+				err = runError{err}
+				if !cmd.SilenceErrors && jsonOutput(cmd) {
+					cmd.SilenceErrors = true
+					printErrorJSON(cmd, err)
+				}
+			}
+		}()
+
+		if runE != nil {
+			return runE(cmd, args)
+		}
+		run(cmd, args)
+		return nil
+	}
+}
+
+// panicError returns the error a handler panicked with. Anything else is a
+// bug, so it's returned with the stack.
+func panicError(r any) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return errors.Errorf("panic: %v\n%s", r, debug.Stack())
+}
+
+// errorOutput is an error printed with --output json.
+type errorOutput struct {
+	// Code names the exit code, e.g. parse for exitParse.
+	Code     string `json:"code"`
+	ExitCode int    `json:"exitCode"`
+	Message  string `json:"message"`
+	// Path is the missing source in strict mode.
+	Path       string `json:"path,omitempty"`
+	Dockerfile string `json:"dockerfile,omitempty"`
+	// Line is the line of the dockerfile with a parse error.
+	Line int `json:"line,omitempty"`
+}
+
+// exitCodeNames are the codes of errorOutput.
+var exitCodeNames = map[int]string{
+	exitError:         "error",
+	exitUsage:         "usage",
+	exitMismatch:      "mismatch",
+	exitMissingSource: "missing-source",
+	exitParse:         "parse",
+}
+
+// jsonOutput returns whether cmd prints JSON, so errors are JSON too.
+func jsonOutput(cmd *cobra.Command) bool {
+	output := cmd.Flags().Lookup("output")
+	return output != nil && output.Value.String() == "json"
+}
+
+// printErrorJSON prints err of cmd as an errorOutput on stderr.
+func printErrorJSON(cmd *cobra.Command, err error) {
+	code := exitCode(err)
+	res := errorOutput{Code: exitCodeNames[code], ExitCode: code, Message: err.Error()}
+
+	var (
+		source   *checksum.SourceError
+		parse    *checksum.ParseError
+		notExist *fs.PathError
+	)
+	switch {
+	case errors.As(err, &source):
+		res.Path = source.Path
+	case errors.As(err, &parse):
+		res.Dockerfile, res.Line = parse.Dockerfile, parse.Line
+	case errors.Is(err, checksum.ErrDockerfileNotFound) && errors.As(err, &notExist):
+		res.Dockerfile = notExist.Path
+	}
+
+	json.NewEncoder(cmd.ErrOrStderr()).Encode(res)
+}
+
+// exitCode returns the exit code for an error of execute.
+func exitCode(err error) int {
+	var (
+		run   runError
+		usage usageError
+	)
+	switch {
+	case err == nil:
+		return exitOK
+	case !errors.As(err, &run), errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, errMismatch),
+		errors.Is(err, errLockOutdated),
+		errors.Is(err, errChanged),
+		errors.Is(err, errImageNotFound):
+		return exitMismatch
+	case errors.Is(err, checksum.ErrDockerfileNotFound),
+		errors.Is(err, checksum.ErrSourceMissing):
+		return exitMissingSource
+	case errors.Is(err, checksum.ErrParse):
+		return exitParse
+	default:
+		return exitError
+	}
+}
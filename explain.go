@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdExplain() *cobra.Command {
+	cmdExplain := &cobra.Command{
+		Use:   "explain <context>",
+		Short: "Print everything added to the checksum in order",
+		Args:  cobra.ExactArgs(1),
+		Run:   handlerExplain,
+	}
+	cmdExplain.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdExplain
+}
+
+func handlerExplain(cmd *cobra.Command, args []string) {
+	config := loadConfig(cmd, args[0])
+
+	sum, inputs, err := checksum.ExplainDockerfileChecksum(config)
+	must0(err)
+	sum = displayChecksum(cmd, config, sum)
+
+	explanation := map[string]any{"checksum": sum, "inputs": inputs}
+
+	printOutput(cmd, explanation, func(out io.Writer) {
+		for _, in := range inputs {
+			fmt.Fprintln(out, in)
+		}
+		fmt.Fprintln(out, "checksum", sum)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// checksumResult is the data of --format and tag templates.
+type checksumResult struct {
+	Checksum  string `json:"checksum"`
+	Algorithm string `json:"algorithm"`
+	// Version is the hash version the checksum was calculated with.
+	Version int `json:"-"`
+}
+
+// newChecksumResult returns the result for a checksum calculated with
+// algorithm and the hash version of config.
+func newChecksumResult(
+	config checksum.Config,
+	algorithm, sum string,
+) checksumResult {
+	version := config.HashVersion
+	if version == 0 {
+		version = checksum.HashVersion1
+	}
+	return checksumResult{Checksum: sum, Algorithm: algorithm, Version: version}
+}
+
+// displayChecksum returns a checksum calculated with config as it's printed,
+// prefixed with its scheme unless --raw is set.
+func displayChecksum(cmd *cobra.Command, config checksum.Config, sum string) string {
+	if must(cmd.Flags().GetBool("raw")) {
+		return sum
+	}
+	return newChecksumResult(config, config.Algorithm(), sum).Prefixed()
+}
+
+// displayChecksums replaces every checksum of sums with displayChecksum.
+func displayChecksums(cmd *cobra.Command, config checksum.Config, sums map[string]string) {
+	for key, sum := range sums {
+		sums[key] = displayChecksum(cmd, config, sum)
+	}
+}
+
+// Scheme returns the hash version and algorithm, e.g. v1:sha1.
+func (r checksumResult) Scheme() string {
+	return fmt.Sprintf("v%d:%s", r.Version, r.Algorithm)
+}
+
+// Prefixed returns the checksum prefixed with its scheme, e.g.
+// v1:sha1:<hex>.
+func (r checksumResult) Prefixed() string {
+	return r.Scheme() + ":" + r.Checksum
+}
+
+// Hex returns the checksum in hex.
+func (r checksumResult) Hex() string {
+	return r.Checksum
+}
+
+// Short returns the first n characters of the checksum.
+func (r checksumResult) Short(n int) string {
+	if n >= len(r.Checksum) {
+		return r.Checksum
+	}
+	return r.Checksum[:n]
+}
+
+// renderTemplate executes a Go template with r.
+func renderTemplate(text string, r checksumResult) (string, error) {
+	tmpl, err := template.New("format").Parse(text)
+	if err != nil {
+		return "", errors.Wrap(err, "parse template")
+	}
+
+	var res strings.Builder
+	if err := tmpl.Execute(&res, r); err != nil {
+		return "", errors.Wrap(err, "execute template")
+	}
+	return res.String(), nil
+}
+
+// verifyChecksum returns errMismatch unless expected is the checksum of r,
+// bare or prefixed. A prefixed checksum from another scheme is reported as
+// such, as it can't be compared.
+func verifyChecksum(expected string, r checksumResult) error {
+	if expected == r.Checksum || expected == r.Prefixed() {
+		return nil
+	}
+
+	if i := strings.LastIndex(expected, ":"); i >= 0 && expected[:i] != r.Scheme() {
+		return errors.Wrapf(
+			errMismatch,
+			"expected %s, which is from scheme %s instead of %s",
+			expected, expected[:i], r.Scheme(),
+		)
+	}
+	return errors.Wrapf(errMismatch, "expected %s", expected)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// appendGitHubOutput appends outputs of a GitHub Actions step, as
+// name=value lines, to the file in $GITHUB_OUTPUT.
+func appendGitHubOutput(outputs ...[2]string) error {
+	path := os.Getenv("GITHUB_OUTPUT")
+	if path == "" {
+		return errors.New("GITHUB_OUTPUT is not set")
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "open GitHub output")
+	}
+	defer f.Close()
+
+	for _, output := range outputs {
+		if _, err := fmt.Fprintf(f, "%s=%s\n", output[0], output[1]); err != nil {
+			return errors.Wrap(err, "write GitHub output")
+		}
+	}
+
+	return errors.Wrap(f.Close(), "write GitHub output")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksumpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newGRPCServer returns a gRPC server that recovers from panics of
+// handlers.
+func newGRPCServer() *grpc.Server {
+	return grpc.NewServer(grpc.UnaryInterceptor(recoverPanics))
+}
+
+// recoverPanics returns a panic of a handler as a codes.Internal error.
+// grpc-go doesn't recover them, so one request would crash the server.
+func recoverPanics(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (res any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := panicError(r)
+			logger.Error("handle request", "method", info.FullMethod, "error", panicErr)
+			res, err = nil, status.Error(codes.Internal, panicErr.Error())
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// checksumServer implements the gRPC checksum service. base.Cache is shared
+// by every request and saved after each of them.
+type checksumServer struct {
+	checksumpb.UnimplementedChecksumServiceServer
+
+	base    checksum.Config
+	metrics *serverMetrics
+}
+
+func (s *checksumServer) Checksum(
+	ctx context.Context,
+	req *checksumpb.ChecksumRequest,
+) (*checksumpb.ChecksumResponse, error) {
+	if req.Context == "" {
+		return nil, status.Error(codes.InvalidArgument, "context is required")
+	}
+
+	config := checksumRequest{
+		Context:       req.Context,
+		Dockerfile:    req.Dockerfile,
+		BuildArgs:     req.BuildArgs,
+		BuildContexts: req.BuildContexts,
+		Labels:        req.Labels,
+		Platforms:     req.Platforms,
+		Target:        req.Target,
+	}.config(s.base)
+	config.Stats = &checksum.Stats{}
+	config.SetContext(ctx)
+
+	start := time.Now()
+	m, err := checksum.NewManifest(config)
+	s.metrics.observe("grpc", start, config.Stats, err)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	if err := s.base.Cache.Save(); err != nil {
+		logger.Warn("save digest cache", "error", err)
+	}
+
+	return &checksumpb.ChecksumResponse{
+		Checksum:  m.Checksum,
+		Algorithm: config.Algorithm(),
+		Manifest: &checksumpb.Manifest{
+			Checksum:         m.Checksum,
+			Hash:             m.Hash,
+			Dockerfile:       m.Dockerfile,
+			DockerfileDigest: m.DockerfileDigest,
+			BuildArgs:        m.BuildArgs,
+			Platforms:        m.Platforms,
+			Labels:           m.Labels,
+			Files:            m.Files,
+			Metadata:         m.Metadata,
+		},
+	}, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const defaultLockfile = "docker-source-checksum.lock"
+
+// errLockOutdated is returned when the lockfile doesn't match the build
+// context, so the process exits with a non-zero status.
+var errLockOutdated = errors.New("lockfile is out of date")
+
+func newCmdLock() *cobra.Command {
+	cmdLock := &cobra.Command{
+		Use:   "lock",
+		Short: "Write and verify a lockfile of the checksum and its sources",
+		Long: "Write the checksum and the digest of every source file to a " +
+			"lockfile, to commit along with the sources, and verify that it's " +
+			"up to date. The lockfile is left out of the checksum.",
+	}
+	cmdLock.PersistentFlags().String(
+		"lockfile",
+		"",
+		"path of the lockfile, "+defaultLockfile+" in the context by default",
+	)
+
+	cmdLock.AddCommand(&cobra.Command{
+		Use:   "write [context]",
+		Short: "Write the lockfile of a build context",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   handlerLockWrite,
+	})
+
+	cmdVerify := &cobra.Command{
+		Use:   "verify [context]",
+		Short: "Check that the lockfile matches a build context",
+		Long: "Check that the lockfile matches a build context. What has " +
+			"changed is printed, and the exit status is non-zero, if it doesn't.",
+		Args:          cobra.MaximumNArgs(1),
+		RunE:          handlerLockVerify,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmdVerify.Flags().StringP("output", "o", "text", "output format: text or json")
+	cmdLock.AddCommand(cmdVerify)
+
+	return cmdLock
+}
+
+// lockConfig returns the config of the context in args, "." by default, and
+// the path of its lockfile, which is excluded if it's in the context.
+func lockConfig(cmd *cobra.Command, args []string) (checksum.Config, string) {
+	context := "."
+	if len(args) > 0 {
+		context = args[0]
+	}
+
+	config := loadConfig(cmd, context)
+
+	path := must(cmd.Flags().GetString("lockfile"))
+	if path == "" {
+		path = filepath.Join(config.Workdir, defaultLockfile)
+	}
+
+	rel, err := filepath.Rel(must(filepath.Abs(config.Workdir)), must(filepath.Abs(path)))
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		config.Exclude = append(config.Exclude, filepath.ToSlash(rel))
+	}
+
+	return config, path
+}
+
+func handlerLockWrite(cmd *cobra.Command, args []string) {
+	config, path := lockConfig(cmd, args)
+	manifest := must(checksum.NewManifest(config))
+	must0(manifest.WriteFile(path))
+}
+
+func handlerLockVerify(cmd *cobra.Command, args []string) error {
+	config, path := lockConfig(cmd, args)
+	locked := must(checksum.ReadManifest(path))
+	current := must(checksum.NewManifest(config))
+
+	diff := checksum.DiffManifests(locked, current)
+	if locked.Checksum != current.Checksum && diff.Empty() {
+		diff.Config = append(diff.Config, fmt.Sprintf(
+			"checksum: %s -> %s", locked.Checksum, current.Checksum,
+		))
+	}
+
+	printManifestDiff(cmd, diff)
+
+	if !diff.Empty() {
+		return errLockOutdated
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// logOutput is the handler records are written to, replaced by
+// setupLogging.
+var logOutput atomic.Pointer[slog.Handler]
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo})
+	logOutput.Store(&h)
+}
+
+// logHandler writes logs of the command and the checksum package, as text
+// or JSON. Every record has a component key, cli or checksum, and paths and
+// durations are logged as path and duration. It writes to logOutput, so
+// logging can be set up while other goroutines log.
+var logHandler slog.Handler = outputHandler{}
+
+var logger = slog.New(logHandler).With("component", "cli")
+
+// setupCommandLogging sets up logging for --log-format, --quiet and --debug
+// of cmd. It's run once before every command.
+func setupCommandLogging(cmd *cobra.Command) error {
+	format, err := cmd.Flags().GetString("log-format")
+	if err != nil {
+		return err
+	}
+	quiet, err := cmd.Flags().GetBool("quiet")
+	if err != nil {
+		return err
+	}
+	debug, err := cmd.Flags().GetBool("debug")
+	if err != nil {
+		return err
+	}
+
+	level := slog.LevelInfo
+	if quiet {
+		level = slog.LevelError
+	} else if debug {
+		level = slog.LevelDebug
+	}
+	return setupLogging(cmd.ErrOrStderr(), format, level)
+}
+
+// setupLogging replaces the log handler for --log-format, to write records
+// of level and above to w.
+func setupLogging(w io.Writer, format string, level slog.Level) error {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return errors.Errorf("unknown log format %s", format)
+	}
+
+	logOutput.Store(&h)
+	return nil
+}
+
+// outputHandler is a handler writing to logOutput, with the attributes and
+// groups added by with.
+type outputHandler struct {
+	with func(slog.Handler) slog.Handler
+}
+
+func (h outputHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return (*logOutput.Load()).Enabled(ctx, level)
+}
+
+func (h outputHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.wrap(*logOutput.Load()).Handle(ctx, r)
+}
+
+func (h outputHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return outputHandler{with: func(output slog.Handler) slog.Handler {
+		return h.wrap(output).WithAttrs(attrs)
+	}}
+}
+
+func (h outputHandler) WithGroup(name string) slog.Handler {
+	return outputHandler{with: func(output slog.Handler) slog.Handler {
+		return h.wrap(output).WithGroup(name)
+	}}
+}
+
+// wrap adds the attributes and groups of h to output.
+func (h outputHandler) wrap(output slog.Handler) slog.Handler {
+	if h.with == nil {
+		return output
+	}
+	return h.with(output)
+}
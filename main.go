@@ -1,71 +1,914 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
+	pathpkg "path"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 
+	"github.com/docker/go-units"
 	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
 )
 
-var logger = slog.New(slog.NewTextHandler(
-	os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo},
-))
+// cleanups are run when a command finishes, e.g. to remove a cloned git
+// context.
+var cleanups []func()
+
+func init() {
+	cobra.OnInitialize(setupTracing)
+	cobra.OnFinalize(func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+		cleanups = nil
+	})
+}
 
 func main() {
-	newCmdRoot().Execute()
+	cmd := newCmdRoot()
+	if args, ok := dockerPluginArgs(os.Args); ok {
+		cmd.Use = "docker " + dockerPluginName
+		cmd.Annotations = map[string]string{
+			cobra.CommandDisplayNameAnnotation: "docker " + dockerPluginName,
+		}
+		cmd.SetArgs(args)
+	}
+	os.Exit(execute(cmd))
 }
 
 func newCmdRoot() *cobra.Command {
 	cmdRoot := &cobra.Command{
-		Use: "docker-source-checksum",
-		Run: handlerRoot,
+		Use: "dockerfile-source-checksum",
+		// The context is read from the query of --terraform-external.
+		Args: func(cmd *cobra.Command, args []string) error {
+			if must(cmd.Flags().GetBool("terraform-external")) {
+				return cobra.MaximumNArgs(1)(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		PersistentPreRunE: setupCommand,
+		RunE:              handlerRoot,
 	}
-	cmdRoot.Flags().StringToString(
+	cmdRoot.PersistentFlags().Var(
+		buildArgsValue{},
 		"build-arg",
+		"--build-arg for the docker build command, a KEY alone takes the value from the environment",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"args-from-env",
+		false,
+		"set args declared in the dockerfile from environment variables if they're not given",
+	)
+	cmdRoot.PersistentFlags().StringArray(
+		"build-arg-file",
+		nil,
+		"file with a KEY=VALUE build arg per line, overridden by --build-arg",
+	)
+	cmdRoot.PersistentFlags().StringToString(
+		"build-context",
 		nil,
-		"--build-arg for the docker build command",
+		"--build-context for the docker buildx build command",
 	)
-	cmdRoot.Flags().StringSlice(
+	cmdRoot.PersistentFlags().StringSlice(
 		"platform",
 		[]string{fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)},
 		"--platform for the docker build command",
 	)
-	cmdRoot.Flags().StringToString(
+	cmdRoot.PersistentFlags().StringToString(
 		"label",
 		nil,
 		"--label for the docker build command",
 	)
-	cmdRoot.Flags().String("hash", "sha1", "hash algorithm to use")
-	cmdRoot.Flags().StringP("file", "f", "Dockerfile", "path to dockerfile")
-	cmdRoot.Flags().Bool("debug", false, "print debug logs")
+	cmdRoot.PersistentFlags().String(
+		"target",
+		"",
+		"--target for the docker build command",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"all-stages",
+		false,
+		"use sources of every stage, even if the target doesn't depend on it",
+	)
+	cmdRoot.PersistentFlags().StringArray(
+		"extra-path",
+		nil,
+		"path or glob in the context to add even if the dockerfile doesn't use it",
+	)
+	cmdRoot.PersistentFlags().StringArray(
+		"exclude",
+		nil,
+		"pattern of source paths to leave out of the checksum, in .dockerignore syntax",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"git-tracked-only",
+		false,
+		"only use source files tracked by git",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"git-blobs",
+		false,
+		"use git object ids as file digests instead of reading files unchanged in git",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"strict",
+		false,
+		"fail if a source doesn't exist or a pattern matches nothing",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"skip-unreadable",
+		false,
+		"add a placeholder for sources that can't be read for lack of permission, instead of failing",
+	)
+	cmdRoot.PersistentFlags().Int(
+		"max-depth",
+		0,
+		"fail if a source is nested deeper than this many directories, 0 for no limit",
+	)
+	cmdRoot.PersistentFlags().Int(
+		"max-files",
+		0,
+		"fail if there are more source files than this, 0 for no limit",
+	)
+	cmdRoot.PersistentFlags().Int(
+		"concurrency",
+		runtime.NumCPU(),
+		"number of source files to read at the same time with --hash-version 2",
+	)
+	cmdRoot.PersistentFlags().Float64(
+		"max-read-mbps",
+		0,
+		"limit reads of source files to this many MB per second altogether, 0 for no limit",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"include-onbuild",
+		false,
+		"add sources of ONBUILD COPY and ADD, used by builds based on the image",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"include-metadata",
+		false,
+		"add the mode of every source file and directory",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"include-owner",
+		false,
+		"add the uid and gid of every source file and directory, with --include-metadata",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"include-empty-dirs",
+		false,
+		"add source directories without files as such, so they don't have the checksum of empty files",
+	)
+	cmdRoot.PersistentFlags().StringSlice(
+		"include-xattrs",
+		nil,
+		"extended attributes to add for every source file and directory that has them, e.g. security.capability",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"normalize-eol",
+		false,
+		"hash text files with CRLF replaced by LF, so checkouts with autocrlf have the same checksum",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"normalize-unicode",
+		false,
+		"hash source paths in Unicode NFC, so names in NFD on macOS have the same checksum as on Linux",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"fold-case",
+		false,
+		"hash source paths case folded, so checkouts on case-insensitive filesystems have the same checksum",
+	)
+	cmdRoot.PersistentFlags().String(
+		"hash",
+		"sha1",
+		"hash algorithm to use: sha1, md5, sha256, blake3, or xxhash64, xxh3 or highwayhash for change detection only, or several separated by commas",
+	)
+	cmdRoot.PersistentFlags().Int(
+		"hash-version",
+		checksum.HashVersion1,
+		"how inputs are encoded for the hash: 1, or 2 to length-prefix every field",
+	)
+	cmdRoot.PersistentFlags().StringArrayP(
+		"file",
+		"f",
+		[]string{"Dockerfile"},
+		"path to dockerfile, or - to read it from stdin. Relative paths are "+
+			"looked up in the current directory, then the context. Containerfile "+
+			"in the context is used if Dockerfile doesn't exist. Can be repeated "+
+			"for the root command to print a checksum of each dockerfile",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"cwd-dockerfile",
+		false,
+		"look up the dockerfile only in the current directory, also the default one, instead of the context",
+	)
+	cmdRoot.PersistentFlags().String(
+		"salt",
+		"",
+		"string mixed into the checksum, to tell apart checksums of the same sources",
+	)
+	cmdRoot.PersistentFlags().StringArray(
+		"secret-arg",
+		nil,
+		"build arg with a secret value, only its key is added to the checksum, or an HMAC of its value with --hmac-key-file",
+	)
+	cmdRoot.PersistentFlags().StringSlice(
+		"ignore-build-args",
+		nil,
+		"build args to leave out of the checksum, still used to expand variables",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"ignore-platforms",
+		false,
+		"leave platforms out of the checksum",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"ignore-labels",
+		false,
+		"leave labels out of the checksum",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"normalize-dockerfile",
+		false,
+		"hash the dockerfile without comments and insignificant whitespace",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"canonical-dockerfile",
+		false,
+		"hash the parsed instructions of the dockerfile instead of its content",
+	)
+	cmdRoot.PersistentFlags().String(
+		"hmac-key-file",
+		"",
+		"make the checksum an HMAC keyed with the content of this file",
+	)
+	cmdRoot.PersistentFlags().String(
+		"config",
+		"",
+		"YAML file with defaults for flags, keyed by flag name",
+	)
+	cmdRoot.PersistentFlags().Bool("debug", false, "print debug logs")
+	cmdRoot.PersistentFlags().BoolP(
+		"quiet",
+		"q",
+		false,
+		"print nothing but the output, without warnings or progress",
+	)
+	cmdRoot.PersistentFlags().BoolP(
+		"no-newline",
+		"n",
+		false,
+		"leave out the trailing newline of subcommands, several dockerfiles and --format; a single checksum has none",
+	)
+	cmdRoot.PersistentFlags().String("log-format", "text", "format of logs on stderr: text or json")
+	cmdRoot.PersistentFlags().String(
+		"cpuprofile",
+		"",
+		"write a CPU profile of the command into this file, for go tool pprof",
+	)
+	cmdRoot.PersistentFlags().String(
+		"memprofile",
+		"",
+		"write a heap profile into this file when the command finishes, for go tool pprof",
+	)
+	cmdRoot.PersistentFlags().String(
+		"progress",
+		progressNone,
+		"report files and bytes read on stderr: none, auto, plain or tty",
+	)
+	cmdRoot.PersistentFlags().Bool("no-cache", false, "do not use cached file digests")
+	cmdRoot.PersistentFlags().String(
+		"cache-dir",
+		"",
+		"directory of the cache of file digests, the user cache directory by default",
+	)
+	cmdRoot.PersistentFlags().String(
+		"remote-cache",
+		"",
+		"URL of a cache of file digests shared between machines: http(s)://, s3:// or redis://",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"pin-from",
+		false,
+		"add registry digests of images in FROM for each platform",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"pin-copy-from",
+		false,
+		"add registry digests of images in COPY --from and RUN --mount=from for each platform",
+	)
+	cmdRoot.PersistentFlags().String(
+		"large-file-mode",
+		checksum.LargeFileContent,
+		"how files above --large-file-threshold are added: content, metadata for their size and modification time, or chunked to read chunks in parallel",
+	)
+	cmdRoot.PersistentFlags().String(
+		"large-file-threshold",
+		"1GB",
+		"size of the largest file that is always read as a whole, with --large-file-mode metadata or chunked",
+	)
+	cmdRoot.PersistentFlags().String(
+		"large-file-chunk-size",
+		"64MB",
+		"size of chunks of large files with --large-file-mode chunked",
+	)
+	cmdRoot.PersistentFlags().String(
+		"remote-add",
+		checksum.RemoteAddOff,
+		"how URLs in ADD are added: off, head (ETag or Last-Modified) or fetch (content digest)",
+	)
+
+	cmdRoot.Flags().String(
+		"format",
+		"",
+		"print the checksum with a Go template, e.g. 'myapp:{{ .Short 12 }}' or '{{ .Algorithm }}:{{ .Hex }}'",
+	)
+
+	cmdRoot.Flags().Bool(
+		"stats",
+		false,
+		"print the number of files, bytes read, cache hits and time of each step on stderr, or in the JSON output",
+	)
+	cmdRoot.Flags().StringP(
+		"output",
+		"o",
+		"text",
+		"output format with several dockerfiles, and of errors: text or json",
+	)
+	cmdRoot.PersistentFlags().Bool(
+		"raw",
+		false,
+		"print the bare hex checksum, without the hash version and algorithm",
+	)
+	cmdRoot.Flags().String(
+		"output-file",
+		"",
+		"write the checksum to a file instead of stdout",
+	)
+	cmdRoot.Flags().String(
+		"attestation-out",
+		"",
+		"write an in-toto statement with SLSA provenance of the checksum to a file",
+	)
+	cmdRoot.Flags().Bool(
+		"terraform-external",
+		false,
+		"read the query of a Terraform external data source from stdin, and write the checksum as JSON",
+	)
+	cmdRoot.Flags().String(
+		"depfile",
+		"",
+		"write a Makefile fragment with the dockerfile and sources as prerequisites to a file",
+	)
+	cmdRoot.Flags().String(
+		"depfile-target",
+		"",
+		"target of the rule in --depfile, --output-file by default",
+	)
+	cmdRoot.Flags().String(
+		"depfile-format",
+		"make",
+		"format of --depfile: make, ninja (a depfile) or dyndep (a dyndep file)",
+	)
+	cmdRoot.Flags().String(
+		"verify",
+		"",
+		"exit with a non-zero status if the checksum isn't this one",
+	)
+	cmdRoot.Flags().String(
+		"github-output",
+		"",
+		"append <name>=<checksum> to $GITHUB_OUTPUT, and changed=true|false with --verify",
+	)
+	cmdRoot.Flags().Lookup("github-output").NoOptDefVal = "checksum"
+
+	registerCompletions(cmdRoot)
+
+	cmdRoot.AddCommand(newCmdWatch())
+	cmdRoot.AddCommand(newCmdPaths())
+	cmdRoot.AddCommand(newCmdExplain())
+	cmdRoot.AddCommand(newCmdManifest())
+	cmdRoot.AddCommand(newCmdBake())
+	cmdRoot.AddCommand(newCmdCompose())
+	cmdRoot.AddCommand(newCmdDiscover())
+	cmdRoot.AddCommand(newCmdStages())
+	cmdRoot.AddCommand(newCmdPlatforms())
+	cmdRoot.AddCommand(newCmdChanged())
+	cmdRoot.AddCommand(newCmdBuild())
+	cmdRoot.AddCommand(newCmdExists())
+	cmdRoot.AddCommand(newCmdServe())
+	cmdRoot.AddCommand(newCmdDaemon())
+	cmdRoot.AddCommand(newCmdDockerPluginMetadata())
+	cmdRoot.AddCommand(newCmdVersion())
+	cmdRoot.AddCommand(newCmdBatch())
+	cmdRoot.AddCommand(newCmdBench())
+	cmdRoot.AddCommand(newCmdCache())
+	cmdRoot.AddCommand(newCmdLock())
+	cmdRoot.AddCommand(newCmdSBOM())
+	cmdRoot.AddCommand(newCmdSign())
+	cmdRoot.AddCommand(newCmdVerifySignature())
 	return cmdRoot
 }
 
-func handlerRoot(cmd *cobra.Command, args []string) {
-	viper.BindPFlags(cmd.Flags())
+// setupCommand sets up logging from the root flags and starts profiling,
+// once before every command.
+func setupCommand(cmd *cobra.Command, args []string) error {
+	if err := setupCommandLogging(cmd); err != nil {
+		return err
+	}
+	return startProfiling(cmd, args)
+}
+
+// errMismatch is returned when the checksum isn't the one given in
+// --verify.
+var errMismatch = errors.New("checksum mismatch")
 
-	if viper.GetBool("debug") {
-		logger = slog.New(slog.NewTextHandler(
-			os.Stderr, &slog.HandlerOptions{
-				Level: slog.LevelDebug,
-			},
-		))
+func handlerRoot(cmd *cobra.Command, args []string) error {
+	if must(cmd.Flags().GetBool("terraform-external")) {
+		handlerTerraformExternal(cmd, args)
+		return nil
 	}
 
-	var config checksum.Config
-	viper.SetConfigType("yaml")
-	viper.Unmarshal(&config)
-	config.Workdir = args[0]
-	config.SetLogger(logger)
+	config := loadConfig(cmd, args[0])
+
+	if files := must(cmd.Flags().GetStringArray("file")); len(files) > 1 {
+		handlerRootFiles(cmd, config, files)
+		return nil
+	}
+
+	depfile := must(cmd.Flags().GetString("depfile"))
+	depfileTarget := must(cmd.Flags().GetString("depfile-target"))
+	var deps dependencies
+	if depfile != "" {
+		if depfileTarget == "" {
+			depfileTarget = must(cmd.Flags().GetString("output-file"))
+		}
+		if depfileTarget == "" {
+			must0(usageErrorf("--depfile takes --depfile-target or --output-file"))
+		}
+		if format := must(cmd.Flags().GetString("depfile-format")); !slices.Contains(depfileFormats, format) {
+			must0(usageErrorf("unknown depfile format %s", format))
+		}
+		if config.ContextFS != nil {
+			must0(usageErrorf("--depfile takes a context directory"))
+		}
+		deps = collectDependencies(&config)
+	}
+
+	results, display, stats := rootChecksums(cmd, config)
+
+	// Everything but the printed checksums uses the first algorithm.
+	verify := must(cmd.Flags().GetString("verify"))
+	var mismatch error
+	if verify != "" {
+		mismatch = verifyChecksum(verify, results[0])
+	}
+
+	if name := must(cmd.Flags().GetString("github-output")); name != "" {
+		outputs := [][2]string{{name, display[0]}}
+		if len(results) > 1 {
+			for i, r := range results {
+				outputs = append(outputs, [2]string{name + "-" + r.Algorithm, display[i]})
+			}
+		}
+		if verify != "" {
+			outputs = append(outputs, [2]string{"changed", strconv.FormatBool(mismatch != nil)})
+		}
+		must0(appendGitHubOutput(outputs...))
+	}
+
+	writeRootOutput(cmd, rootText(cmd, results, display))
+	printStats(cmd, "", stats)
+
+	if depfile != "" {
+		format := must(cmd.Flags().GetString("depfile-format"))
+		content := must(formatDepfile(format, depfileTarget, deps))
+		must0(writeFileAtomic(depfile, []byte(content)))
+	}
+
+	if path := must(cmd.Flags().GetString("attestation-out")); path != "" {
+		must0(must(checksum.NewAttestation(config)).WriteFile(path))
+	}
 
-	fmt.Fprint(
-		cmd.OutOrStdout(),
-		must(checksum.CalculateDockerfileChecksum(config)),
+	if mismatch != nil {
+		cmd.SilenceUsage = true
+		return mismatch
+	}
+	return nil
+}
+
+// rootChecksums calculates a checksum for each algorithm of config, and how
+// each is printed, with a summary of the calculation if --stats is set.
+func rootChecksums(
+	cmd *cobra.Command,
+	config checksum.Config,
+) ([]checksumResult, []string, *statsOutput) {
+	var (
+		sums  []string
+		stats *statsOutput
 	)
+	if must(cmd.Flags().GetBool("stats")) {
+		sums, stats = calculateStats(config)
+	} else {
+		sums = must(checksum.CalculateDockerfileChecksums(config))
+	}
+	raw := must(cmd.Flags().GetBool("raw"))
+
+	results := make([]checksumResult, len(sums))
+	display := make([]string, len(sums))
+	for i, algorithm := range config.Algorithms() {
+		results[i] = newChecksumResult(config, algorithm, sums[i])
+		display[i] = results[i].Prefixed()
+		if raw {
+			display[i] = sums[i]
+		}
+	}
+	return results, display, stats
+}
+
+// rootText returns the printed checksums of a dockerfile, one line for each
+// algorithm, or --format rendered with the first one.
+func rootText(
+	cmd *cobra.Command,
+	results []checksumResult,
+	display []string,
+) string {
+	if format := must(cmd.Flags().GetString("format")); format != "" {
+		return must(renderTemplate(format, results[0]))
+	}
+	if len(results) == 1 {
+		return display[0]
+	}
+
+	lines := display
+	if must(cmd.Flags().GetBool("raw")) {
+		lines = make([]string, len(results))
+		for i, r := range results {
+			lines[i] = r.Algorithm + " " + r.Checksum
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeRootOutput writes out to --output-file, or stdout.
+func writeRootOutput(cmd *cobra.Command, out string) {
+	if must(cmd.Flags().GetBool("no-newline")) {
+		out = strings.TrimRight(out, "\n")
+	}
+	if path := must(cmd.Flags().GetString("output-file")); path != "" {
+		must0(writeFileAtomic(path, []byte(out)))
+	} else {
+		fmt.Fprint(cmd.OutOrStdout(), out)
+	}
+}
+
+type dockerfileResult struct {
+	Dockerfile string `json:"dockerfile"`
+	Checksum   string `json:"checksum"`
+	// Checksums has a checksum for each algorithm if there are several.
+	Checksums []string `json:"checksums,omitempty"`
+	// HashVersion and ToolVersion trace the checksum to how it's
+	// calculated.
+	HashVersion int    `json:"hashVersion"`
+	ToolVersion string `json:"toolVersion"`
+	// Stats is set with --stats.
+	Stats *statsOutput `json:"stats,omitempty"`
+}
+
+// handlerRootFiles prints the checksum of each dockerfile in files with the
+// same context, prefixed by the path of the dockerfile. Digests of files are
+// shared between dockerfiles.
+func handlerRootFiles(cmd *cobra.Command, config checksum.Config, files []string) {
+	for _, flag := range []string{"verify", "github-output", "attestation-out", "depfile"} {
+		if cmd.Flags().Changed(flag) {
+			must0(usageErrorf("--%s takes a single dockerfile", flag))
+		}
+	}
+
+	config.Cache = openSharedCache(config)
+	stdin := config.DockerfileContent
+
+	var (
+		entries []dockerfileResult
+		lines   []string
+	)
+	for _, file := range files {
+		c := config
+		c.Dockerfile, c.DockerfileContent = loadDockerfile(
+			file, c.Workdir, c.ContextFS, must(cmd.Flags().GetBool("cwd-dockerfile")),
+		)
+		if file == "-" {
+			if stdin == nil {
+				stdin = must(io.ReadAll(cmd.InOrStdin()))
+			}
+			c.DockerfileContent = stdin
+		}
+
+		results, display, stats := rootChecksums(cmd, c)
+		entry := dockerfileResult{
+			Dockerfile:  file,
+			Checksum:    display[0],
+			HashVersion: results[0].Version,
+			ToolVersion: buildVersion(),
+			Stats:       stats,
+		}
+		if len(display) > 1 {
+			entry.Checksums = display
+		}
+		entries = append(entries, entry)
+
+		for _, line := range strings.Split(rootText(cmd, results, display), "\n") {
+			lines = append(lines, file+" "+line)
+		}
+		if must(cmd.Flags().GetString("output")) == "text" {
+			printStats(cmd, file+" ", stats)
+		}
+	}
+
+	must0(config.Cache.Save())
+
+	var out string
+	switch output := must(cmd.Flags().GetString("output")); output {
+	case "text":
+		out = strings.Join(lines, "\n") + "\n"
+	case "json":
+		out = string(must(json.Marshal(entries))) + "\n"
+	default:
+		must0(usageErrorf("unknown output format %s", output))
+	}
+	writeRootOutput(cmd, out)
+}
+
+// loadConfig builds checksum config from the flags of cmd, for the build
+// context at workdir.
+func loadConfig(cmd *cobra.Command, workdir string) checksum.Config {
+	workdir = contextDir(workdir)
+
+	v := viper.New()
+	v.BindPFlags(cmd.Flags())
+
+	var config checksum.Config
+	v.SetConfigType("yaml")
+	if path := v.GetString("config"); path != "" {
+		v.SetConfigFile(path)
+		must0(errors.Wrap(v.ReadInConfig(), "read config file"))
+	}
+	v.Unmarshal(&config)
+	if paths := v.GetStringSlice("build-arg-file"); len(paths) > 0 {
+		config.BuildArgs = mergeMap(
+			must(readBuildArgFiles(paths)), config.BuildArgs,
+		)
+	}
+	// Only the root command takes several dockerfiles, and sets them one by
+	// one.
+	files := v.GetStringSlice("file")
+	if len(files) > 1 && cmd.HasParent() {
+		must0(errors.Errorf("%s takes a single dockerfile", cmd.CommandPath()))
+	}
+	if workdir == "-" {
+		if v.IsSet("file") && slices.Contains(files, "-") {
+			must0(errors.New("can't read both the dockerfile and the context from stdin"))
+		}
+		config.ContextFS = must(checksum.ReadTarContext(cmd.InOrStdin()))
+	} else if checksum.IsTarContext(workdir) {
+		fsys, closer, err := checksum.OpenTarContext(workdir)
+		must0(err)
+		cleanups = append(cleanups, func() { closer.Close() })
+		config.ContextFS = fsys
+	}
+	var file string
+	if v.IsSet("file") {
+		file = files[0]
+	}
+	config.Dockerfile, config.DockerfileContent = loadDockerfile(
+		file, workdir, config.ContextFS, v.GetBool("cwd-dockerfile"),
+	)
+	if config.Dockerfile == "-" {
+		config.DockerfileContent = must(io.ReadAll(cmd.InOrStdin()))
+	}
+	config.Workdir = workdir
+	config.SetLogger(slog.New(logHandler))
+	config.SetContext(cmd.Context())
+	if v.GetBool("no-cache") {
+		config.CacheDir = ""
+		config.RemoteCache = ""
+	} else if config.CacheDir == "" {
+		config.CacheDir = defaultCacheDir()
+	}
+	config.LargeFileThreshold = must(units.RAMInBytes(v.GetString("large-file-threshold")))
+	config.LargeFileChunkSize = must(units.RAMInBytes(v.GetString("large-file-chunk-size")))
+	if config.LargeFileChunkSize <= 0 {
+		must0(usageErrorf("--large-file-chunk-size must be positive"))
+	}
+	if mbps := v.GetFloat64("max-read-mbps"); mbps < 0 {
+		must0(usageErrorf("--max-read-mbps can't be negative"))
+	} else if mbps > 0 {
+		config.ReadLimiter = checksum.NewReadLimiter(int64(mbps * units.MiB))
+	}
+	if mode := v.GetString("progress"); mode != progressNone && !v.GetBool("quiet") {
+		config.Stats = &checksum.Stats{}
+		cleanups = append(cleanups, must(startProgress(mode, cmd.ErrOrStderr(), config.Stats)))
+	}
+	if path := v.GetString("hmac-key-file"); path != "" {
+		config.HMACKey = must(readHMACKey(path))
+	}
+
+	return config
+}
+
+// defaultDockerfile returns the Dockerfile in dir, or the Containerfile as
+// Podman does if there's only a Containerfile.
+func defaultDockerfile(dir string) string {
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	if _, err := os.Stat(dockerfile); errors.Is(err, fs.ErrNotExist) {
+		containerfile := filepath.Join(dir, "Containerfile")
+		if _, err := os.Stat(containerfile); err == nil {
+			return containerfile
+		}
+	}
+	return dockerfile
+}
+
+// contextDir returns the directory of a build context. A git context is
+// cloned into a temporary directory first.
+func contextDir(context string) string {
+	if !checksum.IsGitURL(context) {
+		return context
+	}
+
+	dir := must(os.MkdirTemp("", "dockerfile-source-checksum-git"))
+	cleanups = append(cleanups, func() { os.RemoveAll(dir) })
+	logger.Debug("clone git context", "context", context, "dir", dir)
+	return must(checksum.CloneGitContext(context, dir))
+}
+
+// loadDockerfile returns the path of the dockerfile given with -f, or of the
+// default one if path is empty. The content is returned too if the
+// dockerfile is in a context that isn't a directory, e.g. a tar archive.
+func loadDockerfile(
+	path, workdir string,
+	contextFS fs.FS,
+	cwdOnly bool,
+) (string, []byte) {
+	if path == "-" {
+		return path, nil
+	}
+
+	if contextFS == nil || cwdOnly {
+		if path == "" {
+			dir := workdir
+			if cwdOnly {
+				dir = "."
+			}
+			return defaultDockerfile(dir), nil
+		}
+		return must(resolveDockerfile(path, workdir, cwdOnly)), nil
+	}
+
+	if path != "" {
+		if _, err := os.Stat(path); err == nil || filepath.IsAbs(path) {
+			return path, nil
+		}
+	}
+
+	name := pathpkg.Clean(filepath.ToSlash(path))
+	if path == "" {
+		name = "Dockerfile"
+		if _, err := fs.Stat(contextFS, name); errors.Is(err, fs.ErrNotExist) {
+			if _, err := fs.Stat(contextFS, "Containerfile"); err == nil {
+				name = "Containerfile"
+			}
+		}
+	}
+
+	content, err := fs.ReadFile(contextFS, name)
+	if errors.Is(err, fs.ErrNotExist) && path != "" {
+		must0(checksum.Mark(errors.Errorf(
+			"dockerfile %s not found, tried %s and %s in %s",
+			path, path, name, workdir,
+		), checksum.ErrDockerfileNotFound))
+	}
+	must0(errors.Wrapf(err, "read dockerfile %s in %s", name, workdir))
+	return name, content
+}
+
+// resolveDockerfile returns the path of a dockerfile given with -f. A
+// relative path is looked up in the current directory, then in the context
+// at workdir unless cwdOnly is set.
+func resolveDockerfile(path, workdir string, cwdOnly bool) (string, error) {
+	if path == "-" || filepath.IsAbs(path) || cwdOnly {
+		return path, nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	inContext := filepath.Join(workdir, path)
+	if _, err := os.Stat(inContext); err == nil {
+		return inContext, nil
+	}
+	return "", checksum.Mark(errors.Errorf(
+		"dockerfile %s not found, tried %s and %s", path, path, inContext,
+	), checksum.ErrDockerfileNotFound)
+}
+
+// readHMACKey reads a key from path, without a trailing newline.
+func readHMACKey(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read hmac key")
+	}
+
+	key := bytes.TrimRight(content, "\r\n")
+	if len(key) == 0 {
+		return nil, errors.Errorf("hmac key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// writeFileAtomic writes content to path through a temporary file, so
+// readers never see a partially written file. The file is left untouched if
+// it already has the content, so make doesn't consider it updated.
+func writeFileAtomic(path string, content []byte) error {
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "create output file")
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write output file")
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "write output file")
+	}
+
+	// CreateTemp only allows the owner to read the file.
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return errors.Wrap(err, "write output file")
+	}
+
+	return errors.Wrap(os.Rename(f.Name(), path), "write output file")
+}
+
+// printOutput prints v as JSON if the output flag of cmd is json, or calls
+// text to print it otherwise. The trailing newline is left out with
+// --no-newline.
+func printOutput(cmd *cobra.Command, v any, text func(out io.Writer)) {
+	var out bytes.Buffer
+	switch output := must(cmd.Flags().GetString("output")); output {
+	case "text":
+		text(&out)
+	case "json":
+		must0(json.NewEncoder(&out).Encode(v))
+	default:
+		must0(usageErrorf("unknown output format %s", output))
+	}
+
+	b := out.Bytes()
+	if must(cmd.Flags().GetBool("no-newline")) {
+		b = bytes.TrimRight(b, "\n")
+	}
+	cmd.OutOrStdout().Write(b)
+}
+
+// openSharedCache opens a digest cache to share between calculations with
+// config. The cache is only kept in memory if caching is disabled.
+func openSharedCache(config checksum.Config) *checksum.DigestCache {
+	if config.CacheDir == "" {
+		return checksum.NewDigestCache()
+	}
+	return must(checksum.OpenDigestCache(config.CacheDir))
+}
+
+// defaultCacheDir returns the directory for cached file digests, or an
+// empty string to disable caching if there is no user cache directory.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		logger.Debug("disable cache", "error", err)
+		return ""
+	}
+	return filepath.Join(dir, "docker-source-checksum")
 }
 
 func must0(err error) {
@@ -1,18 +1,53 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
 	cryptoRand "crypto/rand"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksumpb"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func TestPathsFromDockerfile(t *testing.T) {
@@ -34,7 +69,17 @@ func TestPathsFromDockerfile(t *testing.T) {
 	require.Equal(t, []string{"./a/*", "./b", "./c", "./d", "./dist"}, paths)
 }
 
+func TestPathsFromDockerfileHeredoc(t *testing.T) {
+	content := must(os.ReadFile("testdata/Dockerfile.heredoc"))
+	res := must(parser.Parse(bytes.NewBuffer(content)))
+
+	paths := checksum.PathsFromDockerfile(res, map[string]string{})
+
+	require.Equal(t, []string{"./b"}, paths)
+}
+
 func TestChecksum(t *testing.T) {
+	useTempCache(t)
 	tmpDir := generateRandomFile(
 		"a/1", "a/2",
 		"b",
@@ -66,24 +111,3409 @@ func TestChecksum(t *testing.T) {
 
 	require.NotEmpty(t, output1.String())
 	require.Equal(t, output1.String(), output2.String())
-	fmt.Println(output1.String(), output2.String())
 }
 
-func generateRandomFile(paths ...string) string {
-	tmpDir := must(os.MkdirTemp(os.TempDir(), "dockerfile-source-checksum"))
-	for _, path := range paths {
+func TestHashVersion1Stable(t *testing.T) {
+	useTempCache(t)
+	tmpDir := t.TempDir()
+	for path, content := range map[string]string{"a/1": "1", "b": "b", "c/1": "c", "d/1": "d"} {
 		path = filepath.Join(tmpDir, path)
 		must0(os.MkdirAll(filepath.Dir(path), 0o755))
+		must0(os.WriteFile(path, []byte(content), 0o644))
+	}
 
-		content := make([]byte, rand.Intn(2048))
-		must(cryptoRand.Read(content))
+	// The checksum of the first release, which never changes, cached or not.
+	// The platform is part of it, so it's pinned instead of the host's.
+	args := []string{
+		"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--platform", "linux/amd64", tmpDir,
+	}
+	expected := "237660f337cc5313f474f2bfa752620a00378f11"
+	require.Equal(t, expected, runRoot(append([]string{"--no-cache"}, args...)...))
+	require.Equal(t, expected, runRoot(args...))
+	require.Equal(t, expected, runRoot(args...))
+}
 
-		f := must(os.OpenFile(
-			path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644,
-		))
-		defer f.Close()
+func TestDirWalkStable(t *testing.T) {
+	useTempCache(t)
+	tmpDir := t.TempDir()
+	// Names that sort differently as paths than as names in a directory,
+	// deep and empty directories, and symlinks to a file and a directory.
+	for path, content := range map[string]string{
+		"src/a/b":           "1",
+		"src/a-b":           "2",
+		"src/a.b/c":         "3",
+		"src/ab":            "4",
+		"src/d/e/f/g/h/i/j": "5",
+		"src/d/e/k":         "6",
+		"src/l/ignored":     "7",
+	} {
+		path = filepath.Join(tmpDir, path)
+		must0(os.MkdirAll(filepath.Dir(path), 0o755))
+		must0(os.WriteFile(path, []byte(content), 0o644))
+	}
+	must0(os.Mkdir(filepath.Join(tmpDir, "src", "empty"), 0o755))
+	must0(os.Symlink("ab", filepath.Join(tmpDir, "src", "m")))
+	must0(os.Symlink("d/e", filepath.Join(tmpDir, "src", "n")))
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY src /src\n"), 0o644))
+	must0(os.WriteFile(filepath.Join(tmpDir, ".dockerignore"), []byte("src/l/ignored\n"), 0o644))
 
-		must(base64.NewEncoder(base64.StdEncoding, f).Write(content))
+	run := func(args ...string) string {
+		return runRoot(append([]string{"--raw", "--platform", "linux/amd64", "-f", dockerfile, tmpDir}, args...)...)
 	}
-	return tmpDir
+	// Checksums of the recursive walk, which the walk must keep, with a
+	// pinned platform as it's part of them.
+	for args, expected := range map[string]string{
+		"--hash-version=1":                      "5e577d17b47e14779d1c8135db8e384fc627038c",
+		"--hash-version=2":                      "9d604c2892ae5008ab17c6d9e42ad19962d9c373",
+		"--hash-version=2 --include-empty-dirs": "623ad834bc59564dcbbebde70a63ecce516c22eb",
+	} {
+		require.Equal(t, expected, run(strings.Fields(args)...), args)
+	}
+}
+
+func TestChecksumCache(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	// Cached digests are only written to the checksum with hash version 2.
+	args := []string{
+		"-f", "testdata/Dockerfile",
+		"--build-arg", "ARG1=b",
+		"--hash-version", "2",
+		tmpDir,
+	}
+
+	uncached := runRoot(append([]string{"--no-cache"}, args...)...)
+	cold := runRoot(args...)
+	warm := runRoot(args...)
+
+	require.NotEmpty(t, uncached)
+	require.Equal(t, uncached, cold)
+	require.Equal(t, uncached, warm)
+
+	// Changing a file must invalidate its cached digest.
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0o644))
+	require.NotEqual(t, warm, runRoot(args...))
+}
+
+func TestPaths(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{
+		"paths",
+		"-f", "testdata/Dockerfile",
+		"--build-arg", "ARG1=b",
+		tmpDir,
+	}
+
+	require.Equal(t, "a/1\na/2\nb\nc\nd\n", runRoot(args...))
+	require.Equal(
+		t,
+		"a/1\na/2\nb\nc\nc/1\nc/1/1\nd\nd/1\n",
+		runRoot(append(args, "--recursive")...),
+	)
+	// Excluded paths under a source directory are left out, as they are
+	// from the checksum.
+	require.Equal(
+		t,
+		"a/1\na/2\nb\nc\nd\nd/1\n",
+		runRoot(append(args, "--recursive", "--exclude", "c/1")...),
+	)
+	require.Equal(
+		t,
+		`["a/1","a/2","b","c","d"]`+"\n",
+		runRoot(append(args, "-o", "json")...),
+	)
+}
+
+func TestWatchSources(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "c/2/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	config := checksum.Config{
+		BuildArgs:  map[string]string{"ARG1": "b"},
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Exclude:    []string{"c/1"},
+	}
+	config.SetLogger(logger)
+
+	watcher := must(fsnotify.NewWatcher())
+	defer watcher.Close()
+	require.NoError(t, watchSources(watcher, config))
+
+	// Excluded directories under a source directory aren't watched.
+	watched := watcher.WatchList()
+	require.Contains(t, watched, filepath.Join(tmpDir, "c", "2"))
+	require.NotContains(t, watched, filepath.Join(tmpDir, "c", "1"))
+	require.ElementsMatch(t, []string{
+		tmpDir,
+		"testdata",
+		filepath.Join(tmpDir, "a"),
+		filepath.Join(tmpDir, "c"),
+		filepath.Join(tmpDir, "c", "2"),
+		filepath.Join(tmpDir, "d"),
+	}, watched)
+}
+
+func TestExplain(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	config := checksum.Config{
+		BuildArgs:  map[string]string{"ARG1": "b"},
+		Platforms:  []string{"linux/amd64"},
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Hash:       "sha1",
+	}
+	config.SetLogger(logger)
+
+	sum, inputs, err := checksum.ExplainDockerfileChecksum(config)
+	require.NoError(t, err)
+	require.Equal(t, must(checksum.CalculateDockerfileChecksum(config)), sum)
+	require.Equal(t, checksum.InputDockerfile, inputs[0].Kind)
+	require.Equal(
+		t,
+		checksum.Input{Kind: checksum.InputPlatform, Value: "linux/amd64"},
+		inputs[len(inputs)-1],
+	)
+
+	// The checksum is displayed as by the root command.
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	for _, flags := range [][]string{nil, {"--raw"}} {
+		explained := runRoot(append(append([]string{"explain"}, flags...), args...)...)
+		require.True(
+			t,
+			strings.HasSuffix(explained, "\nchecksum "+runRoot(append(flags, args...)...)+"\n"),
+			explained,
+		)
+	}
+}
+
+func TestOnInput(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	config := checksum.Config{
+		BuildArgs:  map[string]string{"ARG1": "b"},
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Hash:       "sha1",
+	}
+	config.SetLogger(logger)
+
+	explainedSum, explained, err := checksum.ExplainDockerfileChecksum(config)
+	require.NoError(t, err)
+
+	var inputs []checksum.Input
+	config.OnInput = func(in checksum.Input) { inputs = append(inputs, in) }
+	sum, err := checksum.CalculateDockerfileChecksum(config)
+	require.NoError(t, err)
+	require.Equal(t, explainedSum, sum)
+	require.Equal(t, explained, inputs)
+
+	// Explaining calls OnInput too.
+	inputs = nil
+	_, _, err = checksum.ExplainDockerfileChecksum(config)
+	require.NoError(t, err)
+	require.Equal(t, explained, inputs)
+}
+
+func TestResult(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	config := checksum.Config{
+		BuildArgs:  map[string]string{"ARG1": "b"},
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Hash:       "sha1,sha256",
+	}
+	config.SetLogger(logger)
+
+	res, err := checksum.Calculate(config)
+	require.NoError(t, err)
+	require.Equal(t, must(checksum.CalculateDockerfileChecksums(config)), res.Checksums)
+	require.Equal(t, res.Checksums[0], res.Checksum)
+	require.Equal(t, "sha1", res.Algorithm)
+	require.Equal(t, checksum.HashVersion1, res.HashVersion)
+	require.Contains(t, res.Paths, "c/1")
+
+	m := must(checksum.NewManifest(config))
+	require.Len(t, res.Files, len(m.Files))
+	for _, file := range res.Files {
+		require.Equal(t, m.Files[file.Path], file.Digest)
+		info := must(os.Stat(filepath.Join(tmpDir, file.Path)))
+		require.Equal(t, info.Size(), file.Size)
+	}
+
+	require.Positive(t, res.Timings.Total)
+	require.GreaterOrEqual(t, res.Timings.Total, res.Timings.Parse+res.Timings.Resolve+res.Timings.Hash)
+}
+
+func TestResultUpdate(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	config := checksum.Config{
+		BuildArgs:  map[string]string{"ARG1": "b"},
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Hash:       "sha1",
+		Stats:      &checksum.Stats{},
+		// Only hash version 2 hashes digests of files, which can be reused.
+		HashVersion: checksum.HashVersion2,
+	}
+	config.SetLogger(logger)
+
+	res, err := checksum.Calculate(config)
+	require.NoError(t, err)
+	before := res.Checksum
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "a/1"), []byte("changed"), 0o644))
+
+	// Files that aren't given as changed aren't read again.
+	require.NoError(t, res.Update(nil))
+	require.Equal(t, before, res.Checksum)
+
+	hashed := config.Stats.HashedFiles.Load()
+	require.NoError(t, res.Update([]string{"./a"}))
+	require.Equal(t, hashed+2, config.Stats.HashedFiles.Load())
+	require.NotEqual(t, before, res.Checksum)
+	require.Equal(t, must(checksum.CalculateDockerfileChecksum(config)), res.Checksum)
+
+	// Added files are picked up.
+	must0(os.WriteFile(filepath.Join(tmpDir, "a/3"), []byte("new"), 0o644))
+	require.NoError(t, res.Update([]string{"a/3"}))
+	require.Equal(t, must(checksum.CalculateDockerfileChecksum(config)), res.Checksum)
+}
+
+func TestManifestDiff(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	manifest := filepath.Join(tmpDir, "manifest.json")
+	flags := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b"}
+
+	runRoot(append(append([]string{"manifest", "write"}, flags...), manifest, tmpDir)...)
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0o644))
+	must0(os.Remove(filepath.Join(tmpDir, "a/2")))
+	must0(os.WriteFile(filepath.Join(tmpDir, "c/2"), []byte("new"), 0o644))
+
+	diff := runRoot(append(append(
+		[]string{"manifest", "diff"}, flags...),
+		"--build-arg", "ARG2=x", manifest, tmpDir,
+	)...)
+
+	require.Equal(
+		t,
+		"added: c/2\nremoved: a/2\nmodified: b\nbuild-arg ARG2: added \"x\"\n",
+		diff,
+	)
+}
+
+func TestLock(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b")
+	defer os.RemoveAll(tmpDir)
+
+	// The lockfile is in the copied context, but not part of the checksum.
+	must0(os.WriteFile(
+		filepath.Join(tmpDir, "Dockerfile"),
+		[]byte("FROM alpine\nCOPY . /app\n"),
+		0o644,
+	))
+
+	verify := func() error {
+		cmd := newCmdRoot()
+		cmd.SetArgs([]string{"lock", "verify", tmpDir})
+		cmd.SetOut(io.Discard)
+		return cmd.Execute()
+	}
+
+	runRoot("lock", "write", tmpDir)
+	lockfile := filepath.Join(tmpDir, "docker-source-checksum.lock")
+	manifest := must(checksum.ReadManifest(lockfile))
+	require.Contains(t, manifest.Files, "b")
+	require.NotContains(t, manifest.Files, "docker-source-checksum.lock")
+	require.NoError(t, verify())
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0o644))
+	require.Equal(t, "modified: b\n", runRoot("lock", "verify", tmpDir))
+	require.ErrorIs(t, verify(), errLockOutdated)
+
+	runRoot("lock", "write", tmpDir)
+	require.NoError(t, verify())
+}
+
+func TestSBOM(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	sum := runRoot(args...)
+
+	var bom checksum.CycloneDX
+	must0(json.Unmarshal([]byte(runRoot(append([]string{"sbom"}, args[1:]...)...)), &bom))
+
+	require.Equal(t, "CycloneDX", bom.BOMFormat)
+	require.Equal(t, sum, bom.Metadata.Component.Version)
+
+	var names []string
+	for _, c := range bom.Components {
+		names = append(names, c.Name)
+	}
+	require.Equal(t, []string{"a/1", "a/2", "b", "c/1", "d/1"}, names)
+
+	content := must(os.ReadFile(filepath.Join(tmpDir, "b")))
+	require.Equal(
+		t,
+		[]checksum.CycloneDXHash{{Alg: "SHA-1", Content: fmt.Sprintf("%x", sha1.Sum(content))}},
+		bom.Components[2].Hashes,
+	)
+}
+
+func TestDepfile(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	depfile := filepath.Join(tmpDir, "image.d")
+	runRoot(
+		"--depfile", depfile, "--depfile-target", "image $stamp",
+		"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir,
+	)
+
+	content := string(must(os.ReadFile(depfile)))
+	rule, phony, _ := strings.Cut(content, "\n\n")
+	target, rule, _ := strings.Cut(rule, ":")
+	require.Equal(t, `image\ $$stamp`, target)
+	deps := strings.Fields(strings.ReplaceAll(rule, "\\\n", ""))
+	require.Equal(t, []string{
+		filepath.Join(tmpDir, "a/1"),
+		filepath.Join(tmpDir, "a/2"),
+		filepath.Join(tmpDir, "b"),
+		filepath.Join(tmpDir, "c/1"),
+		filepath.Join(tmpDir, "d/1"),
+		"testdata/Dockerfile",
+	}, deps)
+	require.Contains(t, phony, "testdata/Dockerfile:\n")
+
+	runRoot(
+		"--depfile", depfile, "--depfile-format", "dyndep", "--depfile-target", "image:stamp",
+		"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir,
+	)
+	content = string(must(os.ReadFile(depfile)))
+	require.True(t, strings.HasPrefix(content, "ninja_dyndep_version = 1\nbuild image$:stamp: dyndep | $\n"), content)
+	require.Contains(t, content, filepath.Join(tmpDir, "a/1")+" $\n")
+}
+
+func TestTerraformExternal(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	external := func(query string, args ...string) map[string]string {
+		output := bytes.NewBuffer(nil)
+		cmd := newCmdRoot()
+		cmd.SetArgs(append([]string{"--terraform-external"}, args...))
+		cmd.SetIn(strings.NewReader(query))
+		cmd.SetOut(output)
+		require.NoError(t, cmd.Execute())
+
+		var res map[string]string
+		must0(json.Unmarshal(output.Bytes(), &res))
+		return res
+	}
+
+	expected := runRoot("-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", "--label", "a=b", tmpDir)
+	require.Equal(t, map[string]string{"checksum": expected}, external(
+		`{"context": "`+tmpDir+`", "build_arg.ARG1": "b", "label.a": "b"}`,
+		"-f", "testdata/Dockerfile",
+	))
+	require.Equal(t, map[string]string{"checksum": expected}, external(
+		`{"build_arg.ARG1": "b"}`, "-f", "testdata/Dockerfile", "--label", "a=b", tmpDir,
+	))
+}
+
+func TestVersion(t *testing.T) {
+	useTempCache(t)
+	version = "v1.2.3"
+	defer func() { version = "" }()
+
+	var info versionInfo
+	must0(json.Unmarshal([]byte(runRoot("version", "-o", "json")), &info))
+	require.Equal(t, "v1.2.3", info.Version)
+	require.Equal(t, runtime.Version(), info.GoVersion)
+	require.Equal(t, checksum.HashVersion1, info.HashVersion)
+	require.Equal(t, checksum.HashVersions, info.HashVersions)
+
+	require.Contains(t, runRoot("version"), "version: v1.2.3\n")
+}
+
+func TestCompletion(t *testing.T) {
+	useTempCache(t)
+	require.Contains(t, runRoot("completion", "bash"), "dockerfile-source-checksum")
+
+	completions := strings.Split(runRoot("__complete", "--hash", "sha1,"), "\n")
+	require.Contains(t, completions, "sha1,sha256")
+	require.NotContains(t, completions, "sha1,sha1")
+
+	completions = strings.Split(runRoot("__complete", "--platform", "linux/"), "\n")
+	require.Contains(t, completions, "linux/arm64")
+}
+
+func TestDockerPlugin(t *testing.T) {
+	useTempCache(t)
+	var metadata dockerPluginMetadata
+	must0(json.Unmarshal([]byte(runRoot("docker-cli-plugin-metadata")), &metadata))
+	require.Equal(t, "0.1.0", metadata.SchemaVersion)
+	require.NotEmpty(t, metadata.ShortDescription)
+
+	args, ok := dockerPluginArgs([]string{"/home/me/.docker/cli-plugins/docker-checksum", "checksum", "-f", "Dockerfile", "."})
+	require.True(t, ok)
+	require.Equal(t, []string{"-f", "Dockerfile", "."}, args)
+
+	_, ok = dockerPluginArgs([]string{"dockerfile-source-checksum", "checksum"})
+	require.False(t, ok)
+}
+
+func TestAttestation(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	out := filepath.Join(tmpDir, "attestation.json")
+	sum := runRoot(
+		"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--attestation-out", out, tmpDir,
+	)
+
+	var statement checksum.Statement
+	must0(json.Unmarshal(must(os.ReadFile(out)), &statement))
+
+	require.Equal(t, checksum.InTotoStatementType, statement.Type)
+	require.Equal(t, "sources:testdata/Dockerfile", statement.Subject[0].Name)
+	require.Equal(t, map[string]string{"sourceChecksumV1-sha1": sum}, statement.Subject[0].Digest)
+
+	definition := statement.Predicate.BuildDefinition
+	require.Equal(t, map[string]any{"ARG1": "b"}, definition.ExternalParameters["buildArgs"])
+	require.Len(t, definition.ResolvedDependencies, 5)
+
+	content := must(os.ReadFile(filepath.Join(tmpDir, "b")))
+	require.Equal(t, checksum.ResourceDescriptor{
+		Name:   "b",
+		Digest: map[string]string{"sha1": fmt.Sprintf("%x", sha1.Sum(content))},
+	}, definition.ResolvedDependencies[2])
+}
+
+func TestSPDX(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	sum := runRoot(append([]string{"--raw"}, args...)...)
+
+	var doc checksum.SPDX
+	must0(json.Unmarshal(
+		[]byte(runRoot(append([]string{"sbom", "--format", "spdx"}, args...)...)),
+		&doc,
+	))
+
+	require.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	require.Equal(t, sum, doc.Packages[0].VersionInfo)
+	require.Len(t, doc.Files, 5)
+	require.Len(t, doc.Relationships, 6)
+
+	content := must(os.ReadFile(filepath.Join(tmpDir, "b")))
+	require.Equal(t, "b", doc.Files[2].FileName)
+	require.Equal(
+		t,
+		[]checksum.SPDXChecksum{{Algorithm: "SHA1", ChecksumValue: fmt.Sprintf("%x", sha1.Sum(content))}},
+		doc.Files[2].Checksums,
+	)
+}
+
+func TestRemoteAdd(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("b")
+	defer os.RemoveAll(tmpDir)
+
+	content := "v1"
+	etag := `"1"`
+	rejectHead := false
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if rejectHead && r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			fmt.Fprint(w, content)
+		},
+	))
+	defer server.Close()
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("FROM alpine\nADD "+server.URL+"/app.tar.gz /\nCOPY b /\n"),
+		0o644,
+	))
+
+	run := func(mode string) string {
+		return runRoot("-f", dockerfile, "--remote-add", mode, tmpDir)
+	}
+
+	off, head, fetch := run("off"), run("head"), run("fetch")
+	require.NotEqual(t, off, head)
+	require.NotEqual(t, off, fetch)
+	require.NotEqual(t, head, fetch)
+
+	// URLs are ignored by default, so checksums don't need the network.
+	require.Equal(t, off, runRoot("-f", dockerfile, tmpDir))
+
+	// Servers that reject HEAD are sent a GET for the headers.
+	rejectHead = true
+	require.Equal(t, head, run("head"))
+	rejectHead = false
+
+	// The cached digest is used as long as the ETag doesn't change.
+	content = "v2"
+	require.Equal(t, fetch, run("fetch"))
+	require.Equal(t, head, run("head"))
+
+	etag = `"2"`
+	require.NotEqual(t, fetch, run("fetch"))
+	require.NotEqual(t, head, run("head"))
+	require.Equal(t, off, run("off"))
+}
+
+func TestCachePruneURL(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("b")
+	defer os.RemoveAll(tmpDir)
+	cacheDir := t.TempDir()
+
+	content := "v1"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"1"`)
+			fmt.Fprint(w, content)
+		},
+	))
+	defer server.Close()
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("FROM alpine\nADD "+server.URL+"/app.tar.gz /\nCOPY b /\n"),
+		0o644,
+	))
+	args := []string{"-f", dockerfile, "--remote-add", "fetch", "--cache-dir", cacheDir, tmpDir}
+
+	sum := runRoot(args...)
+	require.Equal(t, "removed 0\n", runRoot("cache", "prune", "--cache-dir", cacheDir))
+
+	// The digest of the URL is still cached after pruning.
+	content = "v2"
+	require.Equal(t, sum, runRoot(args...))
+}
+
+func TestPinFrom(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("b")
+	defer os.RemoveAll(tmpDir)
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	ref := must(name.ParseReference(
+		strings.TrimPrefix(server.URL, "http://") + "/base:latest",
+	))
+	push := func() {
+		must0(remote.Write(ref, must(random.Image(64, 1))))
+	}
+	push()
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("FROM "+ref.String()+" AS base\n"+
+			"FROM base\n"+
+			"COPY --from=base /a /a\n"+
+			"COPY --from=${IMAGE} /a /a\n"+
+			"COPY b /\n"),
+		0o644,
+	))
+
+	args := []string{
+		"-f", dockerfile,
+		"--platform", "linux/amd64",
+		"--build-arg", "IMAGE=" + ref.String(),
+		tmpDir,
+	}
+	unpinned := runRoot(args...)
+	pinned := runRoot(append(args, "--pin-from")...)
+	copyPinned := runRoot(append(args, "--pin-copy-from")...)
+	require.NotEqual(t, unpinned, pinned)
+	require.NotEqual(t, unpinned, copyPinned)
+	require.Equal(t, pinned, runRoot(append(args, "--pin-from")...))
+
+	push()
+	require.Equal(t, unpinned, runRoot(args...))
+	require.NotEqual(t, pinned, runRoot(append(args, "--pin-from")...))
+	require.NotEqual(t, copyPinned, runRoot(append(args, "--pin-copy-from")...))
+}
+
+func TestBuildContext(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("b")
+	defer os.RemoveAll(tmpDir)
+
+	extraDir := generateRandomFile("lib/1", "lib/2", "other")
+	defer os.RemoveAll(extraDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("FROM alpine AS builder\n"+
+			"FROM alpine\n"+
+			"COPY b /\n"+
+			"COPY --from=extra /lib /lib\n"+
+			"RUN --mount=from=extra,source=/lib/2,target=/lib2 "+
+			"--mount=type=cache,from=extra,target=/cache "+
+			"--mount=from=builder,source=/etc,target=/etc true\n"),
+		0o644,
+	))
+
+	args := []string{"-f", dockerfile, "--build-context", "extra=" + extraDir}
+
+	require.Equal(
+		t,
+		"path b\n"+
+			"context extra="+extraDir+"\n"+
+			"path lib\npath lib/1\npath lib/2\n"+
+			"path lib/2\n",
+		grepLines(runRoot(append([]string{"explain"}, append(args, tmpDir)...)...), "path ", "context "),
+	)
+
+	before := runRoot(append(args, tmpDir)...)
+	must0(os.WriteFile(filepath.Join(extraDir, "other"), []byte("changed"), 0o644))
+	require.Equal(t, before, runRoot(append(args, tmpDir)...))
+	must0(os.WriteFile(filepath.Join(extraDir, "lib/1"), []byte("changed"), 0o644))
+	require.NotEqual(t, before, runRoot(append(args, tmpDir)...))
+}
+
+func TestBake(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	must0(os.WriteFile(
+		filepath.Join(tmpDir, "Dockerfile"),
+		must(os.ReadFile("testdata/Dockerfile")),
+		0o644,
+	))
+
+	bakeFile := filepath.Join(tmpDir, "docker-bake.hcl")
+	must0(os.WriteFile(bakeFile, []byte(`
+variable "ARG" {
+  default = "b"
+}
+
+group "default" {
+  targets = ["app", "other"]
+}
+
+target "app" {
+  args = {
+    ARG1 = "${ARG}"
+  }
+  platforms = ["linux/amd64"]
+  tags = ["app:latest"]
+}
+
+target "other" {
+  inherits = ["app"]
+  args = {
+    ARG2 = "x"
+  }
+}
+`), 0o644))
+
+	app := runRoot(
+		"--raw",
+		"-f", filepath.Join(tmpDir, "Dockerfile"),
+		"--build-arg", "ARG1=b",
+		"--platform", "linux/amd64",
+		tmpDir,
+	)
+	other := runRoot(
+		"--raw",
+		"-f", filepath.Join(tmpDir, "Dockerfile"),
+		"--build-arg", "ARG1=b",
+		"--build-arg", "ARG2=x",
+		"--platform", "linux/amd64",
+		tmpDir,
+	)
+	group := must(checksum.CombineChecksums(
+		"sha1", map[string]string{"app": app, "other": other},
+	))
+
+	require.Equal(
+		t,
+		"app v1:sha1:"+app+"\nother v1:sha1:"+other+"\ndefault v1:sha1:"+group+"\n",
+		runRoot("bake", "--bake-file", bakeFile),
+	)
+	require.Equal(
+		t,
+		"other "+other+"\n",
+		runRoot("bake", "--raw", "--bake-file", bakeFile, "other"),
+	)
+}
+
+func TestCompose(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("app/a/1", "app/b", "app/c/1", "app/d/1")
+	defer os.RemoveAll(tmpDir)
+
+	must0(os.WriteFile(
+		filepath.Join(tmpDir, "app/Dockerfile.app"),
+		must(os.ReadFile("testdata/Dockerfile")),
+		0o644,
+	))
+
+	composeFile := filepath.Join(tmpDir, "compose.yaml")
+	must0(os.WriteFile(composeFile, []byte(`
+name: project
+services:
+  app:
+    build:
+      context: ./app
+      dockerfile: Dockerfile.app
+      args:
+        - ARG1=${COMPOSE_TEST_ARG:-b}
+      platforms: [linux/amd64]
+  db:
+    image: postgres
+`), 0o644))
+
+	app := runRoot(
+		"--raw",
+		"-f", filepath.Join(tmpDir, "app/Dockerfile.app"),
+		"--build-arg", "ARG1=b",
+		"--platform", "linux/amd64",
+		filepath.Join(tmpDir, "app"),
+	)
+	project := must(checksum.CombineChecksums(
+		"sha1", map[string]string{"app": app},
+	))
+
+	require.Equal(
+		t,
+		"app "+app+"\nproject "+project+"\n",
+		runRoot("compose", "--raw", "--compose-file", composeFile),
+	)
+}
+
+func TestContainerfile(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/README.md", "b")
+	defer os.RemoveAll(tmpDir)
+
+	containerfile := filepath.Join(tmpDir, "Containerfile")
+	must0(os.WriteFile(
+		containerfile,
+		[]byte("FROM alpine\nCOPY --exclude=*.md --parents a /\nCOPY b /\n"),
+		0o644,
+	))
+	require.Equal(t, "a\nb\n", runRoot("paths", "-f", containerfile, tmpDir))
+
+	composeFile := filepath.Join(tmpDir, "compose.yaml")
+	must0(os.WriteFile(
+		composeFile,
+		[]byte("services:\n  app:\n    build: .\n"),
+		0o644,
+	))
+
+	app := runRoot("--raw", "-f", containerfile, tmpDir)
+	require.Equal(
+		t,
+		"app "+app+"\n",
+		grepLines(runRoot("compose", "--raw", "--compose-file", composeFile), "app "),
+	)
+}
+
+func TestDiscover(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("svc1/b", "svc2/b", "node_modules/x/b")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfiles := []string{
+		filepath.Join(tmpDir, "node_modules/x/Dockerfile"),
+		filepath.Join(tmpDir, "svc1/Dockerfile"),
+		filepath.Join(tmpDir, "svc2/app.Dockerfile"),
+		filepath.Join(tmpDir, "svc2/app.Dockerfile.dockerignore"),
+	}
+	for _, dockerfile := range dockerfiles {
+		must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY b /\n"), 0o644))
+	}
+
+	svc1 := runRoot("--raw", "-f", dockerfiles[1], filepath.Dir(dockerfiles[1]))
+	svc2 := runRoot("--raw", "-f", dockerfiles[2], filepath.Dir(dockerfiles[2]))
+
+	require.Equal(
+		t,
+		dockerfiles[1]+" v1:sha1:"+svc1+"\n"+dockerfiles[2]+" v1:sha1:"+svc2+"\n",
+		runRoot("discover", tmpDir),
+	)
+}
+
+func TestStages(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c/1", "d/1", "dist/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{
+		"stages", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir,
+	}
+
+	stages := func() []string {
+		return strings.Fields(runRoot(args...))
+	}
+
+	before := stages()
+	require.Len(t, before, 4)
+	require.Equal(t, "builder", before[0])
+	require.Equal(t, "1", before[2])
+
+	// Only the final stage copies b.
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0o644))
+	after := stages()
+	require.Equal(t, before[1], after[1])
+	require.NotEqual(t, before[3], after[3])
+
+	// The final stage uses builder, so it changes with builder.
+	must0(os.WriteFile(filepath.Join(tmpDir, "dist/1"), []byte("changed"), 0o644))
+	final := stages()
+	require.NotEqual(t, after[1], final[1])
+	require.NotEqual(t, after[3], final[3])
+}
+
+// grepLines returns lines of s that start with any of prefixes.
+func grepLines(s string, prefixes ...string) string {
+	var res strings.Builder
+	for _, line := range strings.SplitAfter(s, "\n") {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(line, prefix) {
+				res.WriteString(line)
+				break
+			}
+		}
+	}
+	return res.String()
+}
+
+// runRoot runs the root command with args and returns its output.
+// useTempCache makes the CLI cache file digests in a directory of the test,
+// instead of the cache of the user.
+func useTempCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+}
+
+func runRoot(args ...string) string {
+	output := bytes.NewBuffer(nil)
+	cmd := newCmdRoot()
+	cmd.SetArgs(args)
+	cmd.SetOut(output)
+	cmd.Execute()
+	return output.String()
+}
+
+func generateRandomFile(paths ...string) string {
+	tmpDir := must(os.MkdirTemp(os.TempDir(), "dockerfile-source-checksum"))
+	for _, path := range paths {
+		path = filepath.Join(tmpDir, path)
+		must0(os.MkdirAll(filepath.Dir(path), 0o755))
+
+		content := make([]byte, rand.Intn(2048))
+		must(cryptoRand.Read(content))
+
+		f := must(os.OpenFile(
+			path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644,
+		))
+		defer f.Close()
+
+		must(base64.NewEncoder(base64.StdEncoding, f).Write(content))
+	}
+	return tmpDir
+}
+
+func TestPruneStages(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a", "b", "test")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("FROM alpine AS base\n"+
+			"COPY a /\n"+
+			"FROM base AS test\n"+
+			"COPY test /\n"+
+			"FROM base\n"+
+			"COPY b /\n"),
+		0o644,
+	))
+
+	checksums := func() []string {
+		return []string{
+			runRoot("-f", dockerfile, tmpDir),
+			runRoot("-f", dockerfile, "--all-stages", tmpDir),
+			runRoot("-f", dockerfile, "--target", "test", tmpDir),
+		}
+	}
+
+	require.Equal(t, "a\nb\n", runRoot("paths", "-f", dockerfile, tmpDir))
+	require.Equal(t, "a\ntest\n", runRoot("paths", "-f", dockerfile, "--target", "test", tmpDir))
+
+	before := checksums()
+	must0(os.WriteFile(filepath.Join(tmpDir, "test"), []byte("changed"), 0o644))
+	after := checksums()
+	require.Equal(t, before[0], after[0])
+	require.NotEqual(t, before[1], after[1])
+	require.NotEqual(t, before[2], after[2])
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0o644))
+	final := checksums()
+	require.NotEqual(t, after[0], final[0])
+	require.Equal(t, after[2], final[2])
+}
+
+func TestIncludeMetadata(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	withMetadata := append([]string{"--include-metadata"}, args...)
+
+	before := runRoot(args...)
+	beforeMetadata := runRoot(withMetadata...)
+	require.NotEqual(t, before, beforeMetadata)
+
+	must0(os.Chmod(filepath.Join(tmpDir, "b"), 0o755))
+	require.Equal(t, before, runRoot(args...))
+	require.NotEqual(t, beforeMetadata, runRoot(withMetadata...))
+
+	require.Equal(
+		t,
+		"metadata b -rwxr-xr-x\n",
+		grepLines(runRoot(append([]string{"explain"}, withMetadata...)...), "metadata b "),
+	)
+}
+
+func TestLargeFileMetadata(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	large := filepath.Join(tmpDir, "b")
+	must0(os.WriteFile(large, bytes.Repeat([]byte("a"), 4096), 0o644))
+	mtime := time.Now().Add(-time.Hour)
+	must0(os.Chtimes(large, mtime, mtime))
+
+	args := []string{
+		"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--no-cache", "--large-file-threshold", "2KB", tmpDir,
+	}
+	metadata := append([]string{"--large-file-mode", "metadata"}, args...)
+
+	before := runRoot(args...)
+	beforeMetadata := runRoot(metadata...)
+	require.NotEqual(t, before, beforeMetadata)
+
+	// Same size and modification time, different content.
+	must0(os.WriteFile(large, bytes.Repeat([]byte("b"), 4096), 0o644))
+	must0(os.Chtimes(large, mtime, mtime))
+	require.NotEqual(t, before, runRoot(args...))
+	require.Equal(t, beforeMetadata, runRoot(metadata...))
+
+	must0(os.Chtimes(large, mtime, mtime.Add(time.Second)))
+	require.NotEqual(t, beforeMetadata, runRoot(metadata...))
+}
+
+func TestLargeFileChunked(t *testing.T) {
+	large := make([]byte, 10<<10+123)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+	files := fstest.MapFS{
+		"large": {Data: large},
+		"small": {Data: []byte("small")},
+	}
+	explain := func(mode string, concurrency int) (string, []checksum.Input) {
+		config := checksum.Config{
+			DockerfileContent:  []byte("FROM alpine\nCOPY . /app\n"),
+			Workdir:            "context",
+			ContextFS:          files,
+			Hash:               "sha1",
+			LargeFileMode:      mode,
+			LargeFileThreshold: 2 << 10,
+			LargeFileChunkSize: 1 << 10,
+			Concurrency:        concurrency,
+		}
+		config.SetLogger(logger)
+		sum, inputs, err := checksum.ExplainDockerfileChecksum(config)
+		require.NoError(t, err)
+		return sum, inputs
+	}
+
+	// The digest of a large file is of the digests of its chunks, in order.
+	var digests []byte
+	for i := 0; i < len(large); i += 1 << 10 {
+		sum := sha1.Sum(large[i:min(i+1<<10, len(large))])
+		digests = append(digests, hex.EncodeToString(sum[:])...)
+	}
+	sum := sha1.Sum(digests)
+	want := "chunked:" + hex.EncodeToString(sum[:])
+
+	content, _ := explain(checksum.LargeFileContent, 1)
+	chunked, inputs := explain(checksum.LargeFileChunked, 1)
+	require.NotEqual(t, content, chunked)
+	for _, input := range inputs {
+		if input.Kind != checksum.InputFile {
+			continue
+		}
+		switch input.Path {
+		case "large":
+			require.Equal(t, want, input.Digest)
+		case "small":
+			require.NotContains(t, input.Digest, "chunked:")
+		}
+	}
+
+	for _, concurrency := range []int{2, 8} {
+		concurrentSum, concurrentInputs := explain(checksum.LargeFileChunked, concurrency)
+		require.Equal(t, chunked, concurrentSum)
+		require.Equal(t, inputs, concurrentInputs)
+	}
+
+	// Digests of chunks aren't cached as digests of the content.
+	tmpDir := must(os.MkdirTemp(os.TempDir(), "dockerfile-source-checksum"))
+	defer os.RemoveAll(tmpDir)
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), large, 0o644))
+	cacheDir := must(os.MkdirTemp(os.TempDir(), "dockerfile-source-checksum"))
+	defer os.RemoveAll(cacheDir)
+
+	args := []string{
+		"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--hash-version", "2", "--large-file-threshold", "2KB",
+		"--large-file-chunk-size", "1KB", tmpDir,
+	}
+	chunkedArgs := append([]string{"--large-file-mode", "chunked"}, args...)
+	contentSum := runRoot(append([]string{"--no-cache"}, args...)...)
+	chunkedSum := runRoot(append([]string{"--no-cache"}, chunkedArgs...)...)
+	require.NotEqual(t, contentSum, chunkedSum)
+	for i := 0; i < 2; i++ {
+		require.Equal(t, contentSum, runRoot(append([]string{"--cache-dir", cacheDir}, args...)...))
+		require.Equal(t, chunkedSum, runRoot(append([]string{"--cache-dir", cacheDir}, chunkedArgs...)...))
+	}
+
+	cmd := newCmdRoot()
+	cmd.SetArgs(append(chunkedArgs, "--large-file-chunk-size", "0"))
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	require.Equal(t, exitUsage, execute(cmd))
+}
+
+func TestCache(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+	cacheDir := must(os.MkdirTemp(os.TempDir(), "dockerfile-source-checksum"))
+	defer os.RemoveAll(cacheDir)
+
+	sum := runRoot(
+		"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--hash-version", "2", "--cache-dir", cacheDir, tmpDir,
+	)
+	require.NotEmpty(t, sum)
+
+	var stats checksum.CacheStats
+	must0(json.Unmarshal(
+		[]byte(runRoot("cache", "stats", "-o", "json", "--cache-dir", cacheDir)),
+		&stats,
+	))
+	require.Positive(t, stats.Entries)
+
+	require.Equal(t, "removed 0\n", runRoot("cache", "prune", "--cache-dir", cacheDir))
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0o644))
+	require.Equal(t, "removed 1\n", runRoot("cache", "prune", "--cache-dir", cacheDir))
+
+	runRoot("cache", "clear", "--cache-dir", cacheDir)
+	require.Contains(
+		t,
+		runRoot("cache", "stats", "--cache-dir", cacheDir),
+		"entries 0\n",
+	)
+}
+
+func TestRemoteCache(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("app/a/1", "app/a/2", "app/b", "app/c/1", "app/d/1")
+	defer os.RemoveAll(tmpDir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", tmpDir}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init")
+	git("clone", "-q", ".", "clone")
+
+	var (
+		mu      sync.Mutex
+		entries = map[string]string{}
+		puts    int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodPut:
+			puts++
+			entries[r.URL.Path] = string(must(io.ReadAll(r.Body)))
+		case http.MethodGet:
+			value, ok := entries[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, value)
+		}
+	}))
+	defer server.Close()
+
+	run := func(dir string) string {
+		cacheDir := must(os.MkdirTemp(os.TempDir(), "dockerfile-source-checksum"))
+		defer os.RemoveAll(cacheDir)
+		return runRoot(
+			"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+			"--hash-version", "2", "--cache-dir", cacheDir, "--remote-cache", server.URL+"/cache",
+			filepath.Join(tmpDir, dir),
+		)
+	}
+
+	expected := run("app")
+	require.NotEmpty(t, expected)
+	require.Positive(t, puts)
+
+	// A fresh checkout finds every digest in the remote cache.
+	uploaded := puts
+	require.Equal(t, expected, run("clone/app"))
+	require.Equal(t, uploaded, puts)
+
+	for key := range entries {
+		entries[key] = "poisoned"
+	}
+	require.NotEqual(t, expected, run("clone/app"))
+}
+
+func TestRemoteCacheUnreachable(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("app/a/1", "app/a/2", "app/b", "app/c/1", "app/d/1")
+	defer os.RemoveAll(tmpDir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", tmpDir}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init")
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	run := func(args ...string) string {
+		return runRoot(append([]string{
+			"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+			"--hash-version", "2", "--cache-dir", t.TempDir(), filepath.Join(tmpDir, "app"),
+		}, args...)...)
+	}
+	expected := run()
+
+	// The first error disables the remote cache, nothing else is looked up
+	// or uploaded.
+	require.Equal(t, expected, run("--remote-cache", server.URL, "--concurrency", "1"))
+	require.EqualValues(t, 1, requests.Load())
+
+	// Lookups of files read at the same time may already be sent.
+	requests.Store(0)
+	require.Equal(t, expected, run("--remote-cache", server.URL, "--concurrency", "4"))
+	require.LessOrEqual(t, requests.Load(), int32(4))
+}
+
+func TestWindowsPaths(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b/1", "b/2", "c/1")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("# escape=`\n"+
+			"FROM alpine\n"+
+			"COPY .\\a\\1 b C:\\app\\\n"+
+			"ADD c\\1 C:\\c\\\n"),
+		0o644,
+	))
+
+	require.Equal(t, "a/1\nb\nc/1\n", runRoot("paths", "-f", dockerfile, tmpDir))
+	require.Equal(
+		t,
+		"path a/1\npath b\npath b/1\npath b/2\npath c/1\n",
+		grepLines(runRoot("explain", "-f", dockerfile, tmpDir), "path "),
+	)
+}
+
+func TestEscapeDirective(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b/1", "b/2", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("# escape=`\n"+
+			"ARG DIR=b\n"+
+			"FROM mcr.microsoft.com/windows/nanoserver\n"+
+			"COPY .\\a\\..\\a\\1 `\n"+
+			"  ${DIR}\\ C:\\app\\\n"+
+			"RUN --mount=type=bind,source=c\\,target=C:\\c dir C:\\c\n"+
+			"COPY \"d\\1\" C:\\d\\\n"),
+		0o644,
+	))
+
+	require.Equal(t, "a/1\nb\nc\nd/1\n", runRoot("paths", "-f", dockerfile, tmpDir))
+
+	// The same dockerfile for Linux has the same sources.
+	linux := filepath.Join(tmpDir, "Dockerfile.linux")
+	must0(os.WriteFile(
+		linux,
+		[]byte("ARG DIR=b\n"+
+			"FROM alpine\n"+
+			"COPY ./a/1 \\\n"+
+			"  ${DIR}/ /app/\n"+
+			"RUN --mount=type=bind,source=c/,target=/c ls /c\n"+
+			"COPY \"d/1\" /d/\n"),
+		0o644,
+	))
+
+	require.Equal(
+		t,
+		grepLines(runRoot("explain", "-f", dockerfile, tmpDir), "path "),
+		grepLines(runRoot("explain", "-f", linux, tmpDir), "path "),
+	)
+}
+
+func TestDockerfileFromStdin(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"--raw", "--build-arg", "ARG1=b"}
+
+	output := bytes.NewBuffer(nil)
+	cmd := newCmdRoot()
+	cmd.SetArgs(append(args, "-f", "-", tmpDir))
+	cmd.SetIn(bytes.NewReader(must(os.ReadFile("testdata/Dockerfile"))))
+	cmd.SetOut(output)
+	must0(cmd.Execute())
+
+	require.Equal(
+		t,
+		runRoot(append(args, "-f", "testdata/Dockerfile", tmpDir)...),
+		output.String(),
+	)
+}
+
+func TestDockerfileInContext(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	must0(os.WriteFile(
+		filepath.Join(tmpDir, "Dockerfile"),
+		must(os.ReadFile("testdata/Dockerfile")),
+		0o644,
+	))
+
+	args := []string{"--raw", "--build-arg", "ARG1=b"}
+	expected := runRoot(append(args, "-f", "testdata/Dockerfile", tmpDir)...)
+
+	require.Equal(t, expected, runRoot(append(args, tmpDir)...))
+	require.Equal(t, expected, runRoot(append(args, "-f", "Dockerfile", tmpDir)...))
+
+	require.Equal(t, "Dockerfile", must(resolveDockerfile("Dockerfile", tmpDir, true)))
+
+	_, err := resolveDockerfile("missing", tmpDir, false)
+	require.EqualError(
+		t,
+		err,
+		"dockerfile missing not found, tried missing and "+filepath.Join(tmpDir, "missing"),
+	)
+}
+
+func TestMultipleDockerfiles(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"--raw", "--build-arg", "ARG1=b"}
+	dockerfile := runRoot(append(args, "-f", "testdata/Dockerfile", tmpDir)...)
+	heredoc := runRoot(append(args, "-f", "testdata/Dockerfile.heredoc", tmpDir)...)
+
+	require.Equal(
+		t,
+		"testdata/Dockerfile "+dockerfile+"\ntestdata/Dockerfile.heredoc "+heredoc+"\n",
+		runRoot(append(
+			args,
+			"-f", "testdata/Dockerfile",
+			"-f", "testdata/Dockerfile.heredoc",
+			tmpDir,
+		)...),
+	)
+
+	var entries []dockerfileResult
+	must0(json.Unmarshal([]byte(runRoot(append(
+		args,
+		"-o", "json",
+		"-f", "testdata/Dockerfile",
+		"-f", "testdata/Dockerfile.heredoc",
+		tmpDir,
+	)...)), &entries))
+	require.Equal(t, []dockerfileResult{
+		{Dockerfile: "testdata/Dockerfile", Checksum: dockerfile, HashVersion: 1, ToolVersion: buildVersion()},
+		{Dockerfile: "testdata/Dockerfile.heredoc", Checksum: heredoc, HashVersion: 1, ToolVersion: buildVersion()},
+	}, entries)
+}
+
+func TestGlob(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("go.mod", "a/go.mod", "b/c/go.mod", "b/c/main.go", "d/x")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(
+		dockerfile,
+		[]byte("FROM alpine\nCOPY **/go.mod ./\nCOPY b/*/*.go d* /\n"),
+		0o644,
+	))
+
+	require.Equal(
+		t,
+		"a/go.mod\nb/c/go.mod\ngo.mod\nb/c/main.go\nd\n",
+		runRoot("paths", "-f", dockerfile, tmpDir),
+	)
+}
+
+func TestExclude(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "a/version", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b"}
+	exclude := []string{"--exclude", "**/version", "--exclude", "c"}
+
+	require.Equal(
+		t,
+		"path a/1\npath a/2\npath b\npath d\npath d/1\n",
+		grepLines(runRoot(append(append([]string{"explain"}, args...), append(exclude, tmpDir)...)...), "path "),
+	)
+
+	configFile := filepath.Join(tmpDir, "config.yaml")
+	must0(os.WriteFile(configFile, []byte("exclude:\n- '**/version'\n- c\n"), 0o644))
+
+	before := runRoot(append(args, "--config", configFile, tmpDir)...)
+	require.Equal(t, before, runRoot(append(args, append(exclude, tmpDir)...)...))
+	must0(os.WriteFile(filepath.Join(tmpDir, "a/version"), []byte("changed"), 0o644))
+	require.Equal(t, before, runRoot(append(args, "--config", configFile, tmpDir)...))
+	must0(os.WriteFile(filepath.Join(tmpDir, "a/1"), []byte("changed"), 0o644))
+	require.NotEqual(t, before, runRoot(append(args, "--config", configFile, tmpDir)...))
+}
+
+func TestExtraPath(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d", "Makefile", "scripts/build.sh")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{
+		"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--extra-path", "Makefile", "--extra-path", "scripts/*.sh", tmpDir,
+	}
+
+	require.Equal(
+		t,
+		"a/1\nb\nc\nd\nMakefile\nscripts/build.sh\n",
+		runRoot(append([]string{"paths"}, args...)...),
+	)
+
+	before := runRoot(args...)
+	must0(os.WriteFile(filepath.Join(tmpDir, "Makefile"), []byte("changed"), 0o644))
+	require.NotEqual(t, before, runRoot(args...))
+}
+
+func TestGitTrackedOnly(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "c/2", "d")
+	defer os.RemoveAll(tmpDir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", tmpDir}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "-q")
+	git("add", "a/1", "b", "c/1", "d")
+
+	args := []string{
+		"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--git-tracked-only", tmpDir,
+	}
+
+	require.Equal(
+		t,
+		"path a/1\npath b\npath c\npath c/1\npath d\n",
+		grepLines(runRoot(append([]string{"explain"}, args...)...), "path "),
+	)
+
+	before := runRoot(args...)
+	must0(os.WriteFile(filepath.Join(tmpDir, "c/2"), []byte("changed"), 0o644))
+	require.Equal(t, before, runRoot(args...))
+	must0(os.WriteFile(filepath.Join(tmpDir, "c/1"), []byte("changed"), 0o644))
+	require.NotEqual(t, before, runRoot(args...))
+}
+
+func TestGitContext(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("app/a/1", "app/a/2", "app/b", "app/c/1", "app/d/1")
+	defer os.RemoveAll(tmpDir)
+
+	must0(os.WriteFile(
+		filepath.Join(tmpDir, "app/Dockerfile"),
+		must(os.ReadFile("testdata/Dockerfile")),
+		0o644,
+	))
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", tmpDir}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init")
+	git("tag", "v1")
+	git("clone", "-q", "--bare", ".", "repo.git")
+
+	args := []string{"--raw", "--build-arg", "ARG1=b"}
+	expected := runRoot(append(args, filepath.Join(tmpDir, "app"))...)
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "app/b"), []byte("changed"), 0o644))
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-am", "change b")
+	git("push", "-q", "repo.git", "HEAD", "--tags")
+
+	repo := "file://" + filepath.ToSlash(filepath.Join(tmpDir, "repo.git"))
+	require.Equal(t, expected, runRoot(append(args, repo+"#v1:app")...))
+	require.NotEqual(t, expected, runRoot(append(args, repo+"#:app")...))
+
+	require.True(t, checksum.IsGitURL("https://github.com/org/repo.git#main:dir"))
+	require.True(t, checksum.IsGitURL("git@github.com:org/repo"))
+	require.False(t, checksum.IsGitURL("https://example.com/context.tar.gz"))
+}
+
+func TestTarContext(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("ctx/a/1", "ctx/a/2", "ctx/b", "ctx/c/1", "ctx/d/1")
+	defer os.RemoveAll(tmpDir)
+
+	ctx := filepath.Join(tmpDir, "ctx")
+	must0(os.WriteFile(
+		filepath.Join(ctx, "Dockerfile"),
+		must(os.ReadFile("testdata/Dockerfile")),
+		0o644,
+	))
+	must0(os.Symlink("c", filepath.Join(ctx, "link")))
+
+	args := []string{"--raw", "--build-arg", "ARG1=b"}
+	expected := runRoot(append(args, ctx)...)
+	withMetadata := runRoot(append(args, "--include-metadata", ctx)...)
+
+	for _, archive := range []string{"ctx.tar", "ctx.tar.gz"} {
+		path := filepath.Join(tmpDir, archive)
+		cmd := exec.Command("tar", "-C", ctx, "-caf", path, ".")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+
+		require.Equal(t, expected, runRoot(append(args, path)...), archive)
+		require.Equal(
+			t,
+			withMetadata,
+			runRoot(append(args, "--include-metadata", path)...),
+			archive,
+		)
+	}
+
+	require.Equal(
+		t,
+		"a/1\na/2\nb\nc\nd\n",
+		runRoot("paths", "--build-arg", "ARG1=b", filepath.Join(tmpDir, "ctx.tar")),
+	)
+	require.Equal(
+		t,
+		"a/1\na/2\nb\nc\nc/1\nd\nd/1\n",
+		runRoot("paths", "--recursive", "--build-arg", "ARG1=b", filepath.Join(tmpDir, "ctx.tar")),
+	)
+}
+
+func TestTarContextFromStdin(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("ctx/a/1", "ctx/a/2", "ctx/b", "ctx/c/1", "ctx/d/1")
+	defer os.RemoveAll(tmpDir)
+
+	ctx := filepath.Join(tmpDir, "ctx")
+	must0(os.WriteFile(
+		filepath.Join(ctx, "Dockerfile"),
+		must(os.ReadFile("testdata/Dockerfile")),
+		0o644,
+	))
+
+	archive := filepath.Join(tmpDir, "ctx.tar.gz")
+	out, err := exec.Command("tar", "-C", ctx, "-czf", archive, ".").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	args := []string{"--raw", "--build-arg", "ARG1=b"}
+
+	output := bytes.NewBuffer(nil)
+	cmd := newCmdRoot()
+	cmd.SetArgs(append(args, "-"))
+	cmd.SetIn(bytes.NewReader(must(os.ReadFile(archive))))
+	cmd.SetOut(output)
+	must0(cmd.Execute())
+
+	require.Equal(t, runRoot(append(args, ctx)...), output.String())
+}
+
+func TestGitBlobs(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", tmpDir}, args...)...)
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("add", "a/1", "b")
+
+	args := []string{
+		"explain", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--git-blobs", "--no-cache", tmpDir,
+	}
+
+	files := func() string {
+		return grepLines(runRoot(args...), "file ")
+	}
+	expected := func() string {
+		var res string
+		for _, path := range []string{"a/1", "b", "c", "d"} {
+			res += "file " + path + " " + git("hash-object", path) + "\n"
+		}
+		return res
+	}
+
+	// Staged files use object ids from the index, others are hashed the same
+	// way.
+	require.Equal(t, expected(), files())
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0o644))
+	require.Equal(t, expected(), files())
+}
+
+func TestChanged(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c/1", "d", "docs/README")
+	defer os.RemoveAll(tmpDir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{
+			"-C", tmpDir, "-c", "user.name=test", "-c", "user.email=test@example.com",
+		}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	commit := func(path string) {
+		must0(os.WriteFile(filepath.Join(tmpDir, path), []byte(path), 0o644))
+		git("add", ".")
+		git("commit", "-q", "-m", path)
+	}
+
+	dockerfile := must(os.ReadFile("testdata/Dockerfile"))
+	must0(os.WriteFile(filepath.Join(tmpDir, "Dockerfile"), dockerfile, 0o644))
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+
+	changed := func(args ...string) string {
+		return runRoot(append([]string{
+			"changed", "-f", filepath.Join(tmpDir, "Dockerfile"),
+			"--build-arg", "ARG1=b", tmpDir,
+		}, args...)...)
+	}
+
+	commit("docs/README")
+	require.Equal(t, "", changed("--since", "HEAD~1"))
+
+	commit("c/1")
+	commit("a/2")
+	require.Equal(t, "a/2\nc/1\n", changed("--since", "HEAD~3"))
+	require.Equal(t, "c/1\n", changed("--since", "HEAD~3", "--until", "HEAD~1"))
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "Dockerfile"), []byte("FROM alpine\n"), 0o644))
+	require.Equal(t, "Dockerfile\n", changed("--since", "HEAD"))
+}
+
+func TestStrict(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "b", "c", "d", "dist/1")
+	defer os.RemoveAll(tmpDir)
+
+	config := checksum.Config{
+		BuildArgs:  map[string]string{"ARG1": "b"},
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Hash:       "sha1",
+		Strict:     true,
+	}
+	config.SetLogger(logger)
+
+	_, err := checksum.CalculateDockerfileChecksum(config)
+	require.NoError(t, err)
+
+	config.BuildArgs["ARG1"] = "typo"
+	_, err = checksum.CalculateDockerfileChecksum(config)
+	require.EqualError(t, err, "line 21: COPY ./${ARG1} /app: ./typo does not exist")
+
+	must0(os.RemoveAll(filepath.Join(tmpDir, "a")))
+	config.BuildArgs["ARG1"] = "b"
+	_, err = checksum.CalculateDockerfileChecksum(config)
+	require.EqualError(t, err, "line 20: COPY ./a/* /app: ./a/* matches no files")
+}
+
+func TestExitCodes(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	invalid := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(invalid, []byte("FROM alpine\nCOPY\n"), 0o644))
+
+	run := func(args ...string) int {
+		cmd := newCmdRoot()
+		// Without args, cobra would take them from os.Args.
+		cmd.SetArgs(append([]string{}, args...))
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		return execute(cmd)
+	}
+
+	args := []string{"--build-arg", "ARG1=b", "-f", "testdata/Dockerfile", tmpDir}
+	require.Equal(t, exitOK, run(args...))
+	require.Equal(t, exitUsage, run("--unknown", tmpDir))
+	require.Equal(t, exitUsage, run())
+	require.Equal(t, exitUsage, run(append(args, "--depfile", "deps")...))
+	require.Equal(t, exitMismatch, run(append(args, "--verify", "v1:sha1:0")...))
+	require.Equal(t, exitMissingSource, run("-f", "testdata/missing", tmpDir))
+	require.Equal(t, exitMissingSource, run("--strict", "--build-arg", "ARG1=typo", "-f", "testdata/Dockerfile", tmpDir))
+	require.Equal(t, exitParse, run("-f", invalid, tmpDir))
+	require.Equal(t, exitError, run("lock", "verify", tmpDir, "--lockfile", filepath.Join(tmpDir, "missing")))
+}
+
+func TestErrorJSON(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d", "dist/1")
+	defer os.RemoveAll(tmpDir)
+
+	invalid := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(invalid, []byte("FROM alpine\nCOPY\n"), 0o644))
+
+	run := func(args ...string) (errorOutput, string) {
+		var stdout, stderr bytes.Buffer
+		cmd := newCmdRoot()
+		cmd.SetArgs(append([]string{"--output", "json"}, args...))
+		cmd.SetOut(&stdout)
+		cmd.SetErr(&stderr)
+		code := execute(cmd)
+
+		var res errorOutput
+		must0(json.Unmarshal(stderr.Bytes(), &res))
+		require.Equal(t, code, res.ExitCode)
+		return res, stdout.String()
+	}
+
+	res, stdout := run("--strict", "--build-arg", "ARG1=typo", "-f", "testdata/Dockerfile", tmpDir)
+	require.Empty(t, stdout)
+	require.Equal(t, errorOutput{
+		Code:     "missing-source",
+		ExitCode: exitMissingSource,
+		Message:  "line 21: COPY ./${ARG1} /app: ./typo does not exist",
+		Path:     "./typo",
+	}, res)
+
+	res, _ = run("-f", invalid, tmpDir)
+	require.Equal(t, "parse", res.Code)
+	require.Equal(t, invalid, res.Dockerfile)
+	require.Equal(t, 2, res.Line)
+
+	res, _ = run("--build-arg", "ARG1=b", "-f", "testdata/Dockerfile", "--verify", "v1:sha1:0", tmpDir)
+	require.Equal(t, "mismatch", res.Code)
+}
+
+func TestSentinelErrors(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	calculate := func(modify func(c *checksum.Config)) error {
+		config := checksum.Config{
+			BuildArgs:  map[string]string{"ARG1": "b"},
+			Dockerfile: "testdata/Dockerfile",
+			Workdir:    tmpDir,
+			Hash:       "sha1",
+		}
+		config.SetLogger(logger)
+		modify(&config)
+		_, err := checksum.CalculateDockerfileChecksum(config)
+		return err
+	}
+
+	err := calculate(func(c *checksum.Config) { c.Dockerfile = "testdata/missing" })
+	require.ErrorIs(t, err, checksum.ErrDockerfileNotFound)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = calculate(func(c *checksum.Config) { c.Hash = "md4" })
+	require.ErrorIs(t, err, checksum.ErrUnsupportedHash)
+	require.EqualError(t, err, "unknown hash algorithm md4")
+
+	err = calculate(func(c *checksum.Config) {
+		c.Strict = true
+		c.BuildArgs["ARG1"] = "typo"
+	})
+	require.ErrorIs(t, err, checksum.ErrSourceMissing)
+
+	err = calculate(func(c *checksum.Config) {
+		c.DockerfileContent = []byte("FROM alpine\nCOPY a /a\nFOO bar\n")
+	})
+	require.ErrorIs(t, err, checksum.ErrParse)
+	var parseErr *checksum.ParseError
+	require.ErrorAs(t, err, &parseErr)
+	require.Equal(t, 3, parseErr.Line)
+
+	// Errors of expansions are parse errors too, instead of panics.
+	for dockerfile, line := range map[string]int{
+		"FROM alpine\nCOPY ${X:?required} /\n":                            2,
+		"FROM ${BASE:?required}\n":                                        1,
+		"FROM alpine AS a\nFROM alpine\nCOPY --from=${X:?required} / /\n": 3,
+		"FROM alpine\nONBUILD COPY ${X:?required} /\n":                    2,
+	} {
+		err = calculate(func(c *checksum.Config) {
+			c.DockerfileContent = []byte(dockerfile)
+			c.IncludeOnbuild = true
+		})
+		require.ErrorIs(t, err, checksum.ErrParse, dockerfile)
+		require.ErrorAs(t, err, &parseErr)
+		require.Equal(t, line, parseErr.Line, dockerfile)
+		require.Contains(t, err.Error(), ": required", dockerfile)
+	}
+}
+
+// unreadableFS is a file system where some paths can't be opened.
+type unreadableFS struct {
+	fstest.MapFS
+	unreadable []string
+}
+
+func (f unreadableFS) Open(name string) (fs.File, error) {
+	if slices.Contains(f.unreadable, name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f.MapFS.Open(name)
+}
+
+func (f unreadableFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if slices.Contains(f.unreadable, name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f.MapFS.ReadDir(name)
+}
+
+func TestSkipUnreadable(t *testing.T) {
+	files := fstest.MapFS{
+		"a":   {Data: []byte("a")},
+		"b/1": {Data: []byte("1")},
+		"b/2": {Data: []byte("2")},
+		"c/1": {Data: []byte("1")},
+	}
+	explain := func(fsys fs.FS, skip bool) (string, []checksum.Input, error) {
+		config := checksum.Config{
+			DockerfileContent: []byte("FROM alpine\nCOPY . /app\n"),
+			Workdir:           "context",
+			ContextFS:         fsys,
+			Hash:              "sha1",
+			SkipUnreadable:    skip,
+		}
+		config.SetLogger(logger)
+		return checksum.ExplainDockerfileChecksum(config)
+	}
+
+	fsys := unreadableFS{MapFS: files, unreadable: []string{"b/1", "c"}}
+	_, _, err := explain(fsys, false)
+	require.ErrorIs(t, err, fs.ErrPermission)
+
+	sum, inputs, err := explain(fsys, true)
+	require.NoError(t, err)
+	require.Contains(t, inputs, checksum.Input{Kind: checksum.InputUnreadable, Path: "b/1", Value: "permission denied"})
+	require.Contains(t, inputs, checksum.Input{Kind: checksum.InputUnreadable, Path: "c", Value: "permission denied"})
+
+	readable, _, err := explain(files, true)
+	require.NoError(t, err)
+	require.NotEqual(t, readable, sum)
+
+	// The placeholder changes the checksum, unlike a file that's gone.
+	delete(files, "b/1")
+	delete(files, "c/1")
+	gone, _, err := explain(files, true)
+	require.NoError(t, err)
+	require.NotEqual(t, gone, sum)
+}
+
+func TestConcurrency(t *testing.T) {
+	files := fstest.MapFS{}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("%d/%d", i%7, i)] = &fstest.MapFile{Data: []byte(fmt.Sprint(i))}
+	}
+	explain := func(fsys fs.FS, concurrency int, skip bool) (string, []checksum.Input, error) {
+		config := checksum.Config{
+			DockerfileContent: []byte("FROM alpine\nCOPY . /app\n"),
+			Workdir:           "context",
+			ContextFS:         fsys,
+			Hash:              "sha1",
+			HashVersion:       checksum.HashVersion2,
+			Concurrency:       concurrency,
+			SkipUnreadable:    skip,
+		}
+		config.SetLogger(logger)
+		return checksum.ExplainDockerfileChecksum(config)
+	}
+
+	// Files read at the same time are hashed in the order of the walk.
+	sum, inputs, err := explain(files, 1, false)
+	require.NoError(t, err)
+	for _, concurrency := range []int{2, 8} {
+		concurrentSum, concurrentInputs, err := explain(files, concurrency, false)
+		require.NoError(t, err)
+		require.Equal(t, sum, concurrentSum)
+		require.Equal(t, inputs, concurrentInputs)
+	}
+
+	// The error is of the first file that can't be read, as one at a time.
+	fsys := unreadableFS{MapFS: files, unreadable: []string{"3/52", "5/5"}}
+	_, _, want := explain(fsys, 1, false)
+	_, _, err = explain(fsys, 8, false)
+	require.ErrorIs(t, err, fs.ErrPermission)
+	require.EqualError(t, err, want.Error())
+
+	sum, inputs, err = explain(fsys, 1, true)
+	require.NoError(t, err)
+	concurrentSum, concurrentInputs, err := explain(fsys, 8, true)
+	require.NoError(t, err)
+	require.Equal(t, sum, concurrentSum)
+	require.Equal(t, inputs, concurrentInputs)
+}
+
+func TestMaxReadRate(t *testing.T) {
+	files := fstest.MapFS{
+		"a": {Data: bytes.Repeat([]byte("a"), 384<<10)},
+		"b": {Data: bytes.Repeat([]byte("b"), 128<<10)},
+	}
+	calculate := func(limiter *rate.Limiter) (string, time.Duration) {
+		config := checksum.Config{
+			DockerfileContent: []byte("FROM alpine\nCOPY . /app\n"),
+			Workdir:           "context",
+			ContextFS:         files,
+			Hash:              "sha1",
+			HashVersion:       checksum.HashVersion2,
+			Concurrency:       2,
+			ReadLimiter:       limiter,
+		}
+		config.SetLogger(logger)
+		start := time.Now()
+		return must(checksum.CalculateDockerfileChecksum(config)), time.Since(start)
+	}
+
+	sum, _ := calculate(nil)
+	// 512KiB at 1MiB/s, less the first burst, takes at least 250ms for both
+	// files together.
+	throttled, elapsed := calculate(checksum.NewReadLimiter(1 << 20))
+	require.Equal(t, sum, throttled)
+	require.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+
+	cmd := newCmdRoot()
+	cmd.SetArgs([]string{"--max-read-mbps", "-1", "-f", "testdata/Dockerfile", "."})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	require.Equal(t, exitUsage, execute(cmd))
+}
+
+func TestLimits(t *testing.T) {
+	files := fstest.MapFS{
+		"a":     {Data: []byte("a")},
+		"b/1":   {Data: []byte("1")},
+		"b/c/2": {Data: []byte("2")},
+	}
+	calculate := func(modify func(c *checksum.Config)) error {
+		config := checksum.Config{
+			DockerfileContent: []byte("FROM alpine\nCOPY . /app\n"),
+			Workdir:           "context",
+			ContextFS:         files,
+			Hash:              "sha1",
+		}
+		config.SetLogger(logger)
+		modify(&config)
+		_, err := checksum.CalculateDockerfileChecksum(config)
+		return err
+	}
+
+	require.NoError(t, calculate(func(c *checksum.Config) { c.MaxDepth, c.MaxFiles = 3, 3 }))
+
+	err := calculate(func(c *checksum.Config) { c.MaxDepth = 2 })
+	require.ErrorIs(t, err, checksum.ErrLimitExceeded)
+	require.ErrorContains(t, err, "b/c/2 is nested deeper than the maximum depth of 2")
+
+	err = calculate(func(c *checksum.Config) { c.MaxFiles = 2 })
+	require.ErrorIs(t, err, checksum.ErrLimitExceeded)
+	require.ErrorContains(t, err, "more than the maximum of 2 source files at b/c/2")
+}
+
+func TestSymlinkCycle(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/b/2", "c/3")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY . /app\n"), 0o644))
+
+	// A symlink to another directory is followed.
+	must0(os.Symlink("../c", filepath.Join(tmpDir, "a", "c")))
+	cmd := newCmdRoot()
+	cmd.SetArgs([]string{"-f", dockerfile, tmpDir})
+	cmd.SetOut(io.Discard)
+	require.NoError(t, cmd.Execute())
+
+	must0(os.Symlink("..", filepath.Join(tmpDir, "a", "b", "loop")))
+	config := checksum.Config{Dockerfile: dockerfile, Workdir: tmpDir, Hash: "sha1"}
+	config.SetLogger(logger)
+	_, err := checksum.CalculateDockerfileChecksum(config)
+	require.EqualError(
+		t,
+		err,
+		"calculate checksum for .: calculating hash for a: calculating hash for a/b: "+
+			"calculating hash for a/b/loop: a/b/loop is a symlink cycle, it's the directory a again",
+	)
+}
+
+func TestHardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are only detected on unix")
+	}
+
+	copies, links := t.TempDir(), t.TempDir()
+	concurrency := 1
+	for _, dir := range []string{copies, links} {
+		must0(os.Mkdir(filepath.Join(dir, "a"), 0o755))
+		must0(os.WriteFile(filepath.Join(dir, "a", "1"), []byte("a"), 0o644))
+		must0(os.WriteFile(filepath.Join(dir, "b"), []byte("b"), 0o644))
+	}
+	for _, name := range []string{"2", "3"} {
+		must0(os.WriteFile(filepath.Join(copies, "a", name), []byte("a"), 0o644))
+		must0(os.Link(filepath.Join(links, "a", "1"), filepath.Join(links, "a", name)))
+	}
+
+	calculate := func(dir string, version int) (string, int64) {
+		config := checksum.Config{
+			DockerfileContent: []byte("FROM alpine\nCOPY . /app\n"),
+			Workdir:           dir,
+			Hash:              "sha1",
+			HashVersion:       version,
+			Concurrency:       concurrency,
+			Stats:             &checksum.Stats{},
+		}
+		config.SetLogger(logger)
+		return must(checksum.CalculateDockerfileChecksum(config)), config.Stats.HashedFiles.Load()
+	}
+
+	// Hard links are only read once, and the checksum is as with copies,
+	// also while the first of them is still read.
+	for _, concurrency = range []int{1, 4} {
+		sum, hashed := calculate(copies, checksum.HashVersion2)
+		require.EqualValues(t, 4, hashed)
+		linkedSum, hashed := calculate(links, checksum.HashVersion2)
+		require.EqualValues(t, 2, hashed)
+		require.Equal(t, sum, linkedSum)
+	}
+
+	// Content is written to the hash with version 1, so it's always read.
+	sum, _ := calculate(copies, checksum.HashVersion1)
+	linkedSum, hashed := calculate(links, checksum.HashVersion1)
+	require.EqualValues(t, 4, hashed)
+	require.Equal(t, sum, linkedSum)
+}
+
+func TestSpecialFiles(t *testing.T) {
+	useTempCache(t)
+	tmpDir := t.TempDir()
+	must0(os.WriteFile(filepath.Join(tmpDir, "a"), []byte("a"), 0o644))
+
+	config := checksum.Config{
+		DockerfileContent: []byte("FROM alpine\nCOPY . /app\n"),
+		Workdir:           tmpDir,
+		Hash:              "sha1",
+	}
+	config.SetLogger(logger)
+	sum := must(checksum.CalculateDockerfileChecksum(config))
+
+	listener := must(net.Listen("unix", filepath.Join(tmpDir, "sock")))
+	defer listener.Close()
+
+	// Only the path and type of the socket are added.
+	withSocket, inputs, err := checksum.ExplainDockerfileChecksum(config)
+	require.NoError(t, err)
+	require.NotEqual(t, sum, withSocket)
+	require.Contains(t, inputs, checksum.Input{Kind: checksum.InputSpecial, Path: "sock", Value: "socket"})
+}
+
+func TestIncludeXattrs(t *testing.T) {
+	archive := func(capability string) fs.FS {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		header := &tar.Header{Name: "app", Mode: 0o755, Size: 3, Format: tar.FormatPAX}
+		if capability != "" {
+			header.PAXRecords = map[string]string{"SCHILY.xattr.security.capability": capability}
+		}
+		must0(w.WriteHeader(header))
+		must(w.Write([]byte("app")))
+		must0(w.Close())
+		return must(checksum.ReadTarContext(&buf))
+	}
+	explain := func(fsys fs.FS, xattrs ...string) (string, []checksum.Input) {
+		config := checksum.Config{
+			DockerfileContent: []byte("FROM alpine\nCOPY app /app\n"),
+			Workdir:           "context",
+			ContextFS:         fsys,
+			Hash:              "sha1",
+			IncludeXattrs:     xattrs,
+		}
+		config.SetLogger(logger)
+		sum, inputs, err := checksum.ExplainDockerfileChecksum(config)
+		require.NoError(t, err)
+		return sum, inputs
+	}
+
+	plain, _ := explain(archive(""))
+	withCapability, _ := explain(archive("\x01\x02"))
+	require.Equal(t, plain, withCapability)
+
+	sum, inputs := explain(archive("\x01\x02"), "security.capability")
+	require.NotEqual(t, plain, sum)
+	require.Contains(t, inputs, checksum.Input{
+		Kind:  checksum.InputXattr,
+		Path:  "app",
+		Key:   "security.capability",
+		Value: "0102",
+	})
+
+	other, _ := explain(archive("\x01\x03"), "security.capability")
+	require.NotEqual(t, sum, other)
+	unset, _ := explain(archive(""), "security.capability")
+	require.Equal(t, plain, unset)
+}
+
+func TestNormalizeEOL(t *testing.T) {
+	useTempCache(t)
+	// Long enough for CRLF to span reads.
+	text := strings.Repeat("line\r\n", 5000) + "lone\rcr\r\n"
+	files := map[string]string{
+		"a.txt": text,
+		"b.bin": "\x00bin\r\n",
+	}
+
+	crlf, lf := t.TempDir(), t.TempDir()
+	for name, content := range files {
+		must0(os.WriteFile(filepath.Join(crlf, name), []byte(content), 0o644))
+		must0(os.WriteFile(filepath.Join(lf, name), []byte(content), 0o644))
+	}
+	must0(os.WriteFile(filepath.Join(lf, "a.txt"), []byte(strings.ReplaceAll(text, "\r\n", "\n")), 0o644))
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY a.txt b.bin /app/\n"), 0o644))
+
+	run := func(dir string, args ...string) string {
+		return runRoot(append([]string{"--raw", "-f", dockerfile, dir}, args...)...)
+	}
+
+	for _, version := range []string{"1", "2"} {
+		require.NotEqual(t, run(lf, "--hash-version", version), run(crlf, "--hash-version", version))
+		// Cached digests of the content as is aren't used.
+		normalized := run(crlf, "--hash-version", version, "--normalize-eol")
+		require.Equal(t, run(lf, "--hash-version", version, "--normalize-eol", "--no-cache"), normalized)
+		require.Equal(t, run(lf, "--hash-version", version), normalized)
+	}
+
+	// Binary files are hashed as is.
+	must0(os.WriteFile(filepath.Join(lf, "b.bin"), []byte("\x00bin\n"), 0o644))
+	require.NotEqual(t, run(lf, "--normalize-eol"), run(crlf, "--normalize-eol"))
+}
+
+func TestNormalizeEOLGitAttributes(t *testing.T) {
+	useTempCache(t)
+	checkout := map[string]string{
+		".gitattributes": "force.txt text\nkeep.txt -text\nid.c ident\n",
+		// Text despite the NUL byte.
+		"force.txt": "\x00a\r\nb\r\n",
+		"keep.txt":  "a\r\nb\r\n",
+		"id.c":      "// $Id: 0123abcd $\r\nint a;\r\n",
+	}
+	index := map[string]string{
+		".gitattributes": checkout[".gitattributes"],
+		"force.txt":      "\x00a\nb\n",
+		"keep.txt":       "a\r\nb\r\n",
+		"id.c":           "// $Id$\nint a;\n",
+	}
+
+	write := func(files map[string]string) string {
+		dir := t.TempDir()
+		for name, content := range files {
+			must0(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+		}
+		out, err := exec.Command("git", "-C", dir, "init", "-q").CombinedOutput()
+		require.NoError(t, err, string(out))
+		return dir
+	}
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY force.txt keep.txt id.c /app/\n"), 0o644))
+
+	run := func(dir string, args ...string) string {
+		return runRoot(append([]string{"--raw", "--normalize-eol", "-f", dockerfile, dir}, args...)...)
+	}
+
+	checkoutDir, indexDir := write(checkout), write(index)
+	for _, version := range []string{"1", "2"} {
+		require.Equal(t, run(indexDir, "--hash-version", version), run(checkoutDir, "--hash-version", version))
+	}
+
+	// Files with -text are hashed as is.
+	must0(os.WriteFile(filepath.Join(indexDir, "keep.txt"), []byte("a\nb\n"), 0o644))
+	require.NotEqual(t, run(indexDir), run(checkoutDir))
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	useTempCache(t)
+	// é sorts after f in NFC, but before it in NFD.
+	nfc, nfd := "caf\u00e9", "cafe\u0301"
+
+	dirs := map[string]string{nfc: t.TempDir(), nfd: t.TempDir()}
+	for name, dir := range dirs {
+		must0(os.MkdirAll(filepath.Join(dir, "src", name), 0o755))
+		must0(os.WriteFile(filepath.Join(dir, "src", name, "a"), []byte("a"), 0o644))
+		must0(os.WriteFile(filepath.Join(dir, "src", "caff"), []byte("f"), 0o644))
+	}
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY src /src\n"), 0o644))
+
+	run := func(dir string, args ...string) string {
+		return runRoot(append([]string{"--raw", "-f", dockerfile, dir}, args...)...)
+	}
+
+	for _, version := range []string{"1", "2"} {
+		require.NotEqual(t, run(dirs[nfc], "--hash-version", version), run(dirs[nfd], "--hash-version", version))
+		normalized := run(dirs[nfd], "--hash-version", version, "--normalize-unicode")
+		require.Equal(t, run(dirs[nfc], "--hash-version", version, "--normalize-unicode"), normalized)
+		// Names in NFC have the same checksum as without the flag.
+		require.Equal(t, run(dirs[nfc], "--hash-version", version), normalized)
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	useTempCache(t)
+	upper, lower := t.TempDir(), t.TempDir()
+	for dir, names := range map[string][]string{upper: {"Src/B", "Src/a"}, lower: {"src/b", "src/a"}} {
+		for _, name := range names {
+			must0(os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+			must0(os.WriteFile(filepath.Join(dir, name), []byte(filepath.Base(name)), 0o644))
+		}
+	}
+	// The content of B differs only in case too.
+	must0(os.WriteFile(filepath.Join(upper, "Src/B"), []byte("b"), 0o644))
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY . /src\n"), 0o644))
+
+	run := func(dir string, args ...string) string {
+		return runRoot(append([]string{"--raw", "-f", dockerfile, dir}, args...)...)
+	}
+	for _, version := range []string{"1", "2"} {
+		require.NotEqual(t, run(upper, "--hash-version", version), run(lower, "--hash-version", version))
+		folded := run(upper, "--hash-version", version, "--fold-case")
+		require.Equal(t, run(lower, "--hash-version", version, "--fold-case"), folded)
+		require.Equal(t, run(lower, "--hash-version", version), folded)
+	}
+
+	// Paths that collide when folded are logged.
+	must0(os.WriteFile(filepath.Join(lower, "src/A"), []byte("A"), 0o644))
+	var logs bytes.Buffer
+	config := checksum.Config{Dockerfile: dockerfile, Workdir: lower, Hash: "sha1", FoldCase: true}
+	config.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	must(checksum.CalculateDockerfileChecksum(config))
+	require.Contains(t, logs.String(), "paths only differ in case")
+	require.Contains(t, logs.String(), "path=src/A other=src/a")
+}
+
+func TestIncludeEmptyDirs(t *testing.T) {
+	useTempCache(t)
+	dir := t.TempDir()
+	must0(os.MkdirAll(filepath.Join(dir, "src", "a"), 0o755))
+	must0(os.WriteFile(filepath.Join(dir, "src", "a", "f"), []byte("f"), 0o644))
+	must0(os.WriteFile(filepath.Join(dir, "src", "empty"), nil, 0o644))
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY src /src\n"), 0o644))
+
+	run := func(args ...string) string {
+		return runRoot(append([]string{"--raw", "-f", dockerfile, dir}, args...)...)
+	}
+
+	file := run("--include-empty-dirs")
+	// Without files, the directory isn't hashed by itself.
+	require.Equal(t, run(), file)
+
+	must0(os.Remove(filepath.Join(dir, "src", "empty")))
+	must0(os.Mkdir(filepath.Join(dir, "src", "empty"), 0o755))
+	require.Equal(t, file, run("--hash-version", "1"))
+	require.NotEqual(t, file, run("--include-empty-dirs"))
+	require.NotEqual(t, run("--hash-version", "2"), run("--hash-version", "2", "--include-empty-dirs"))
+
+	// A directory with only excluded files is empty in the image, too.
+	must0(os.WriteFile(filepath.Join(dir, "src", "empty", "ignored"), nil, 0o644))
+	config := checksum.Config{
+		Dockerfile:       dockerfile,
+		Workdir:          dir,
+		Hash:             "sha1",
+		Exclude:          []string{"src/empty/ignored"},
+		IncludeEmptyDirs: true,
+	}
+	config.SetLogger(logger)
+	_, inputs, err := checksum.ExplainDockerfileChecksum(config)
+	require.NoError(t, err)
+	require.Contains(t, inputs, checksum.Input{Kind: checksum.InputEmptyDir, Path: "src/empty"})
+	require.NotContains(t, inputs, checksum.Input{Kind: checksum.InputEmptyDir, Path: "src/a"})
+}
+
+func TestBuild(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	sum := runRoot(append([]string{"--raw"}, args...)...)
+
+	require.Equal(
+		t,
+		"buildx build -f testdata/Dockerfile --build-arg ARG1=b "+
+			"--label org.opencontainers.source-checksum="+sum+" "+
+			"-t example.com/app:src-"+sum+" --push "+tmpDir+"\n",
+		runRoot(append(
+			[]string{"build", "--docker", "echo", "--repo", "example.com/app"},
+			append(args, "--", "--push")...,
+		)...),
+	)
+}
+
+func TestTracing(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(tracenoop.NewTracerProvider())
+
+	runRoot("--no-cache", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir)
+
+	names := map[string]int{}
+	for _, span := range exporter.GetSpans() {
+		names[span.Name]++
+	}
+	require.Equal(t, map[string]int{
+		"calculate":        1,
+		"parse dockerfile": 1,
+		"resolve sources":  1,
+		"hash sources":     1,
+		"hash file":        5,
+	}, names)
+}
+
+func TestProgress(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := newCmdRoot()
+	cmd.SetArgs([]string{
+		"--progress", "plain", "--no-cache", "-f", "testdata/Dockerfile",
+		"--build-arg", "ARG1=b", tmpDir,
+	})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(stderr)
+	require.NoError(t, cmd.Execute())
+	require.True(t, strings.HasPrefix(stderr.String(), "done: 5 files, "), stderr.String())
+}
+
+func TestStats(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+	cacheDir := must(os.MkdirTemp(os.TempDir(), "dockerfile-source-checksum"))
+	defer os.RemoveAll(cacheDir)
+
+	run := func(args ...string) (string, string) {
+		stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		cmd := newCmdRoot()
+		cmd.SetArgs(append([]string{
+			"--stats", "--raw", "--hash-version", "2", "--cache-dir", cacheDir,
+			"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		}, append(args, tmpDir)...))
+		cmd.SetOut(stdout)
+		cmd.SetErr(stderr)
+		require.NoError(t, cmd.Execute())
+		return stdout.String(), stderr.String()
+	}
+
+	// The summary is on stderr, so the checksum is printed as without it.
+	sum, stats := run()
+	require.Len(t, sum, 40)
+	require.True(t, strings.HasPrefix(stats, "stats: 5 files, 5 read ("), stats)
+	require.Contains(t, stats, " 0 cache hits, 5 cache misses; parse ")
+
+	_, stats = run()
+	require.Contains(t, stats, "stats: 5 files, 0 read (0B), 5 cache hits, 0 cache misses; ")
+
+	out, stderr := run("-f", "testdata/Dockerfile", "-o", "json")
+	require.Empty(t, stderr)
+	var entries []struct {
+		Checksum string
+		Stats    struct {
+			Files, HashedFiles, CacheHits int64
+			Timings                       checksum.Timings
+		}
+	}
+	must0(json.Unmarshal([]byte(out), &entries))
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		require.Equal(t, sum, entry.Checksum)
+		require.EqualValues(t, 5, entry.Stats.Files)
+		require.EqualValues(t, 5, entry.Stats.CacheHits)
+		require.Zero(t, entry.Stats.HashedFiles)
+		require.Positive(t, entry.Stats.Timings.Total)
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	dir := t.TempDir()
+	cpuprofile := filepath.Join(dir, "cpu.pprof")
+	memprofile := filepath.Join(dir, "mem.pprof")
+	sum := runRoot(
+		"--raw", "--cpuprofile", cpuprofile, "--memprofile", memprofile,
+		"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir,
+	)
+	require.Equal(t, runRoot("--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir), sum)
+
+	// Profiles are gzipped protocol buffers.
+	for _, path := range []string{cpuprofile, memprofile} {
+		require.True(t, bytes.HasPrefix(must(os.ReadFile(path)), []byte{0x1f, 0x8b}), path)
+	}
+
+	cmd := newCmdRoot()
+	cmd.SetArgs([]string{
+		"--cpuprofile", filepath.Join(dir, "missing", "cpu.pprof"),
+		"-f", "testdata/Dockerfile", tmpDir,
+	})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	require.Equal(t, exitError, execute(cmd))
+
+	server := httptest.NewServer(pprofHandler())
+	defer server.Close()
+	resp := must(http.Get(server.URL + "/debug/pprof/heap?debug=1"))
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(must(io.ReadAll(resp.Body))), "heap profile")
+}
+
+func TestBench(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"--hash-version", "2", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b"}
+	bench := func(flags ...string) benchResult {
+		var res benchResult
+		out := runRoot(append(append([]string{"bench", "--runs", "3", "-o", "json"}, args...), append(flags, tmpDir)...)...)
+		must0(json.Unmarshal([]byte(out), &res))
+		return res
+	}
+
+	res := bench()
+	require.Equal(t, runRoot(append(args, tmpDir)...), res.Checksum)
+	require.Equal(t, 5, res.Files)
+	require.Positive(t, res.Bytes)
+	for _, runs := range []*benchRuns{&res.Cold, res.Warm} {
+		require.NotNil(t, runs)
+		require.Equal(t, 3, runs.Runs)
+		require.LessOrEqual(t, runs.Min, runs.Mean)
+		require.LessOrEqual(t, runs.Mean, runs.Max)
+		require.Positive(t, runs.BytesPerSecond)
+	}
+
+	// Without a cache, every run is cold.
+	res = bench("--no-cache")
+	require.Equal(t, 3, res.Cold.Runs)
+	require.Nil(t, res.Warm)
+
+	cmd := newCmdRoot()
+	cmd.SetArgs(append(append([]string{"bench", "--runs", "0"}, args...), tmpDir))
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	require.Equal(t, exitUsage, execute(cmd))
+}
+
+func TestQuiet(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	cmd := newCmdRoot()
+	cmd.SetArgs([]string{
+		"-q", "--debug", "--progress", "plain", "--raw", "-f", "testdata/Dockerfile",
+		"--build-arg", "ARG1=b", tmpDir,
+	})
+	cmd.SetOut(stdout)
+	cmd.SetErr(stderr)
+	require.NoError(t, cmd.Execute())
+	require.Len(t, stdout.String(), 40)
+	require.Empty(t, stderr.String())
+
+	paths := runRoot(
+		"paths", "-n", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir,
+	)
+	require.NotEmpty(t, paths)
+	require.False(t, strings.HasSuffix(paths, "\n"))
+
+	// A single checksum has no trailing newline either way, unlike several
+	// dockerfiles.
+	args := []string{"--raw", "--build-arg", "ARG1=b", "-f", "testdata/Dockerfile"}
+	require.Equal(t, runRoot(append(args, tmpDir)...), runRoot(append(args, "-n", tmpDir)...))
+	several := append(args, "-f", "testdata/Dockerfile.heredoc", tmpDir)
+	require.True(t, strings.HasSuffix(runRoot(several...), "\n"))
+	require.Equal(
+		t,
+		strings.TrimSuffix(runRoot(several...), "\n"),
+		runRoot(append(several, "-n")...),
+	)
+}
+
+func TestJSONLogs(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := newCmdRoot()
+	cmd.SetArgs([]string{
+		"--debug", "--log-format", "json", "-f", "testdata/Dockerfile",
+		"--build-arg", "ARG1=b", tmpDir,
+	})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(stderr)
+	require.NoError(t, cmd.Execute())
+
+	var calculated bool
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+		require.Contains(t, record, "component")
+		if record["msg"] == "calculate checksum" {
+			calculated = true
+			require.Equal(t, "checksum", record["component"])
+			require.Equal(t, tmpDir, record["path"])
+			require.Contains(t, record, "duration")
+		}
+	}
+	require.True(t, calculated)
+
+	// Later commands log as text again.
+	must0(setupLogging(os.Stderr, "text", slog.LevelInfo))
+}
+
+func TestSign(t *testing.T) {
+	useTempCache(t)
+	t.Setenv("COSIGN_PASSWORD", "")
+	dir := t.TempDir()
+
+	keys := must(cosign.GenerateKeyPair(func(bool) ([]byte, error) { return nil, nil }))
+	key, pub := filepath.Join(dir, "cosign.key"), filepath.Join(dir, "cosign.pub")
+	must0(os.WriteFile(key, keys.PrivateBytes, 0o600))
+	must0(os.WriteFile(pub, keys.PublicBytes, 0o644))
+
+	manifest := filepath.Join(dir, "manifest.json")
+	must0(os.WriteFile(manifest, []byte(`{"checksum":"123"}`), 0o644))
+
+	run := func(args ...string) int {
+		cmd := newCmdRoot()
+		cmd.SetArgs(args)
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		return execute(cmd)
+	}
+	verify := []string{"verify-signature", "--key", pub, "--insecure-ignore-tlog", manifest}
+
+	require.Equal(t, exitOK, run("sign", "--key", key, "--tlog-upload=false", manifest))
+	require.FileExists(t, manifest+".sigstore.json")
+	require.Equal(t, exitOK, run(verify...))
+
+	must0(os.WriteFile(manifest, []byte(`{"checksum":"456"}`), 0o644))
+	require.Equal(t, exitError, run(verify...))
+
+	require.Equal(t, exitUsage, run("verify-signature", manifest))
+}
+
+func TestExists(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	repo := strings.TrimPrefix(server.URL, "http://") + "/app"
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	sum := runRoot(append([]string{"--raw"}, args...)...)
+
+	exists := func() string {
+		return runRoot(append([]string{"exists", "--image", repo, "--tag", "v1-{{ .Checksum }}"}, args...)...)
+	}
+
+	require.Equal(t, "", exists())
+
+	ref := must(name.ParseReference(repo + ":v1-" + sum))
+	must0(remote.Write(ref, must(random.Image(64, 1))))
+	require.Equal(t, ref.String()+"\n", exists())
+}
+
+func TestFormat(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	sum := runRoot(append([]string{"--raw"}, args...)...)
+
+	require.Equal(
+		t,
+		"myapp:"+sum[:12]+" sha1:"+sum,
+		runRoot(append([]string{"--format", "myapp:{{ .Short 12 }} {{ .Algorithm }}:{{ .Hex }}"}, args...)...),
+	)
+}
+
+func TestGitHubOutput(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	output := filepath.Join(tmpDir, "github-output")
+	t.Setenv("GITHUB_OUTPUT", output)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	sum := runRoot(append([]string{"--github-output"}, args...)...)
+	runRoot(append([]string{"--github-output=image", "--verify", sum}, args...)...)
+	runRoot(append([]string{"--github-output=image", "--verify", "other"}, args...)...)
+
+	require.Equal(
+		t,
+		"checksum="+sum+"\n"+
+			"image="+sum+"\nchanged=false\n"+
+			"image="+sum+"\nchanged=true\n",
+		string(must(os.ReadFile(output))),
+	)
+
+	cmd := newCmdRoot()
+	cmd.SetArgs(append([]string{"--verify", "other"}, args...))
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	require.ErrorIs(t, cmd.Execute(), errMismatch)
+}
+
+func TestServe(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	must0(os.WriteFile(
+		filepath.Join(tmpDir, "app.Dockerfile"),
+		must(os.ReadFile("testdata/Dockerfile")),
+		0o644,
+	))
+
+	base := checksum.Config{
+		Hash:        "sha1",
+		Platforms:   []string{"linux/amd64"},
+		Cache:       checksum.NewDigestCache(),
+		HashVersion: checksum.HashVersion2,
+	}
+	base.SetLogger(logger)
+
+	metrics := newServerMetrics()
+	server := httptest.NewServer(newChecksumHandler(base, metrics))
+	defer server.Close()
+
+	post := func(body string) (int, map[string]string) {
+		resp := must(http.Post(server.URL+"/checksum", "application/json", strings.NewReader(body)))
+		defer resp.Body.Close()
+		var res map[string]string
+		must0(json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	status, res := post(`{"context": "` + tmpDir + `", "dockerfile": "app.Dockerfile", "buildArgs": {"ARG1": "b"}}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "sha1", res["algorithm"])
+	require.Equal(
+		t,
+		runRoot("--raw", "-f", filepath.Join(tmpDir, "app.Dockerfile"), "--platform", "linux/amd64", "--build-arg", "ARG1=b", "--hash-version", "2", tmpDir),
+		res["checksum"],
+	)
+
+	status, res = post(`{}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "context is required", res["error"])
+
+	resp := must(http.Get(server.URL + "/metrics"))
+	defer resp.Body.Close()
+	metricsText := string(must(io.ReadAll(resp.Body)))
+	require.Contains(t, metricsText, `dockerfile_source_checksum_requests_total{protocol="http",result="ok"} 1`)
+	require.Contains(t, metricsText, "dockerfile_source_checksum_files_hashed_total 4\n")
+	require.Contains(t, metricsText, "dockerfile_source_checksum_cache_misses_total 4\n")
+
+	// Concurrent requests don't sort the platforms of the base config.
+	base.Platforms = []string{"linux/arm64", "linux/amd64"}
+	concurrent := httptest.NewServer(newChecksumHandler(base, newServerMetrics()))
+	defer concurrent.Close()
+	body := `{"context": "` + tmpDir + `", "dockerfile": "app.Dockerfile", "buildArgs": {"ARG1": "b"}}`
+	sums := make([]string, 4)
+	var wg sync.WaitGroup
+	for i := range sums {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := must(http.Post(concurrent.URL+"/checksum", "application/json", strings.NewReader(body)))
+			defer resp.Body.Close()
+			var res map[string]string
+			must0(json.NewDecoder(resp.Body).Decode(&res))
+			sums[i] = res["checksum"]
+		}(i)
+	}
+	wg.Wait()
+	for _, sum := range sums {
+		require.Equal(t, sums[0], sum)
+	}
+	require.Equal(t, []string{"linux/arm64", "linux/amd64"}, base.Platforms)
+}
+
+func TestDaemon(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "a/2", "b", "c/1", "d/1")
+	defer os.RemoveAll(tmpDir)
+
+	socket := filepath.Join(tmpDir, "daemon.sock")
+	flags := []string{"--no-cache", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		cmd := newCmdRoot()
+		cmd.SetArgs(append(append([]string{"daemon", "--socket", socket}, flags...), tmpDir))
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		done <- cmd.ExecuteContext(ctx)
+	}()
+
+	query := func() string {
+		return runRoot("daemon", "query", "--socket", socket, tmpDir)
+	}
+	expected := func() string {
+		return runRoot(append(flags, tmpDir)...)
+	}
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, expected(), query())
+	require.Equal(
+		t,
+		runRoot(append([]string{"--raw"}, append(flags, tmpDir)...)...),
+		runRoot("daemon", "query", "--raw", "--socket", socket, tmpDir),
+	)
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "a/1"), []byte("changed"), 0o644))
+	require.Eventually(t, func() bool { return query() == expected() }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+	require.NoFileExists(t, socket)
+}
+
+// panicFS is a file system whose files panic when they're opened while
+// panics is set.
+type panicFS struct {
+	fstest.MapFS
+	panics *atomic.Bool
+}
+
+func (f panicFS) Open(name string) (fs.File, error) {
+	if f.panics.Load() && name != "." {
+		panic("open " + name)
+	}
+	return f.MapFS.Open(name)
+}
+
+func TestDaemonRecover(t *testing.T) {
+	// The context is watched on disk, and read from fsys.
+	tmpDir := t.TempDir()
+	must0(os.WriteFile(filepath.Join(tmpDir, "a"), []byte("a"), 0o644))
+	fsys := panicFS{MapFS: fstest.MapFS{"a": {Data: []byte("a")}}, panics: &atomic.Bool{}}
+	config := checksum.Config{
+		DockerfileContent: []byte("FROM alpine\nCOPY a /a\n"),
+		Workdir:           tmpDir,
+		ContextFS:         fsys,
+		Hash:              "sha1",
+		Cache:             checksum.NewDigestCache(),
+	}
+	config.SetLogger(logger)
+	target := &daemonTarget{config: config}
+	must0(target.start(time.Hour))
+	defer target.stop()
+
+	sum, err := target.checksum()
+	require.NoError(t, err)
+
+	// A panic is the error of the target, which keeps its result.
+	fsys.panics.Store(true)
+	target.changed(filepath.Join(tmpDir, "a"))
+	_, err = target.checksum()
+	require.ErrorContains(t, err, "panic: open a")
+	require.NotNil(t, target.res)
+
+	fsys.panics.Store(false)
+	require.Equal(t, sum, must(target.checksum()))
+}
+
+func TestDaemonNamedContext(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("app/b", "lib/x/1", "lib/x/2")
+	defer os.RemoveAll(tmpDir)
+
+	app, lib := filepath.Join(tmpDir, "app"), filepath.Join(tmpDir, "lib")
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY --from=lib x /x\nCOPY b /\n"), 0o644))
+
+	socket := filepath.Join(tmpDir, "daemon.sock")
+	// Digests of files that didn't change are reused with hash version 2.
+	flags := []string{"--hash-version", "2", "-f", dockerfile, "--build-context", "lib=" + lib}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		cmd := newCmdRoot()
+		cmd.SetArgs(append(append([]string{"daemon", "--socket", socket}, flags...), app))
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		done <- cmd.ExecuteContext(ctx)
+	}()
+
+	query := func() string {
+		return runRoot("daemon", "query", "--socket", socket, app)
+	}
+	expected := func() string {
+		return runRoot(append([]string{"--no-cache"}, append(flags, app)...)...)
+	}
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, expected(), query())
+
+	before := query()
+	must0(os.WriteFile(filepath.Join(lib, "x/1"), []byte("changed"), 0o644))
+	require.NotEqual(t, before, expected())
+	require.Eventually(t, func() bool { return query() == expected() }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestServeGRPC(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	base := checksum.Config{
+		Hash:      "sha1",
+		Platforms: []string{"linux/amd64"},
+		Cache:     checksum.NewDigestCache(),
+	}
+	base.SetLogger(logger)
+
+	listener := must(net.Listen("tcp", "127.0.0.1:0"))
+	server := newGRPCServer()
+	checksumpb.RegisterChecksumServiceServer(
+		server, &checksumServer{base: base, metrics: newServerMetrics()},
+	)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn := must(grpc.Dial(
+		listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	))
+	defer conn.Close()
+	client := checksumpb.NewChecksumServiceClient(conn)
+
+	dockerfile := must(filepath.Abs("testdata/Dockerfile"))
+	res := must(client.Checksum(context.Background(), &checksumpb.ChecksumRequest{
+		Context:    tmpDir,
+		Dockerfile: dockerfile,
+		BuildArgs:  map[string]string{"ARG1": "b"},
+	}))
+	require.Equal(
+		t,
+		runRoot("--raw", "-f", dockerfile, "--platform", "linux/amd64", "--build-arg", "ARG1=b", tmpDir),
+		res.Checksum,
+	)
+	require.Equal(t, res.Checksum, res.Manifest.Checksum)
+	require.Contains(t, res.Manifest.Files, "b")
+
+	_, err := client.Checksum(context.Background(), &checksumpb.ChecksumRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A dockerfile that can't be expanded fails its request only.
+	invalid := filepath.Join(tmpDir, "invalid.Dockerfile")
+	must0(os.WriteFile(invalid, []byte("FROM alpine\nCOPY ${X:?required} /\n"), 0o644))
+	_, err = client.Checksum(context.Background(), &checksumpb.ChecksumRequest{
+		Context:    tmpDir,
+		Dockerfile: invalid,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.ErrorContains(t, err, "X: required")
+	again := must(client.Checksum(context.Background(), &checksumpb.ChecksumRequest{
+		Context:    tmpDir,
+		Dockerfile: dockerfile,
+		BuildArgs:  map[string]string{"ARG1": "b"},
+	}))
+	require.Equal(t, res.Checksum, again.Checksum)
+
+	// Panics of handlers are internal errors.
+	_, err = recoverPanics(
+		context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test"},
+		func(context.Context, any) (any, error) { panic("boom") },
+	)
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.ErrorContains(t, err, "panic: boom")
+}
+
+func TestBatch(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("app/a/1", "app/b", "app/c", "app/d", "web/b", "web/a/1")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := must(os.ReadFile("testdata/Dockerfile"))
+	must0(os.WriteFile(filepath.Join(tmpDir, "app/Dockerfile"), dockerfile, 0o644))
+	must0(os.WriteFile(filepath.Join(tmpDir, "web/web.Dockerfile"), dockerfile, 0o644))
+
+	spec := filepath.Join(tmpDir, "batch.yaml")
+	must0(os.WriteFile(spec, []byte(`
+- context: app
+  args:
+    ARG1: b
+- name: web
+  context: web
+  dockerfile: web.Dockerfile
+  platforms: [linux/arm64]
+`), 0o644))
+
+	checksumOf := func(dir string, args ...string) string {
+		return runRoot(append(append([]string{"--raw"}, args...), filepath.Join(tmpDir, dir))...)
+	}
+
+	require.Equal(
+		t,
+		"app "+checksumOf("app", "-f", filepath.Join(tmpDir, "app/Dockerfile"), "--build-arg", "ARG1=b")+"\n"+
+			"web "+checksumOf("web", "-f", filepath.Join(tmpDir, "web/web.Dockerfile"), "--platform", "linux/arm64")+"\n",
+		runRoot("batch", "--raw", spec),
+	)
+}
+
+func TestOutputFile(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	output := filepath.Join(tmpDir, "checksum")
+
+	sum := runRoot(args...)
+	require.Equal(t, "", runRoot(append([]string{"--output-file", output}, args...)...))
+	require.Equal(t, sum, string(must(os.ReadFile(output))))
+}
+
+func TestFastHashes(t *testing.T) {
+	useTempCache(t)
+	tmpDir := t.TempDir()
+	for path, content := range map[string]string{"a/1": "1", "b": "b", "c/1": "c", "d/1": "d"} {
+		path = filepath.Join(tmpDir, path)
+		must0(os.MkdirAll(filepath.Dir(path), 0o755))
+		must0(os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	// Checksums are pinned, so a new version of a library can't change them.
+	// So is the platform, which is part of them.
+	args := []string{
+		"--raw", "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b",
+		"--platform", "linux/amd64", tmpDir,
+	}
+	for algorithm, expected := range map[string]string{
+		"xxhash64":    "295a0f1ea061bb52",
+		"xxh3":        "cf87328f9fefc744",
+		"highwayhash": "ad8f763ee0d85dea3db2bf159ef4ed4c7be93cc4f417938c3799cd3a8ffb556b",
+	} {
+		require.Equal(t, expected, runRoot(append([]string{"--hash", algorithm}, args...)...), algorithm)
+		require.NotEqual(t, expected, runRoot(append([]string{"--hash", algorithm, "--hash-version", "2"}, args...)...), algorithm)
+	}
+
+	// They aren't cryptographic, so an HMAC with them would be no secret.
+	key := filepath.Join(t.TempDir(), "key")
+	must0(os.WriteFile(key, []byte("key"), 0o600))
+	cmd := newCmdRoot()
+	cmd.SetArgs(append([]string{"--hash", "xxh3", "--hmac-key-file", key}, args...))
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	require.Equal(t, exitError, execute(cmd))
+}
+
+func TestMultipleHashes(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	hash := func(algorithm string, extra ...string) []string {
+		return append(append([]string{"--hash", algorithm}, extra...), args...)
+	}
+
+	require.Equal(
+		t,
+		runRoot(hash("sha256")...)+"\n"+runRoot(hash("blake3")...),
+		runRoot(hash("sha256,blake3")...),
+	)
+	require.Equal(
+		t,
+		"sha256 "+runRoot(hash("sha256", "--raw")...)+"\nblake3 "+runRoot(hash("blake3", "--raw")...),
+		runRoot(hash("sha256,blake3", "--raw")...),
+	)
+}
+
+func TestHMACKey(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	key := filepath.Join(t.TempDir(), "key")
+	args := func(extra ...string) []string {
+		return append(extra, "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir)
+	}
+
+	plain := runRoot(args()...)
+
+	must0(os.WriteFile(key, []byte("secret\n"), 0o600))
+	keyed := runRoot(args("--hmac-key-file", key)...)
+	require.NotEqual(t, plain, keyed)
+	require.Len(t, keyed, len(plain))
+
+	must0(os.WriteFile(key, []byte("secret"), 0o600))
+	require.Equal(t, keyed, runRoot(args("--hmac-key-file", key)...))
+
+	must0(os.WriteFile(key, []byte("other"), 0o600))
+	require.NotEqual(t, keyed, runRoot(args("--hmac-key-file", key)...))
+}
+
+func TestSalt(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	config := checksum.Config{
+		BuildArgs:  map[string]string{"ARG1": "b"},
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Hash:       "sha1",
+	}
+	config.SetLogger(logger)
+
+	plain := must(checksum.CalculateDockerfileChecksum(config))
+
+	config.Salt = "pipeline-a"
+	sum, inputs, err := checksum.ExplainDockerfileChecksum(config)
+	require.NoError(t, err)
+	require.NotEqual(t, plain, sum)
+	require.Equal(t, checksum.Input{Kind: checksum.InputSalt, Value: "pipeline-a"}, inputs[0])
+
+	config.Salt = "pipeline-b"
+	require.NotEqual(t, sum, must(checksum.CalculateDockerfileChecksum(config)))
+}
+
+func TestHashVersion(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	sum := func(version int, buildArgs map[string]string) string {
+		config := checksum.Config{
+			BuildArgs:   buildArgs,
+			Dockerfile:  "testdata/Dockerfile",
+			Workdir:     tmpDir,
+			Hash:        "sha1",
+			HashVersion: version,
+		}
+		config.SetLogger(logger)
+		return must(checksum.CalculateDockerfileChecksum(config))
+	}
+
+	a := map[string]string{"ARG1": "b", "X": "ab"}
+	b := map[string]string{"ARG1": "b", "Xa": "b"}
+
+	require.Equal(t, sum(0, a), sum(checksum.HashVersion1, a))
+	require.Equal(t, sum(checksum.HashVersion1, a), sum(checksum.HashVersion1, b))
+	require.NotEqual(t, sum(checksum.HashVersion1, a), sum(checksum.HashVersion2, a))
+	require.NotEqual(t, sum(checksum.HashVersion2, a), sum(checksum.HashVersion2, b))
+
+	config := checksum.Config{Dockerfile: "testdata/Dockerfile", Workdir: tmpDir, Hash: "sha1", HashVersion: 3}
+	config.SetLogger(logger)
+	_, err := checksum.CalculateDockerfileChecksum(config)
+	require.ErrorContains(t, err, "unknown hash version 3")
+}
+
+func TestPrefixedChecksum(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir}
+	raw := runRoot(append([]string{"--raw"}, args...)...)
+
+	require.Equal(t, "v1:sha1:"+raw, runRoot(args...))
+	require.True(t, strings.HasPrefix(runRoot(append([]string{"--hash-version", "2", "--hash", "sha256"}, args...)...), "v2:sha256:"))
+
+	verify := func(expected string) error {
+		cmd := newCmdRoot()
+		cmd.SetArgs(append([]string{"--verify", expected}, args...))
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		return cmd.Execute()
+	}
+
+	require.NoError(t, verify(raw))
+	require.NoError(t, verify("v1:sha1:"+raw))
+	err := verify("v2:sha1:" + raw)
+	require.ErrorIs(t, err, errMismatch)
+	require.ErrorContains(t, err, "from scheme v2:sha1 instead of v1:sha1")
+}
+
+func TestNormalizeDockerfile(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c")
+	defer os.RemoveAll(tmpDir)
+
+	write := func(content string) string {
+		path := filepath.Join(tmpDir, "Dockerfile")
+		must0(os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	sum := func(dockerfile string, extra ...string) string {
+		return runRoot(append(extra, "-f", dockerfile, tmpDir)...)
+	}
+
+	original := write("FROM alpine\nRUN echo \"a  b\"\nCOPY ./a ./b /app\nCOPY <<EOF /app/c\n  x\nEOF\n")
+	plain, normalized := sum(original), sum(original, "--normalize-dockerfile")
+
+	reformatted := write("# the base image\nFROM   alpine\n\nRUN echo \\\n    \"a  b\"\n# sources\nCOPY ./a \\\n  # b too\n  ./b /app\nCOPY <<EOF /app/c\n  x\nEOF\n")
+	require.NotEqual(t, plain, sum(reformatted))
+	require.Equal(t, normalized, sum(reformatted, "--normalize-dockerfile"))
+
+	quoted := write("FROM alpine\nRUN echo \"a b\"\nCOPY ./a ./b /app\nCOPY <<EOF /app/c\n  x\nEOF\n")
+	require.NotEqual(t, normalized, sum(quoted, "--normalize-dockerfile"))
+
+	heredoc := write("FROM alpine\nRUN echo \"a  b\"\nCOPY ./a ./b /app\nCOPY <<EOF /app/c\nx\nEOF\n")
+	require.NotEqual(t, normalized, sum(heredoc, "--normalize-dockerfile"))
+}
+
+func TestCanonicalDockerfile(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b")
+	defer os.RemoveAll(tmpDir)
+
+	write := func(content string) string {
+		path := filepath.Join(tmpDir, "Dockerfile")
+		must0(os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	sum := func(dockerfile string, extra ...string) string {
+		return runRoot(append(extra, "-f", dockerfile, tmpDir)...)
+	}
+
+	original := write("FROM alpine AS base\nCOPY --chmod=644 --chown=1:1 a /app\nRUN echo \"x  y\"\nCMD [\"a\", \"b\"]\n")
+	normalized, canonical := sum(original, "--normalize-dockerfile"), sum(original, "--canonical-dockerfile")
+
+	reformatted := write("# comment\nfrom alpine as base\ncopy --chown=1:1 --chmod=644 a \\\n   /app\nRUN   echo \"x  y\"\nCMD [\"a\",\"b\"]\n")
+	require.NotEqual(t, normalized, sum(reformatted, "--normalize-dockerfile"))
+	require.Equal(t, canonical, sum(reformatted, "--canonical-dockerfile"))
+
+	shellForm := write("FROM alpine AS base\nCOPY --chmod=644 --chown=1:1 a /app\nRUN echo \"x  y\"\nCMD a b\n")
+	require.NotEqual(t, canonical, sum(shellForm, "--canonical-dockerfile"))
+}
+
+func TestIgnoreDimensions(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	sum := func(args ...string) string {
+		return runRoot(append(args, "-f", "testdata/Dockerfile", "--build-arg", "ARG1=b", tmpDir)...)
+	}
+
+	base := sum("--platform", "linux/amd64")
+
+	require.NotEqual(t, base, sum("--platform", "linux/amd64", "--label", "built=now"))
+	require.Equal(t, base, sum("--platform", "linux/amd64", "--label", "built=now", "--ignore-labels"))
+
+	require.Equal(t, sum("--ignore-platforms"), sum("--platform", "linux/arm64", "--ignore-platforms"))
+
+	require.Equal(t, base, sum("--platform", "linux/amd64", "--build-arg", "BUILD_DATE=now", "--ignore-build-args", "BUILD_DATE"))
+	require.NotEqual(t, base, sum("--platform", "linux/amd64", "--build-arg", "BUILD_DATE=now"))
+
+	// Ignored build args are still expanded in sources.
+	ignored := func(value string) string {
+		return runRoot("-f", "testdata/Dockerfile", "--build-arg", "ARG1="+value, "--ignore-build-args", "ARG1", tmpDir)
+	}
+	require.NotEqual(t, ignored("b"), ignored("c"))
+}
+
+func TestSecretArg(t *testing.T) {
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	var logs bytes.Buffer
+	config := checksum.Config{
+		Dockerfile: "testdata/Dockerfile",
+		Workdir:    tmpDir,
+		Hash:       "sha1",
+		Debug:      true,
+		SecretArgs: []string{"TOKEN"},
+	}
+	config.SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	sum := func(token string) string {
+		config.BuildArgs = map[string]string{"ARG1": "b", "TOKEN": token}
+		sum, inputs, err := checksum.ExplainDockerfileChecksum(config)
+		require.NoError(t, err)
+		require.Contains(t, inputs, checksum.Input{Kind: checksum.InputBuildArg, Key: "TOKEN", Value: ""})
+		return sum
+	}
+
+	require.Equal(t, sum("secret1"), sum("secret2"))
+	require.NotContains(t, logs.String(), "secret1")
+
+	config.HMACKey = []byte("key")
+	config.BuildArgs = map[string]string{"ARG1": "b", "TOKEN": "secret1"}
+	first := must(checksum.CalculateDockerfileChecksum(config))
+	config.BuildArgs["TOKEN"] = "secret2"
+	require.NotEqual(t, first, must(checksum.CalculateDockerfileChecksum(config)))
+	require.NotContains(t, logs.String(), "secret")
+}
+
+func TestBuildArgFile(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	files := t.TempDir()
+	first := filepath.Join(files, "first.env")
+	second := filepath.Join(files, "second.env")
+	must0(os.WriteFile(first, []byte("# defaults\nARG1=c\n\nARG2='x y'\n"), 0o644))
+	must0(os.WriteFile(second, []byte("export ARG1=\"b\"\n"), 0o644))
+
+	args := []string{"-f", "testdata/Dockerfile", tmpDir}
+
+	require.Equal(
+		t,
+		runRoot(append([]string{"--build-arg", "ARG1=b", "--build-arg", "ARG2=x y"}, args...)...),
+		runRoot(append([]string{"--build-arg-file", first, "--build-arg-file", second}, args...)...),
+	)
+	require.Equal(
+		t,
+		runRoot(append([]string{"--build-arg", "ARG1=d", "--build-arg", "ARG2=x y"}, args...)...),
+		runRoot(append([]string{"--build-arg-file", first, "--build-arg", "ARG1=d"}, args...)...),
+	)
+}
+
+func TestArgsFromEnv(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "c", "d")
+	defer os.RemoveAll(tmpDir)
+
+	sum := func(args ...string) string {
+		return runRoot(append(args, "-f", "testdata/Dockerfile", tmpDir)...)
+	}
+
+	unset := sum()
+	require.Equal(t, unset, sum("--build-arg", "ARG1"))
+
+	t.Setenv("ARG1", "b")
+	explicit := sum("--build-arg", "ARG1=b")
+	require.NotEqual(t, unset, explicit)
+	require.Equal(t, explicit, sum("--build-arg", "ARG1"))
+	require.Equal(t, explicit, sum("--args-from-env"))
+	require.Equal(t, unset, sum())
+
+	require.Equal(t, sum("--build-arg", "ARG1=c"), sum("--args-from-env", "--build-arg", "ARG1=c"))
+}
+
+func TestPlatformArgs(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("dist/amd64/app", "dist/arm64/app", "dist/arm/v7/app")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nARG TARGETARCH\nCOPY dist/${TARGETARCH}/${TARGETVARIANT} /app\n"), 0o644))
+
+	run := func(args ...string) string {
+		return runRoot(append(args, "-f", dockerfile, tmpDir)...)
+	}
+
+	require.Equal(t, "dist/amd64\n", run("paths", "--platform", "linux/amd64"))
+	require.Equal(
+		t,
+		"dist/arm/v7\ndist/arm64\n",
+		run("paths", "--platform", "linux/arm64/v8", "--platform", "linux/arm"),
+	)
+	require.Empty(t, grepLines(run("explain", "--platform", "linux/amd64"), "build-arg "))
+
+	amd64 := run("--platform", "linux/amd64")
+	both := run("--platform", "linux/amd64", "--platform", "linux/arm64")
+	must0(os.WriteFile(filepath.Join(tmpDir, "dist/arm64/app"), []byte("changed"), 0o644))
+	require.Equal(t, amd64, run("--platform", "linux/amd64"))
+	require.NotEqual(t, both, run("--platform", "linux/amd64", "--platform", "linux/arm64"))
+}
+
+func TestPlatforms(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("dist/amd64/app", "dist/arm64/app")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("FROM alpine\nCOPY dist/${TARGETARCH}/app /app\n"), 0o644))
+
+	checksumOf := func(platforms ...string) string {
+		args := []string{"--raw", "-f", dockerfile}
+		for _, platform := range platforms {
+			args = append(args, "--platform", platform)
+		}
+		return runRoot(append(args, tmpDir)...)
+	}
+
+	run := func() string {
+		return runRoot("platforms", "--raw", "-f", dockerfile, "--platform", "linux/amd64", "--platform", "linux/arm64", tmpDir)
+	}
+
+	before := run()
+	require.Equal(
+		t,
+		"linux/amd64 "+checksumOf("linux/amd64")+"\n"+
+			"linux/arm64 "+checksumOf("linux/arm64")+"\n"+
+			"combined "+checksumOf("linux/amd64", "linux/arm64")+"\n",
+		before,
+	)
+
+	must0(os.WriteFile(filepath.Join(tmpDir, "dist/arm64/app"), []byte("changed"), 0o644))
+	after := strings.Split(run(), "\n")
+	require.Equal(t, strings.Split(before, "\n")[0], after[0])
+	require.NotEqual(t, strings.Split(before, "\n")[1], after[1])
+}
+
+func TestOnbuild(t *testing.T) {
+	useTempCache(t)
+	tmpDir := generateRandomFile("a/1", "b", "src/1")
+	defer os.RemoveAll(tmpDir)
+
+	dockerfile := filepath.Join(tmpDir, "Dockerfile")
+	must0(os.WriteFile(dockerfile, []byte("ARG DIR=src\nFROM alpine\nCOPY b /\nONBUILD COPY ./${DIR} /src\nONBUILD ADD a /a\nONBUILD RUN make\n"), 0o644))
+
+	require.Equal(t, "b\n", runRoot("paths", "-f", dockerfile, tmpDir))
+	require.Equal(t, "src\na\nb\n", runRoot("paths", "--include-onbuild", "-f", dockerfile, tmpDir))
+	require.NotEqual(
+		t,
+		runRoot("-f", dockerfile, tmpDir),
+		runRoot("--include-onbuild", "-f", dockerfile, tmpDir),
+	)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdManifest() *cobra.Command {
+	cmdManifest := &cobra.Command{
+		Use:   "manifest",
+		Short: "Save and compare everything that contributes to the checksum",
+	}
+
+	cmdManifest.AddCommand(&cobra.Command{
+		Use:   "write <file> <context>",
+		Short: "Write the manifest of a build context to a file",
+		Args:  cobra.ExactArgs(2),
+		Run:   handlerManifestWrite,
+	})
+
+	cmdDiff := &cobra.Command{
+		Use:   "diff <old> <new>",
+		Short: "Show what has changed between two manifests",
+		Long: "Show what has changed between two manifests. If <new> is a " +
+			"directory, it's used as the build context to compare against.",
+		Args: cobra.ExactArgs(2),
+		Run:  handlerManifestDiff,
+	}
+	cmdDiff.Flags().StringP("output", "o", "text", "output format: text or json")
+	cmdManifest.AddCommand(cmdDiff)
+
+	return cmdManifest
+}
+
+func handlerManifestWrite(cmd *cobra.Command, args []string) {
+	config := loadConfig(cmd, args[1])
+	manifest := must(checksum.NewManifest(config))
+	must0(manifest.WriteFile(args[0]))
+}
+
+func handlerManifestDiff(cmd *cobra.Command, args []string) {
+	old := must(checksum.ReadManifest(args[0]))
+
+	var new *checksum.Manifest
+	if stat, err := os.Stat(args[1]); err == nil && stat.IsDir() {
+		new = must(checksum.NewManifest(loadConfig(cmd, args[1])))
+	} else {
+		new = must(checksum.ReadManifest(args[1]))
+	}
+
+	printManifestDiff(cmd, checksum.DiffManifests(old, new))
+}
+
+// printManifestDiff prints each change of diff on a line.
+func printManifestDiff(cmd *cobra.Command, diff checksum.ManifestDiff) {
+	printOutput(cmd, diff, func(out io.Writer) {
+		for _, path := range diff.Added {
+			fmt.Fprintln(out, "added:", path)
+		}
+		for _, path := range diff.Removed {
+			fmt.Fprintln(out, "removed:", path)
+		}
+		for _, path := range diff.Modified {
+			fmt.Fprintln(out, "modified:", path)
+		}
+		for _, change := range diff.Config {
+			fmt.Fprintln(out, change)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "dockerfile_source_checksum"
+
+// serverMetrics are the Prometheus metrics of serve.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	files       prometheus.Counter
+	filesHashed prometheus.Counter
+	bytesHashed prometheus.Counter
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+}
+
+func newServerMetrics() *serverMetrics {
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		})
+	}
+
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Checksum requests by protocol and result, ok or error.",
+		}, []string{"protocol", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time to calculate a checksum by protocol.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"protocol"}),
+		files:       counter("files_total", "Source files added to checksums."),
+		filesHashed: counter("files_hashed_total", "Source files whose content was read."),
+		bytesHashed: counter("bytes_hashed_total", "Bytes of source files that were read."),
+		cacheHits:   counter("cache_hits_total", "Source files whose digest was cached."),
+		cacheMisses: counter("cache_misses_total", "Source files read while a cache is used."),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.duration,
+		m.files,
+		m.filesHashed,
+		m.bytesHashed,
+		m.cacheHits,
+		m.cacheMisses,
+	)
+	return m
+}
+
+// observe records a request that started at start, with the stats of its
+// calculation.
+func (m *serverMetrics) observe(
+	protocol string,
+	start time.Time,
+	stats *checksum.Stats,
+	err error,
+) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.requests.WithLabelValues(protocol, result).Inc()
+	m.duration.WithLabelValues(protocol).Observe(time.Since(start).Seconds())
+
+	m.files.Add(float64(stats.Files.Load()))
+	m.filesHashed.Add(float64(stats.HashedFiles.Load()))
+	m.bytesHashed.Add(float64(stats.HashedBytes.Load()))
+	m.cacheHits.Add(float64(stats.CacheHits.Load()))
+	m.cacheMisses.Add(float64(stats.CacheMisses.Load()))
+}
+
+// handler serves the metrics in the Prometheus format.
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
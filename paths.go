@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdPaths() *cobra.Command {
+	cmdPaths := &cobra.Command{
+		Use:   "paths <context>",
+		Short: "List source paths added by the dockerfile",
+		Args:  cobra.ExactArgs(1),
+		Run:   handlerPaths,
+	}
+	cmdPaths.Flags().Bool(
+		"recursive", false, "also list everything under matched directories",
+	)
+	cmdPaths.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdPaths
+}
+
+func handlerPaths(cmd *cobra.Command, args []string) {
+	config := loadConfig(cmd, args[0])
+
+	var paths []string
+	if must(cmd.Flags().GetBool("recursive")) {
+		must0(checksum.WalkSourcePaths(config, func(
+			p string, d fs.DirEntry, err error,
+		) error {
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			return nil
+		}))
+	} else {
+		paths = must(checksum.SourcePaths(config))
+	}
+
+	if paths == nil {
+		paths = []string{}
+	}
+
+	printOutput(cmd, paths, func(out io.Writer) {
+		for _, path := range paths {
+			fmt.Fprintln(out, path)
+		}
+	})
+}
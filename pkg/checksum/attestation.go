@@ -0,0 +1,165 @@
+package checksum
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	// InTotoStatementType is the type of an in-toto statement.
+	InTotoStatementType = "https://in-toto.io/Statement/v1"
+	// SLSAProvenanceType is the predicate type of SLSA provenance.
+	SLSAProvenanceType = "https://slsa.dev/provenance/v1"
+	// attestationBuildType identifies how a checksum is calculated in
+	// provenance.
+	attestationBuildType = "https://github.com/inoc603/dockerfile-source-checksum/checksum@v1"
+)
+
+// attestationSubjectPrefix starts the name of the subject of a statement,
+// which is the sources of the dockerfile rather than the dockerfile itself.
+const attestationSubjectPrefix = "sources:"
+
+// SourceChecksumDigestKey returns the key of a source checksum in the digest
+// of a statement's subject, with the hash version and algorithm so it's not
+// mistaken for a digest of a file, e.g. sourceChecksumV1-sha1.
+func SourceChecksumDigestKey(hashVersion int, algorithm string) string {
+	if hashVersion == 0 {
+		hashVersion = HashVersion1
+	}
+	return fmt.Sprintf("sourceChecksumV%d-%s", hashVersion, algorithm)
+}
+
+// Statement is an in-toto statement whose subject is the source checksum
+// of a dockerfile, and whose predicate is SLSA provenance listing the sources.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// ResourceDescriptor is an artifact, identified by its digests.
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Provenance is a SLSA provenance predicate.
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the inputs of the checksum. External parameters
+// are the dockerfile, build args, labels, platforms and salt, and resolved
+// dependencies are the source files and URLs.
+type BuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   map[string]any       `json:"externalParameters"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// RunDetails describes what calculated the checksum.
+type RunDetails struct {
+	Builder Builder `json:"builder"`
+}
+
+// Builder identifies what calculated the checksum.
+type Builder struct {
+	ID string `json:"id"`
+}
+
+// NewAttestation calculates the checksum for a dockerfile and returns an
+// in-toto statement of it. Digests of dependencies are keyed by the hash
+// algorithm, or gitBlob with git blobs. Other digests, e.g. ETags of URLs,
+// are annotations.
+func NewAttestation(c Config) (*Statement, error) {
+	m, err := NewManifest(c)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]any{
+		"dockerfile":       m.Dockerfile,
+		"dockerfileDigest": map[string]string{m.Hash: m.DockerfileDigest},
+	}
+	// Only build args that are given are parameters, not ARG defaults and
+	// ENV of the dockerfile, which the manifest has.
+	if args := c.hashedBuildArgs(); len(args) > 0 {
+		params["buildArgs"] = args
+	}
+	if len(m.Labels) > 0 {
+		params["labels"] = m.Labels
+	}
+	if len(m.Platforms) > 0 {
+		params["platforms"] = m.Platforms
+	}
+	if m.Salt != "" {
+		params["salt"] = m.Salt
+	}
+	if m.HashVersion != 0 {
+		params["hashVersion"] = m.HashVersion
+	}
+
+	paths := maps.Keys(m.Files)
+	sort.Strings(paths)
+
+	deps := []ResourceDescriptor{}
+	for _, path := range paths {
+		dep := ResourceDescriptor{Name: path}
+		if isURL(path) {
+			dep = ResourceDescriptor{URI: path}
+		}
+
+		digest := m.Files[path]
+		switch {
+		case c.GitBlobs && !isURL(path):
+			dep.Digest = map[string]string{"gitBlob": digest}
+		case isContentDigest(c, m.Hash, digest):
+			dep.Digest = map[string]string{m.Hash: digest}
+		default:
+			dep.Annotations = map[string]string{"digest": digest}
+		}
+
+		deps = append(deps, dep)
+	}
+
+	return &Statement{
+		Type: InTotoStatementType,
+		Subject: []ResourceDescriptor{{
+			Name:   attestationSubjectPrefix + m.Dockerfile,
+			Digest: map[string]string{SourceChecksumDigestKey(c.HashVersion, m.Hash): m.Checksum},
+		}},
+		PredicateType: SLSAProvenanceType,
+		Predicate: Provenance{
+			BuildDefinition: BuildDefinition{
+				BuildType:            attestationBuildType,
+				ExternalParameters:   params,
+				ResolvedDependencies: deps,
+			},
+			RunDetails: RunDetails{
+				Builder: Builder{ID: "https://github.com/inoc603/dockerfile-source-checksum"},
+			},
+		},
+	}, nil
+}
+
+// WriteFile writes the statement to path as JSON.
+func (s *Statement) WriteFile(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode attestation")
+	}
+
+	return errors.Wrap(
+		os.WriteFile(path, append(content, '\n'), 0o644),
+		"write attestation",
+	)
+}
@@ -0,0 +1,369 @@
+package checksum
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	digestCacheFile = "digests.db"
+	// legacyDigestCacheFile is the JSON file the cache used to be saved in.
+	legacyDigestCacheFile = "digests.json"
+)
+
+var digestBucket = []byte("digests")
+
+// digestCacheTimeout is how long to wait for another process to release
+// the cache.
+var digestCacheTimeout = 5 * time.Second
+
+// DigestCache stores file digests so unchanged files don't have to be read
+// again. It's safe for concurrent use.
+//
+// A cache opened with OpenDigestCache is a bbolt database. It's opened
+// read-only on the first lookup, so concurrent runs can share it, and new
+// entries are only written by Save.
+type DigestCache struct {
+	// path is where the cache is saved. The cache is only kept in memory
+	// if it's empty.
+	path string
+
+	mu sync.Mutex
+	db *bolt.DB
+	// pending holds entries that aren't saved yet.
+	pending map[string]string
+}
+
+// NewDigestCache returns a cache that's only kept in memory.
+func NewDigestCache() *DigestCache {
+	return &DigestCache{pending: map[string]string{}}
+}
+
+// OpenDigestCache opens the cache saved in dir, or an empty cache if there's
+// none.
+func OpenDigestCache(dir string) (*DigestCache, error) {
+	return &DigestCache{
+		path:    filepath.Join(dir, digestCacheFile),
+		pending: map[string]string{},
+	}, nil
+}
+
+func (c *DigestCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if digest, ok := c.pending[key]; ok {
+		return digest, true
+	}
+
+	if c.path == "" {
+		return "", false
+	}
+
+	if c.db == nil {
+		if _, err := os.Stat(c.path); err != nil {
+			return "", false
+		}
+		db, err := c.openDB(true)
+		if err != nil {
+			// An unreadable cache only costs us a full rehash.
+			return "", false
+		}
+		c.db = db
+	}
+
+	var digest string
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(digestBucket); b != nil {
+			digest, _, _ = decodeCacheEntry(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	return digest, digest != ""
+}
+
+func (c *DigestCache) put(key, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[key] = digest
+}
+
+// Save writes new entries to disk in a single transaction, so concurrent
+// runs never see a partial update. It does nothing for in-memory caches,
+// and fails if another process holds the cache for longer than
+// digestCacheTimeout.
+func (c *DigestCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" {
+		return nil
+	}
+	c.closeDB()
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	db, err := c.openDB(false)
+	if err != nil {
+		return errors.Wrap(err, "save digest cache")
+	}
+	defer db.Close()
+
+	now := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(digestBucket)
+		if err != nil {
+			return err
+		}
+		for key, digest := range c.pending {
+			if err := b.Put([]byte(key), encodeCacheEntry(digest, now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "save digest cache")
+	}
+
+	c.pending = map[string]string{}
+	return nil
+}
+
+// Release closes the saved cache, so other processes can save it. It's
+// opened again by the next lookup, and entries that aren't saved are kept.
+func (c *DigestCache) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeDB()
+}
+
+func (c *DigestCache) closeDB() {
+	if c.db != nil {
+		c.db.Close()
+		c.db = nil
+	}
+}
+
+// openDB opens the saved cache, waiting for other processes writing to it.
+// A cache opened for writing is created if it doesn't exist.
+func (c *DigestCache) openDB(readOnly bool) (*bolt.DB, error) {
+	if !readOnly {
+		if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+			return nil, errors.Wrap(err, "create cache dir")
+		}
+	}
+
+	db, err := bolt.Open(c.path, 0o644, &bolt.Options{
+		ReadOnly: readOnly,
+		Timeout:  digestCacheTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "open digest cache")
+	}
+	return db, nil
+}
+
+// CacheStats describes a saved cache.
+type CacheStats struct {
+	Path    string `json:"path"`
+	Entries int    `json:"entries"`
+	// Size is the size of the cache file in bytes.
+	Size   int64     `json:"size"`
+	Oldest time.Time `json:"oldest,omitempty"`
+	Newest time.Time `json:"newest,omitempty"`
+}
+
+// Stats returns statistics of the saved cache.
+func (c *DigestCache) Stats() (CacheStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := CacheStats{Path: c.path}
+	if c.path == "" {
+		stats.Entries = len(c.pending)
+		return stats, nil
+	}
+
+	info, err := os.Stat(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, errors.Wrap(err, "stat digest cache")
+	}
+	stats.Size = info.Size()
+
+	c.closeDB()
+	db, err := c.openDB(true)
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(digestBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			_, saved, _ := decodeCacheEntry(v)
+			stats.Entries++
+			if stats.Oldest.IsZero() || saved.Before(stats.Oldest) {
+				stats.Oldest = saved
+			}
+			if saved.After(stats.Newest) {
+				stats.Newest = saved
+			}
+			return nil
+		})
+	})
+	return stats, errors.Wrap(err, "read digest cache")
+}
+
+// Prune removes entries of files that changed or no longer exist, and
+// entries saved longer than olderThan ago if it's not zero. It returns the
+// number of removed entries.
+func (c *DigestCache) Prune(olderThan time.Duration) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" {
+		return 0, nil
+	}
+	if _, err := os.Stat(c.path); errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+
+	c.closeDB()
+	db, err := c.openDB(false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var removed int
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(digestBucket)
+		if b == nil {
+			return nil
+		}
+
+		var stale [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			_, saved, ok := decodeCacheEntry(v)
+			if !ok || (olderThan > 0 && time.Since(saved) > olderThan) ||
+				!cacheKeyValid(string(k)) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(stale)
+		return nil
+	})
+	return removed, errors.Wrap(err, "prune digest cache")
+}
+
+// Clear removes the saved cache.
+func (c *DigestCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeDB()
+	c.pending = map[string]string{}
+	if c.path == "" {
+		return nil
+	}
+
+	for _, path := range []string{
+		c.path,
+		filepath.Join(filepath.Dir(c.path), legacyDigestCacheFile),
+	} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Wrap(err, "clear digest cache")
+		}
+	}
+	return nil
+}
+
+// encodeCacheEntry returns the value of a cache entry, with the time it's
+// saved so old entries can be pruned.
+func encodeCacheEntry(digest string, saved time.Time) []byte {
+	return []byte(strconv.FormatInt(saved.Unix(), 10) + " " + digest)
+}
+
+func decodeCacheEntry(v []byte) (digest string, saved time.Time, ok bool) {
+	unix, digest, ok := strings.Cut(string(v), " ")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return digest, time.Unix(seconds, 0), true
+}
+
+// cacheKey identifies a version of a file by its path, size, modification
+// time and inode. Any change to the file is expected to change at least one
+// of them.
+func cacheKey(algorithm, path string, info fs.FileInfo) string {
+	return fmt.Sprintf(
+		"%s:%s:%d:%d:%d",
+		algorithm, path, info.Size(), info.ModTime().UnixNano(), inode(info),
+	)
+}
+
+// urlCacheKeyPrefix starts the cache keys of URLs, which have the version
+// of the key shape so it can change without being mistaken for a file.
+const urlCacheKeyPrefix = "url1:"
+
+// urlCacheKey identifies a version of the content of a URL by its ETag.
+// The URL can't contain spaces, but the ETag can contain anything.
+func urlCacheKey(algorithm, url, etag string) string {
+	return urlCacheKeyPrefix + algorithm + ":" + url + " " + etag
+}
+
+// cacheKeyValid reports whether the file of a cache key still exists
+// unchanged. Entries of URLs are always valid, as checking them takes a
+// request, and they're only pruned by age.
+func cacheKeyValid(key string) bool {
+	if strings.HasPrefix(key, urlCacheKeyPrefix) {
+		return true
+	}
+
+	fields := strings.Split(key, ":")
+	if len(fields) < 5 {
+		return false
+	}
+
+	// Paths may contain colons, but the algorithm and numbers don't.
+	path := strings.Join(fields[1:len(fields)-3], ":")
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return cacheKey(fields[0], path, info) == key
+}
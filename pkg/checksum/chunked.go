@@ -0,0 +1,88 @@
+package checksum
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultLargeFileChunkSize is the size of chunks of large files hashed with
+// LargeFileChunked when the chunk size isn't set.
+const DefaultLargeFileChunkSize = 64 << 20
+
+// chunkedPrefix is the prefix of digests of files hashed in chunks, so
+// they're never the digest of a file read as a whole.
+const chunkedPrefix = "chunked:"
+
+// chunked reports whether a file is hashed in chunks. Content that's
+// converted for NormalizeEOL is read as a whole, as a line ending may span
+// chunks, and so are files hashed as git blobs.
+func (s *checksummer) chunked(info fs.FileInfo, conversion string) bool {
+	return s.largeFileMode == LargeFileChunked &&
+		info.Size() > s.largeFileThreshold &&
+		conversion == "" &&
+		s.blobs == nil
+}
+
+// chunkedAlgorithm is the name of algorithm in cache keys of digests of
+// files hashed in chunks of size, which differ from digests of the content.
+func chunkedAlgorithm(algorithm string, size int64) string {
+	return fmt.Sprintf("%s+chunked-%d", algorithm, size)
+}
+
+// chunkedDigests returns the digest of a file with each algorithm, which is
+// the digest of the digests of its chunks, in order. Up to concurrency
+// chunks are read at the same time if the file can be read at an offset.
+func (s *checksummer) chunkedDigests(path string, info fs.FileInfo) ([]string, error) {
+	f, err := s.fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size := s.largeFileChunkSize
+	chunks := make([][]string, (info.Size()+size-1)/size)
+	chunk := func(i int, r io.Reader) (err error) {
+		if s.readLimiter != nil {
+			r = &throttledReader{r: r, limiter: s.readLimiter, ctx: s.ctx}
+		}
+		chunks[i], err = digests(s.algorithms, r)
+		return err
+	}
+
+	if ra, ok := f.(io.ReaderAt); ok {
+		var g errgroup.Group
+		g.SetLimit(max(s.concurrency, 1))
+		for i := range chunks {
+			i := i
+			g.Go(func() error {
+				return chunk(i, io.NewSectionReader(ra, int64(i)*size, size))
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+	} else {
+		for i := range chunks {
+			if err := chunk(i, io.LimitReader(f, size)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	res := make([]string, len(s.algorithms))
+	for i, algorithm := range s.algorithms {
+		h, err := newHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		for _, digests := range chunks {
+			io.WriteString(h, digests[i])
+		}
+		res[i] = chunkedPrefix + hex.EncodeToString(h.Sum(nil))
+	}
+	return res, nil
+}
@@ -0,0 +1,27 @@
+package checksum
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/exp/maps"
+)
+
+// CombineChecksums returns a checksum of named checksums, e.g. for a group
+// of targets. The result doesn't depend on the order of names.
+func CombineChecksums(algorithm string, sums map[string]string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	names := maps.Keys(sums)
+	sort.Strings(names)
+	for _, name := range names {
+		must(io.WriteString(h, name))
+		must(io.WriteString(h, sums[name]))
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,98 @@
+package checksum
+
+// fileRead is a file whose digests are read in the background, with the
+// writes to the final hash and inputs that come after it in the walk.
+type fileRead struct {
+	done    chan struct{}
+	digests []string
+	remote  bool
+	err     error
+
+	// written writes the digests, or handles the error, once they're read.
+	written func(digests []string, remote bool, err error) error
+	// then are the writes after the file, up to the next file read in the
+	// background.
+	then []func()
+}
+
+// readError is an error of a file read in the background, which is
+// already wrapped with the directories it's in.
+type readError struct{ error }
+
+// readAsync calls read in the background, and written with its result in
+// the order of the walk. Up to concurrency files are read at the same time,
+// so it waits for the first of them if there are as many.
+func (s *checksummer) readAsync(
+	read func() ([]string, bool, error),
+	written func(digests []string, remote bool, err error) error,
+) (*fileRead, error) {
+	for len(s.reads) > 0 && (len(s.reads) >= s.concurrency || s.reads[0].isDone()) {
+		if err := s.waitRead(); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &fileRead{done: make(chan struct{}), written: written}
+	go func() {
+		defer close(r.done)
+		r.digests, r.remote, r.err = read()
+	}()
+	s.reads = append(s.reads, r)
+	return r, nil
+}
+
+func (r *fileRead) isDone() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait returns the result of read.
+func (r *fileRead) wait() ([]string, bool, error) {
+	<-r.done
+	return r.digests, r.remote, r.err
+}
+
+// waitRead waits for the first file read in the background, and makes the
+// writes up to the next one.
+func (s *checksummer) waitRead() error {
+	r := s.reads[0]
+	s.reads = s.reads[1:]
+
+	s.draining = true
+	defer func() { s.draining = false }()
+
+	if err := r.written(r.wait()); err != nil {
+		s.reads = nil
+		return readError{err}
+	}
+	for _, fn := range r.then {
+		fn()
+	}
+	return nil
+}
+
+// waitReads waits for every file read in the background.
+func (s *checksummer) waitReads() error {
+	for len(s.reads) > 0 {
+		if err := s.waitRead(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deferred adds fn to the writes after the last file that's read in the
+// background, and reports whether there's one. Otherwise fn is to be run
+// right away.
+func (s *checksummer) deferred(fn func()) bool {
+	if len(s.reads) == 0 || s.draining {
+		return false
+	}
+	r := s.reads[len(s.reads)-1]
+	r.then = append(r.then, fn)
+	return true
+}
@@ -2,6 +2,8 @@ package checksum
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -12,15 +14,27 @@ import (
 	"io/fs"
 	"log/slog"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/minio/highwayhash"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	"github.com/moby/patternmatcher"
 	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
 )
 
 type Config struct {
@@ -29,14 +43,185 @@ type Config struct {
 	Platforms  []string          `mapstructure:"platform"`
 	Dockerfile string            `mapstructure:"file"`
 	Workdir    string            `mapstructure:"workdir"`
-	Hash       string            `mapstructure:"hash"`
-	Debug      bool              `mapstructure:"debug"`
+	// DockerfileContent is used instead of reading Dockerfile if it's set,
+	// e.g. for a dockerfile read from stdin.
+	DockerfileContent []byte `mapstructure:"-"`
+	// ContextFS is the build context instead of Workdir if it's set, e.g.
+	// for a tar archive. Workdir only names it then. Digests of its files
+	// aren't cached, and it can't be used with git.
+	ContextFS fs.FS `mapstructure:"-"`
+	// Hash is the hash algorithm, or several separated by commas. Sources
+	// are read once for all of them.
+	Hash  string `mapstructure:"hash"`
+	Debug bool   `mapstructure:"debug"`
+	// CacheDir is where file digests are cached between runs. Caching is
+	// disabled when it's empty. Cached digests are only written to the
+	// checksum with HashVersion2.
+	CacheDir string `mapstructure:"cache-dir"`
+	// Cache is used instead of CacheDir if it's set, so a cache can be
+	// shared between calculations. It's not saved by the calculation.
+	Cache *DigestCache `mapstructure:"-"`
+	// Stats counts the work of the calculation if it's set.
+	Stats *Stats `mapstructure:"-"`
+	// ReadLimiter throttles reads of source files to its rate in bytes per
+	// second if it's set, e.g. from NewReadLimiter. It can be shared between
+	// calculations to limit them altogether.
+	ReadLimiter *rate.Limiter `mapstructure:"-"`
+	// OnInput is called with everything written to the hash, in order, as
+	// ExplainDockerfileChecksum returns it. Digests are of the first
+	// algorithm.
+	OnInput func(Input) `mapstructure:"-"`
+	// RemoteCache is the URL of a remote cache of file digests, shared
+	// between machines, as accepted by OpenRemoteCache. It's only used for
+	// files in a git repository.
+	RemoteCache string `mapstructure:"remote-cache"`
+	// RemoteAdd is how URLs in ADD are added to the checksum, one of
+	// RemoteAddOff, RemoteAddHead or RemoteAddFetch. URLs are ignored when
+	// it's empty.
+	RemoteAdd string `mapstructure:"remote-add"`
+	// LargeFileMode is how files above LargeFileThreshold are added, one of
+	// LargeFileContent, LargeFileMetadata or LargeFileChunked. Their content
+	// is read when it's empty.
+	LargeFileMode string `mapstructure:"large-file-mode"`
+	// LargeFileThreshold is the size in bytes of the largest file that is
+	// always read as a whole.
+	LargeFileThreshold int64 `mapstructure:"-"`
+	// LargeFileChunkSize is the size in bytes of chunks of large files with
+	// LargeFileChunked, DefaultLargeFileChunkSize if it's 0.
+	LargeFileChunkSize int64 `mapstructure:"-"`
+	// PinFrom adds the registry digests of images in FROM, for each
+	// platform.
+	PinFrom bool `mapstructure:"pin-from"`
+	// PinCopyFrom adds the registry digests of external images used by
+	// COPY --from and RUN --mount=from, for each platform.
+	PinCopyFrom bool `mapstructure:"pin-copy-from"`
+	// BuildContexts maps names of additional build contexts to their
+	// directories, as in --build-context of docker buildx build.
+	BuildContexts map[string]string `mapstructure:"build-context"`
+	// Target is the stage to build, the last stage by default. Only sources
+	// of the target and stages it depends on are used.
+	Target string `mapstructure:"target"`
+	// AllStages uses sources of every stage, ignoring Target.
+	AllStages bool `mapstructure:"all-stages"`
+	// ExtraPaths are paths or globs in the workdir to add as if they were
+	// copied by the dockerfile.
+	ExtraPaths []string `mapstructure:"extra-path"`
+	// GitTrackedOnly leaves out files that aren't tracked by git. Every
+	// context must be in a git repository.
+	GitTrackedOnly bool `mapstructure:"git-tracked-only"`
+	// GitBlobs uses git object ids as digests of files, so files that are
+	// unchanged in git don't have to be read. Other files are hashed as git
+	// blobs. Every context must be in a git repository.
+	GitBlobs bool `mapstructure:"git-blobs"`
+	// Strict fails the calculation if a source path doesn't exist, or a
+	// pattern matches nothing.
+	Strict bool `mapstructure:"strict"`
+	// SkipUnreadable adds a placeholder for source files and directories
+	// that can't be read for lack of permission, instead of failing the
+	// calculation.
+	SkipUnreadable bool `mapstructure:"skip-unreadable"`
+	// MaxDepth fails the calculation if a source is nested deeper than this
+	// many directories of a context, e.g. when / is included by mistake.
+	// There's no limit when it's 0.
+	MaxDepth int `mapstructure:"max-depth"`
+	// MaxFiles fails the calculation if there are more source files than
+	// this in all contexts. There's no limit when it's 0.
+	MaxFiles int `mapstructure:"max-files"`
+	// Concurrency is how many source files are read at the same time, along
+	// with their lookups in the remote cache. Files are read one at a time
+	// when it's 0 or 1, or with HashVersion1, which hashes their content in
+	// order.
+	Concurrency int `mapstructure:"concurrency"`
+	// Exclude is patterns of source paths to leave out of the checksum, in
+	// .dockerignore syntax, relative to the root of each context.
+	Exclude []string `mapstructure:"exclude"`
+	// IncludeOnbuild adds sources of ONBUILD COPY and ADD triggers, which
+	// are used by builds of images based on this one, from this context.
+	IncludeOnbuild bool `mapstructure:"include-onbuild"`
+	// IncludeMetadata adds the mode of every source file and directory.
+	IncludeMetadata bool `mapstructure:"include-metadata"`
+	// IncludeOwner adds the uid and gid of every source file and directory
+	// along with its mode. It's ignored unless IncludeMetadata is set.
+	IncludeOwner bool `mapstructure:"include-owner"`
+	// IncludeEmptyDirs adds source directories without files as such, since
+	// a build creates them. Otherwise an empty directory only adds its path,
+	// the same as an empty file.
+	IncludeEmptyDirs bool `mapstructure:"include-empty-dirs"`
+	// IncludeXattrs are extended attributes added for every source file and
+	// directory that has them, e.g. security.capability, since file
+	// capabilities change what a binary can do. They're read on linux and
+	// from tar archives.
+	IncludeXattrs []string `mapstructure:"include-xattrs"`
+	// NormalizeEOL hashes source files that are text with CRLF replaced by
+	// LF, so a checkout with autocrlf on Windows has the same checksum as on
+	// Linux. Files with a NUL byte near the start are binary and hashed as
+	// is. It can't be used with GitBlobs, which hashes files as they're in
+	// the index.
+	NormalizeEOL bool `mapstructure:"normalize-eol"`
+	// NormalizeUnicode hashes source paths in Unicode NFC, so names macOS
+	// keeps in NFD have the same checksum as on Linux. It's off by default,
+	// as it changes checksums of sources with NFD names.
+	NormalizeUnicode bool `mapstructure:"normalize-unicode"`
+	// FoldCase hashes source paths case folded, so a checkout on a
+	// case-insensitive filesystem, as on macOS and Windows, has the same
+	// checksum as on Linux. Paths that only differ in case are logged.
+	FoldCase bool `mapstructure:"fold-case"`
+	// HMACKey makes the checksum an HMAC with this key, so it can't be
+	// forged or matched to known sources without the key. Digests of
+	// individual files are not keyed.
+	HMACKey []byte `mapstructure:"-"`
+	// Salt is mixed into the checksum, so the same sources can have
+	// different checksums, e.g. for different pipelines or to bust caches.
+	Salt string `mapstructure:"salt"`
+	// NormalizeDockerfile hashes the dockerfile without comments and
+	// insignificant whitespace, instead of its content as is.
+	NormalizeDockerfile bool `mapstructure:"normalize-dockerfile"`
+	// CanonicalDockerfile hashes a serialization of the parsed instructions
+	// instead of the dockerfile content, so only changes to instructions
+	// change the checksum. It takes precedence over NormalizeDockerfile.
+	CanonicalDockerfile bool `mapstructure:"canonical-dockerfile"`
+	// IgnoreBuildArgs are build args left out of the checksum. They're still
+	// used to expand variables in the dockerfile.
+	IgnoreBuildArgs []string `mapstructure:"ignore-build-args"`
+	// ArgsFromEnv sets args declared by the dockerfile that aren't in
+	// BuildArgs from environment variables of the same name, if they're set.
+	ArgsFromEnv bool `mapstructure:"args-from-env"`
+	// SecretArgs are build args with secret values. Only their keys are
+	// added to the checksum, or an HMAC of the value if HMACKey is set, and
+	// their values are never logged.
+	SecretArgs []string `mapstructure:"secret-arg"`
+	// IgnorePlatforms leaves platforms out of the checksum. They're still
+	// used to pin images.
+	IgnorePlatforms bool `mapstructure:"ignore-platforms"`
+	// IgnoreLabels leaves labels out of the checksum.
+	IgnoreLabels bool `mapstructure:"ignore-labels"`
+	// HashVersion is how everything is encoded when it's written to the
+	// hash, HashVersion1 by default.
+	HashVersion int `mapstructure:"hash-version"`
 
 	logger *slog.Logger
+	ctx    context.Context
 }
 
+// SetLogger sets the logger of calculations. Records have a component key
+// set to checksum.
 func (c *Config) SetLogger(l *slog.Logger) {
-	c.logger = l
+	c.logger = l.With("component", "checksum")
+}
+
+// Algorithms returns the hash algorithms in Hash.
+func (c Config) Algorithms() []string {
+	var res []string
+	for _, algorithm := range strings.Split(c.Hash, ",") {
+		res = append(res, strings.TrimSpace(algorithm))
+	}
+	return res
+}
+
+// Algorithm returns the first hash algorithm in Hash, which is used by
+// everything that supports a single algorithm.
+func (c Config) Algorithm() string {
+	return c.Algorithms()[0]
 }
 
 func mapToAttr(m map[string]string) []any {
@@ -46,142 +231,1693 @@ func mapToAttr(m map[string]string) []any {
 	for _, key := range keys {
 		res = append(res, slog.String(key, m[key]))
 	}
-	return res
+	return res
+}
+
+// CalculateDockerfileChecksum returns a source-based checksum for a
+// dockerfile, with the first algorithm if there are several.
+func CalculateDockerfileChecksum(c Config) (string, error) {
+	sums, err := calculate(c, calculation{})
+	if err != nil {
+		return "", err
+	}
+	return sums[0], nil
+}
+
+// CalculateDockerfileChecksums returns the checksum for a dockerfile with
+// each algorithm in Hash, in the same order.
+func CalculateDockerfileChecksums(c Config) ([]string, error) {
+	return calculate(c, calculation{})
+}
+
+// ExplainDockerfileChecksum returns the checksum for a dockerfile, along with
+// everything written to the hash in order. Digests are of the first
+// algorithm.
+func ExplainDockerfileChecksum(c Config) (string, []Input, error) {
+	var inputs []Input
+	sums, err := calculate(c, calculation{onInput: func(in Input) {
+		inputs = append(inputs, in)
+	}})
+	if err != nil {
+		return "", nil, err
+	}
+	return sums[0], inputs, nil
+}
+
+// calculation is what a calculation reports besides the checksums, and the
+// digests it can reuse. Every field is optional.
+type calculation struct {
+	// onInput is called with every input.
+	onInput func(Input)
+	// timings records how long each step took.
+	timings *Timings
+	// known are digests of files with each algorithm, keyed by their path
+	// prefixed as in Result.Files, used instead of reading the files.
+	known map[string][]string
+	// digests records the digests of every file, as in known.
+	digests map[string][]string
+}
+
+// calculate returns the checksum with each algorithm.
+func calculate(c Config, calc calculation) (sums []string, err error) {
+	ctx, span := tracer.Start(c.context(), "calculate", trace.WithAttributes(
+		attribute.String("dockerfile", c.Dockerfile),
+		attribute.String("workdir", c.Workdir),
+	))
+	defer func() { endSpan(span, err) }()
+
+	timings := calc.timings
+	if timings == nil {
+		timings = &Timings{}
+	}
+	start := time.Now()
+	defer func() {
+		timings.Total = time.Since(start)
+		c.logger.Debug(
+			"calculate checksum",
+			"path", c.Workdir,
+			"duration", time.Since(start),
+			"error", err,
+		)
+	}()
+
+	c.logger.Debug("buildArgs:", mapToAttr(c.redactSecrets(c.BuildArgs))...)
+
+	// Build args are updated with ARG defaults and ENV from the dockerfile.
+	c.BuildArgs = cloneMap(c.BuildArgs)
+
+	_, parseSpan := tracer.Start(ctx, "parse dockerfile")
+	content, res, err := c.readDockerfile()
+	endSpan(parseSpan, err)
+	timings.Parse = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.CanonicalDockerfile:
+		content = canonicalDockerfile(content, res)
+	case c.NormalizeDockerfile:
+		content = normalizeDockerfile(content, res)
+	}
+
+	workdir := c.contextFS()
+
+	c.ctx = ctx
+	s, err := newChecksummer(c, workdir, calc.onInput)
+	if err != nil {
+		return nil, err
+	}
+	s.known, s.digests = calc.known, calc.digests
+	defer s.closeAttributes()
+	// The cache is opened by lookups, so it's released on every path for
+	// other processes, or other caches of the same file, to save it.
+	defer func() {
+		if err != nil {
+			s.releaseCache()
+			return
+		}
+		if err = s.saveCache(c); err != nil {
+			sums = nil
+		}
+	}()
+
+	s.writeSalt(c.Salt)
+
+	// Add dockerfile to checksum
+	c.logger.Debug(
+		"add dockerfile to checksum",
+		"workdir", workdir,
+		"dockerfile", c.Dockerfile,
+	)
+	dockerfileDigest, err := digest(c.Algorithm(), bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	s.writeField(s.h, string(InputDockerfile), string(content))
+	s.input(Input{
+		Kind:   InputDockerfile,
+		Path:   c.Dockerfile,
+		Digest: dockerfileDigest,
+	})
+
+	// Add copied source to checksum
+	resolveStart := time.Now()
+	_, resolveSpan := tracer.Start(ctx, "resolve sources")
+	src, err := c.sources(res, c.BuildArgs)
+	endSpan(resolveSpan, err)
+	timings.Resolve = time.Since(resolveStart)
+	if err != nil {
+		return nil, err
+	}
+	hashStart := time.Now()
+	defer func() { timings.Hash = time.Since(hashStart) }()
+	var hashSpan trace.Span
+	s.ctx, hashSpan = tracer.Start(ctx, "hash sources")
+	err = s.pathsSha(src.paths)
+	endSpan(hashSpan, err)
+	s.ctx = ctx
+	if err != nil {
+		return nil, err
+	}
+
+	// Add sources from named contexts to checksum
+	contextPaths, copyImages, err := src.resolveExternal(c.BuildContexts)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Strict {
+		if err := src.check(workdir, c.BuildContexts, contextPaths); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.contextsSha(c.BuildContexts, contextPaths); err != nil {
+		return nil, err
+	}
+
+	if c.PinFrom {
+		if err := s.imagesSha(src.images, c.Platforms); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.PinCopyFrom {
+		if err := s.imagesSha(copyImages, c.Platforms); err != nil {
+			return nil, err
+		}
+	}
+
+	s.writeMap(InputBuildArg, c.hashedBuildArgs())
+
+	s.writeSlice(InputPlatform, c.hashedPlatforms())
+
+	s.writeMap(InputLabel, c.hashedLabels())
+
+	return s.sums(), nil
+}
+
+// hashedBuildArgs returns build args that are added to the checksum, with
+// values of secret args replaced.
+func (c Config) hashedBuildArgs() map[string]string {
+	if len(c.IgnoreBuildArgs) == 0 && len(c.SecretArgs) == 0 {
+		return c.BuildArgs
+	}
+
+	res := cloneMap(c.BuildArgs)
+	for _, key := range c.IgnoreBuildArgs {
+		delete(res, key)
+	}
+	for _, key := range c.SecretArgs {
+		if value, ok := res[key]; ok {
+			res[key] = c.secretDigest(value)
+		}
+	}
+	return res
+}
+
+// secretDigest returns what's added to the checksum for the value of a
+// secret arg: nothing, or its HMAC if there's a key.
+func (c Config) secretDigest(value string) string {
+	if c.HMACKey == nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, c.HMACKey)
+	must(io.WriteString(mac, value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// redactSecrets returns build args with values of secret args redacted, for
+// logging.
+func (c Config) redactSecrets(args map[string]string) map[string]string {
+	if len(c.SecretArgs) == 0 {
+		return args
+	}
+
+	res := cloneMap(args)
+	for _, key := range c.SecretArgs {
+		if _, ok := res[key]; ok {
+			res[key] = "<redacted>"
+		}
+	}
+	return res
+}
+
+// hashedPlatforms returns platforms that are added to the checksum.
+func (c Config) hashedPlatforms() []string {
+	if c.IgnorePlatforms {
+		return nil
+	}
+	return c.Platforms
+}
+
+// hashedLabels returns labels that are added to the checksum.
+func (c Config) hashedLabels() map[string]string {
+	if c.IgnoreLabels {
+		return nil
+	}
+	return c.Labels
+}
+
+// cloneMap returns a copy of m that's never nil.
+func cloneMap(m map[string]string) map[string]string {
+	res := make(map[string]string, len(m))
+	maps.Copy(res, m)
+	return res
+}
+
+// SourcePaths returns paths in the workdir that are added by a dockerfile,
+// with globs expanded. Directories are returned as is, without their
+// children.
+func SourcePaths(c Config) ([]string, error) {
+	_, res, err := c.readDockerfile()
+	if err != nil {
+		return nil, err
+	}
+
+	workdir := c.contextFS()
+
+	filter, err := newPathFilter(c, c.Workdir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	seen := map[string]bool{}
+	src, err := c.sources(res, cloneMap(c.BuildArgs))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range src.paths {
+		if isURL(path) {
+			continue
+		}
+
+		files, err := globPath(workdir, path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if !seen[file] && !filter.skip(file) {
+				seen[file] = true
+				paths = append(paths, file)
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// WalkSourcePaths calls fn for every path of SourcePaths and everything under
+// them in the build context, like fs.WalkDir. Excluded paths are skipped
+// along with their children.
+func WalkSourcePaths(c Config, fn fs.WalkDirFunc) error {
+	paths, err := SourcePaths(c)
+	if err != nil {
+		return err
+	}
+
+	filter, err := newPathFilter(c, c.Workdir)
+	if err != nil {
+		return err
+	}
+
+	workdir := c.contextFS()
+	for _, path := range paths {
+		err := fs.WalkDir(workdir, path, func(
+			p string, d fs.DirEntry, err error,
+		) error {
+			if err == nil && p != path && filter.skip(p) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			return fn(p, d, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contextFS returns the file system of the build context.
+func (c Config) contextFS() fs.FS {
+	if c.ContextFS != nil {
+		return c.ContextFS
+	}
+	return os.DirFS(c.Workdir)
+}
+
+func (c Config) readDockerfile() ([]byte, *parser.Result, error) {
+	content := c.DockerfileContent
+	if content == nil {
+		var err error
+		content, err = os.ReadFile(c.Dockerfile)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = Mark(err, ErrDockerfileNotFound)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read dockerfile")
+		}
+	}
+
+	res, err := parser.Parse(bytes.NewBuffer(content))
+	if err != nil {
+		return nil, nil, c.withDockerfile(newParseError(err))
+	}
+
+	return content, res, nil
+}
+
+// globPath returns files in fsys matching a source path of the dockerfile,
+// with the pattern syntax of BuildKit, where ** matches any number of
+// directories. Absolute paths are relative to the root of fsys. A matched
+// directory is returned without its children.
+func globPath(fsys fs.FS, path string) ([]string, error) {
+	// Sources are relative to the root of the context, whether they're
+	// written as /src, ./src or src/, e.g. when a variable like
+	// TARGETVARIANT is empty, and can't go above it.
+	path = strings.TrimPrefix(pathpkg.Clean("/"+path), "/")
+	if path == "" {
+		path = "."
+	}
+
+	if !hasWildcard(path) {
+		if _, err := fs.Stat(fsys, path); err != nil {
+			return nil, nil
+		}
+		return []string{path}, nil
+	}
+
+	pm, err := patternmatcher.New([]string{path})
+	if err != nil {
+		return nil, errors.Wrapf(err, "glob %s", path)
+	}
+
+	// Only walk the directory before the first component with a wildcard.
+	var root []string
+	for _, dir := range strings.Split(path, "/") {
+		if hasWildcard(dir) {
+			break
+		}
+		root = append(root, dir)
+	}
+
+	rootDir := pathpkg.Join(append([]string{"."}, root...)...)
+	if _, err := fs.Stat(fsys, rootDir); err != nil {
+		return nil, nil
+	}
+
+	var files []string
+	err = fs.WalkDir(fsys, rootDir, func(
+		p string, d fs.DirEntry, err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		// The root has no wildcard, so it's never a match by itself.
+		if p == rootDir {
+			return nil
+		}
+
+		ok, err := pm.MatchesOrParentMatches(p)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		files = append(files, p)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "glob %s", path)
+	}
+
+	return files, nil
+}
+
+// hasWildcard reports whether a source path is a pattern.
+func hasWildcard(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// HashAlgorithms are the supported hash algorithms.
+var HashAlgorithms = []string{"sha1", "md5", "sha256", "blake3", "xxhash64", "xxh3", "highwayhash"}
+
+// fastHashes are the hash algorithms that aren't cryptographic. They're
+// several times faster, and only good for telling whether sources changed,
+// as anyone can make other sources with the same checksum.
+var fastHashes = []string{"xxhash64", "xxh3", "highwayhash"}
+
+// highwayhashKey is the key of highwayhash, which is public, as it's only
+// used to detect changes.
+var highwayhashKey = make([]byte, highwayhash.Size)
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "blake3":
+		return blake3.New(), nil
+	case "xxhash64":
+		return xxhash.New(), nil
+	case "xxh3":
+		return xxh3.New(), nil
+	case "highwayhash":
+		return highwayhash.New(highwayhashKey)
+	default:
+		return nil, Mark(
+			errors.Errorf("unknown hash algorithm %s", algorithm), ErrUnsupportedHash,
+		)
+	}
+}
+
+// digest returns the hex digest of everything in r.
+func digest(algorithm string, r io.Reader) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digests returns the hex digest of everything in r with each algorithm,
+// reading r once.
+func digests(algorithms []string, r io.Reader) ([]string, error) {
+	hashes := make([]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, len(algorithms))
+	for i, algorithm := range algorithms {
+		h, err := newHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i], writers[i] = h, h
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return nil, err
+	}
+
+	res := make([]string, len(hashes))
+	for i, h := range hashes {
+		res[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return res, nil
+}
+
+// repeat returns a slice of n copies of digest, for digests that don't
+// depend on the algorithm.
+func repeat(digest string, n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = digest
+	}
+	return res
+}
+
+// newChecksummer returns a checksummer for sources in workdir.
+func newChecksummer(
+	c Config,
+	workdir fs.FS,
+	onInput func(Input),
+) (*checksummer, error) {
+	if err := checkHashVersion(c.HashVersion); err != nil {
+		return nil, err
+	}
+	if err := checkLargeFileMode(c.LargeFileMode); err != nil {
+		return nil, err
+	}
+	if c.HMACKey != nil {
+		for _, algorithm := range c.Algorithms() {
+			if slices.Contains(fastHashes, algorithm) {
+				return nil, errors.Errorf("%s isn't cryptographic, it can't be used with an HMAC key", algorithm)
+			}
+		}
+	}
+
+	s := &checksummer{
+		fsys:       workdir,
+		algorithms: c.Algorithms(),
+		logger:     c.logger,
+		remoteAdd:  c.RemoteAdd,
+		version:    c.HashVersion,
+		hmacKey:    c.HMACKey,
+		onInput:    chainInput(onInput, c.OnInput),
+
+		includeMetadata:  c.IncludeMetadata,
+		includeOwner:     c.IncludeOwner,
+		skipUnreadable:   c.SkipUnreadable,
+		includeEmptyDirs: c.IncludeEmptyDirs,
+		includeXattrs:    c.IncludeXattrs,
+		normalizeEOL:     c.NormalizeEOL,
+		normalizeUnicode: c.NormalizeUnicode,
+		foldCase:         c.FoldCase,
+		concurrency:      c.Concurrency,
+		readLimiter:      c.ReadLimiter,
+
+		maxDepth: c.MaxDepth,
+		maxFiles: c.MaxFiles,
+		files:    new(int),
+		links:    map[fileID][]string{},
+		reading:  map[fileID]*fileRead{},
+
+		attributes: map[string]*gitAttributes{},
+
+		largeFileMode:      c.LargeFileMode,
+		largeFileThreshold: c.LargeFileThreshold,
+		largeFileChunkSize: c.LargeFileChunkSize,
+
+		ctx:   c.context(),
+		stats: c.Stats,
+	}
+	if s.stats == nil {
+		s.stats = &Stats{}
+	}
+	if s.largeFileChunkSize <= 0 {
+		s.largeFileChunkSize = DefaultLargeFileChunkSize
+	}
+
+	if err := s.resetHashes(); err != nil {
+		return nil, err
+	}
+
+	// Only log writes to the first hash, as the others get the same.
+	if c.Debug {
+		s.hashes[0] = newHashWithLog(s.hashes[0], c.logger)
+		s.h = io.MultiWriter(s.writers()...)
+	}
+
+	var err error
+	s.filter, err = newPathFilter(c, c.Workdir)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.GitBlobs {
+		if c.ContextFS != nil {
+			return nil, errors.New("git blobs can't be used with this build context")
+		}
+		if c.NormalizeEOL {
+			return nil, errors.New("line endings can't be normalized with git blobs")
+		}
+		s.blobs, err = readGitBlobs(c.Workdir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Files of a context that isn't a directory have no stable path to
+	// cache their digests by.
+	if c.ContextFS != nil {
+		return s, nil
+	}
+	s.dir = c.Workdir
+
+	s.cache = c.Cache
+	if s.cache == nil && c.CacheDir != "" {
+		s.cache, err = OpenDigestCache(c.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.cache != nil {
+		s.realWorkdir, err = filepath.Abs(c.Workdir)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve workdir")
+		}
+	}
+
+	// Git blobs are already content addresses, there's nothing to look up.
+	if c.RemoteCache != "" && s.blobs == nil {
+		s.remote, err = OpenRemoteCache(c.RemoteCache)
+		if err != nil {
+			return nil, err
+		}
+		s.objects = s.readObjects(c.Workdir)
+	}
+
+	return s, nil
+}
+
+// readObjects returns git object ids of files under dir to look them up in
+// the remote cache by, or nil if dir isn't in a git repository.
+func (s *checksummer) readObjects(dir string) *gitBlobs {
+	objects, err := readGitBlobs(dir)
+	if err != nil {
+		s.logger.Debug("no remote cache outside of git", "dir", dir, "error", err)
+		return nil
+	}
+	return objects
+}
+
+// saveCache saves the cache unless it's shared with c.Cache, which is saved
+// by its owner, and uploads new entries to the remote cache.
+func (s *checksummer) saveCache(c Config) error {
+	if s.remote != nil {
+		if err := s.remote.Save(); err != nil {
+			s.logger.Warn("remote cache not saved", "error", err)
+		}
+	}
+	if c.Cache == nil && s.cache != nil {
+		return s.cache.Save()
+	}
+	s.releaseCache()
+	return nil
+}
+
+// releaseCache closes the saved cache until the next lookup.
+func (s *checksummer) releaseCache() {
+	if s.cache != nil {
+		s.cache.Release()
+	}
+}
+
+// checksummer walks source paths and writes them to the final hash.
+type checksummer struct {
+	fsys fs.FS
+	// dir is the directory of fsys, or empty if it's not a directory.
+	dir string
+
+	algorithms []string
+	// hashes are the final hashes of each algorithm, and h writes to all
+	// of them.
+	hashes []hash.Hash
+	h      io.Writer
+	logger *slog.Logger
+
+	// realWorkdir is the absolute path of fsys on disk, used to build cache
+	// keys. It's only set when cache is enabled.
+	realWorkdir string
+	cache       *DigestCache
+	remote      *RemoteCache
+	// objects are git object ids of files that are looked up in the remote
+	// cache, nil if it's not used.
+	objects *gitBlobs
+
+	remoteAdd string
+	hmacKey   []byte
+	version   int
+
+	includeMetadata  bool
+	includeOwner     bool
+	skipUnreadable   bool
+	includeEmptyDirs bool
+	includeXattrs    []string
+	normalizeEOL     bool
+	normalizeUnicode bool
+	foldCase         bool
+
+	// concurrency is how many files are read in the background at most.
+	concurrency int
+	// readLimiter throttles reads of source files, if it's set.
+	readLimiter *rate.Limiter
+	// reads are the files read in the background, in the order of the walk.
+	reads []*fileRead
+	// draining is set while the writes after a file read in the background
+	// are made.
+	draining bool
+
+	maxDepth int
+	maxFiles int
+	// files counts source files of every context against maxFiles.
+	files *int
+	// dirs are the directories being walked, from the outermost.
+	dirs []walkedDir
+	// links are digests of files with hard links, by their hardlinkID.
+	links map[fileID][]string
+	// reading are files with hard links that are read in the background.
+	reading map[fileID]*fileRead
+	// attributes are the git attributes of each context directory, if
+	// normalizeEOL is set.
+	attributes map[string]*gitAttributes
+
+	largeFileMode      string
+	largeFileThreshold int64
+	largeFileChunkSize int64
+
+	filter *pathFilter
+	// blobs is used for digests of files that are unchanged in git, nil
+	// unless git blobs are used.
+	blobs *gitBlobs
+
+	onInput func(Input)
+
+	// known and digests are as in calculation, with paths prefixed by
+	// context.
+	known   map[string][]string
+	digests map[string][]string
+	// context is the prefix of paths from a named context in known and
+	// digests.
+	context string
+
+	// ctx is the parent of spans of hashed files.
+	ctx   context.Context
+	stats *Stats
+}
+
+// resetHashes replaces the final hashes with new ones, keyed with hmacKey
+// if it's set.
+func (s *checksummer) resetHashes() error {
+	s.hashes = make([]hash.Hash, len(s.algorithms))
+	for i, algorithm := range s.algorithms {
+		h, err := newHash(algorithm)
+		if err != nil {
+			return err
+		}
+		if s.hmacKey != nil {
+			h = hmac.New(func() hash.Hash {
+				h, _ := newHash(algorithm)
+				return h
+			}, s.hmacKey)
+		}
+		s.hashes[i] = h
+	}
+	s.h = io.MultiWriter(s.writers()...)
+
+	if s.version == HashVersion2 {
+		s.writeField(s.h, "version", "2")
+	}
+	return nil
+}
+
+func (s *checksummer) writers() []io.Writer {
+	res := make([]io.Writer, len(s.hashes))
+	for i, h := range s.hashes {
+		res[i] = h
+	}
+	return res
+}
+
+// sums returns the hex sum of each final hash.
+func (s *checksummer) sums() []string {
+	res := make([]string, len(s.hashes))
+	for i, h := range s.hashes {
+		res[i] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return res
+}
+
+// chainInput returns a function calling each of fns that isn't nil.
+func chainInput(fns ...func(Input)) func(Input) {
+	var res []func(Input)
+	for _, fn := range fns {
+		if fn != nil {
+			res = append(res, fn)
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return func(in Input) {
+		for _, fn := range res {
+			fn(in)
+		}
+	}
+}
+
+func (s *checksummer) input(in Input) {
+	if s.onInput == nil || s.deferred(func() { s.input(in) }) {
+		return
+	}
+	s.onInput(in)
+}
+
+// writeSalt writes salt to the final hash, if it's not empty.
+func (s *checksummer) writeSalt(salt string) {
+	if salt == "" {
+		return
+	}
+	s.writeField(s.h, string(InputSalt), salt)
+	s.input(Input{Kind: InputSalt, Value: salt})
+}
+
+func (s *checksummer) writePath(path string) {
+	s.writeField(s.h, string(InputPath), s.hashedPath(path))
+	s.input(Input{Kind: InputPath, Path: path})
+}
+
+func (s *checksummer) writeMap(kind InputKind, m map[string]string) {
+	keys := maps.Keys(m)
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.writeField(s.h, string(kind), key, m[key])
+		s.input(Input{Kind: kind, Key: key, Value: m[key]})
+	}
+}
+
+func (s *checksummer) writeSlice(kind InputKind, values []string) {
+	// values are often of the config, which calculations may share.
+	values = slices.Clone(values)
+	sort.Strings(values)
+	for _, value := range values {
+		s.writeField(s.h, string(kind), value)
+		s.input(Input{Kind: kind, Value: value})
+	}
+}
+
+// pathsSha writes every file matching paths to the final hash.
+func (s *checksummer) pathsSha(paths []string) error {
+	for _, path := range paths {
+		s.logger.Debug("calculate checksum for path", "path", path)
+
+		if isURL(path) {
+			if err := s.urlSha(path); err != nil {
+				return errors.Wrapf(err, "calculate checksum for %s", path)
+			}
+			continue
+		}
+
+		files, err := globPath(s.fsys, path)
+		if err != nil {
+			return err
+		}
+		s.sortPaths(files)
+
+		for _, file := range files {
+			if s.skip(file) {
+				continue
+			}
+
+			s.writePath(file)
+			if err := s.pathSha(file); err != nil {
+				return errors.Wrapf(err, "calculate checksum for %s", file)
+			}
+		}
+	}
+
+	return nil
+}
+
+// contextsSha writes paths from each named context to the final hash, with
+// the context name before its paths.
+func (s *checksummer) contextsSha(
+	contexts map[string]string,
+	contextPaths map[string][]string,
+) error {
+	names := maps.Keys(contextPaths)
+	sort.Strings(names)
+
+	for _, name := range names {
+		dir := contexts[name]
+
+		cs := *s
+		cs.fsys = os.DirFS(dir)
+		cs.dir = dir
+		cs.context = name + ":"
+
+		filter, err := s.filter.forDir(dir)
+		if err != nil {
+			return errors.Wrapf(err, "build context %s", name)
+		}
+		cs.filter = filter
+
+		if s.blobs != nil {
+			cs.blobs, err = readGitBlobs(dir)
+			if err != nil {
+				return errors.Wrapf(err, "build context %s", name)
+			}
+		}
+		if s.remote != nil {
+			cs.objects = s.readObjects(dir)
+		}
+		if s.cache != nil {
+			realDir, err := filepath.Abs(dir)
+			if err != nil {
+				return errors.Wrapf(err, "resolve build context %s", name)
+			}
+			cs.realWorkdir = realDir
+		}
+
+		s.writeField(s.h, string(InputContext), name)
+		s.input(Input{Kind: InputContext, Key: name, Path: dir})
+
+		var span trace.Span
+		cs.ctx, span = tracer.Start(s.ctx, "hash context", trace.WithAttributes(
+			attribute.String("context", name),
+		))
+		err = cs.pathsSha(contextPaths[name])
+		endSpan(span, err)
+		if err != nil {
+			return errors.Wrapf(err, "build context %s", name)
+		}
+	}
+
+	return nil
+}
+
+// pathSha writes a source file, or every path in a source directory, to
+// the final hash. Directories are walked depth first in sorted order with a
+// stack of the directories being walked instead of recursion, so only the
+// entries left in each of them are held, however deep the tree is.
+func (s *checksummer) pathSha(path string) (err error) {
+	base := len(s.dirs)
+	defer func() {
+		s.dirs = s.dirs[:base]
+		// Files read in the background are before anything that failed in
+		// the walk, so their errors come first.
+		if readErr := s.waitReads(); readErr != nil {
+			err = readErr
+		}
+		var read readError
+		if errors.As(err, &read) {
+			err = read.error
+		}
+	}()
+
+	if err := s.entrySha(path); err != nil {
+		return err
+	}
+
+	for len(s.dirs) > base {
+		dir := &s.dirs[len(s.dirs)-1]
+		if len(dir.children) == 0 {
+			if dir.empty && s.includeEmptyDirs {
+				s.writeField(s.h, string(InputEmptyDir), emptyDirValue)
+				s.input(Input{Kind: InputEmptyDir, Path: dir.path})
+			}
+			s.dirs = s.dirs[:len(s.dirs)-1]
+			continue
+		}
+
+		child := dir.children[0]
+		dir.children = dir.children[1:]
+		if s.skip(child) {
+			continue
+		}
+		dir.empty = false
+
+		s.writePath(child)
+		if err := s.entrySha(child); err != nil {
+			var read readError
+			if errors.As(err, &read) {
+				return err
+			}
+			return walkError(s.dirs[base:], child, err)
+		}
+	}
+
+	return nil
+}
+
+// walkError wraps err of child with the directories it's in, below the
+// directory the walk started from, which are dirs.
+func walkError(dirs []walkedDir, child string, err error) error {
+	if len(dirs) == 0 {
+		return err
+	}
+	err = fmt.Errorf("calculating hash for %s: %w", child, err)
+	for i := len(dirs) - 1; i > 0; i-- {
+		err = fmt.Errorf("calculating hash for %s: %w", dirs[i].path, err)
+	}
+	return err
+}
+
+// entrySha writes a source file to the final hash, or its metadata and
+// pushes it to dirs to be walked if it's a directory.
+func (s *checksummer) entrySha(path string) error {
+	stat, err := fs.Stat(s.fsys, path)
+	if err != nil {
+		return s.unreadable(path, err)
+	}
+	if err := s.checkLimits(path, stat); err != nil {
+		return err
+	}
+
+	if s.includeMetadata {
+		s.writeMetadata(path, stat)
+	}
+	if err := s.writeXattrs(path, stat); err != nil {
+		return err
+	}
+
+	if !stat.IsDir() {
+		if !stat.Mode().IsRegular() {
+			s.specialSha(path, stat.Mode())
+			return nil
+		}
+		return s.unreadable(path, s.fileSha(path, stat))
+	}
+
+	// Directories are followed through symlinks, so a symlink to a parent
+	// would be walked forever.
+	for _, dir := range s.dirs {
+		if os.SameFile(dir.info, stat) {
+			return errors.Errorf(
+				"%s is a symlink cycle, it's the directory %s again",
+				s.context+path, s.context+dir.path,
+			)
+		}
+	}
+
+	children, err := s.readDir(path)
+	if err != nil {
+		return s.unreadable(path, err)
+	}
+	s.dirs = append(s.dirs, walkedDir{path: path, info: stat, children: children, empty: true})
+	return nil
+}
+
+// readDir returns the paths in a directory, in the order they're hashed.
+func (s *checksummer) readDir(path string) ([]string, error) {
+	children, err := fs.ReadDir(s.fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("fs.ReadDir: %w", err)
+	}
+
+	childPaths := make([]string, len(children))
+	for i, child := range children {
+		childPaths[i] = pathpkg.Join(path, child.Name())
+	}
+	s.sortPaths(childPaths)
+	return childPaths, nil
+}
+
+// specialSha writes the type of a file that isn't regular to the final hash,
+// instead of its content. Reading a named pipe would block, and other types
+// can't be read at all, and their content isn't part of a build either.
+func (s *checksummer) specialSha(path string, mode fs.FileMode) {
+	var kind string
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		kind = "named pipe"
+	case mode&fs.ModeSocket != 0:
+		kind = "socket"
+	case mode&fs.ModeCharDevice != 0:
+		kind = "char device"
+	case mode&fs.ModeDevice != 0:
+		kind = "device"
+	default:
+		kind = "irregular"
+	}
+
+	s.logger.Debug("skip special file", "path", s.context+path, "type", kind)
+	s.writeField(s.h, string(InputSpecial), kind)
+	s.input(Input{Kind: InputSpecial, Path: path, Value: kind})
+}
+
+// walkedDir is a directory that's being walked.
+type walkedDir struct {
+	path string
+	info fs.FileInfo
+	// children are the paths in the directory that are left to walk.
+	children []string
+	// empty is unset once a path in the directory is hashed.
+	empty bool
+}
+
+// fileID is the device and inode of a file.
+type fileID struct {
+	dev, ino uint64
+}
+
+// checkLimits returns an error if path is deeper than maxDepth, or one file
+// more than maxFiles.
+func (s *checksummer) checkLimits(path string, info fs.FileInfo) error {
+	depth := 0
+	if path != "." {
+		depth = strings.Count(path, "/") + 1
+	}
+	if s.maxDepth > 0 && depth > s.maxDepth {
+		return Mark(errors.Errorf(
+			"%s is nested deeper than the maximum depth of %d, check the sources of the dockerfile",
+			s.context+path, s.maxDepth,
+		), ErrLimitExceeded)
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+	*s.files++
+	if s.maxFiles > 0 && *s.files > s.maxFiles {
+		return Mark(errors.Errorf(
+			"more than the maximum of %d source files at %s, check the sources of the dockerfile",
+			s.maxFiles, s.context+path,
+		), ErrLimitExceeded)
+	}
+	return nil
 }
 
-// CalculateDockerfileChecksum returns a source-based checksum for a dockerfile.
-func CalculateDockerfileChecksum(c Config) (string, error) {
-	c.logger.Debug("buildArgs:", mapToAttr(c.BuildArgs)...)
+// unreadableValue is written to the final hash for a path that can't be
+// read.
+const unreadableValue = "permission denied"
 
-	content, err := os.ReadFile(c.Dockerfile)
-	if err != nil {
-		return "", errors.Wrap(err, "read dockerfile")
+// unreadable writes a placeholder for path to the final hash instead of
+// returning err, if it's a permission error and skipUnreadable is set.
+// Nothing of path is written before reading it fails.
+func (s *checksummer) unreadable(path string, err error) error {
+	if !s.skipUnreadable || !errors.Is(err, fs.ErrPermission) {
+		return err
 	}
 
-	res, err := parser.Parse(bytes.NewBuffer(content))
-	if err != nil {
-		return "", errors.Wrap(err, "parse dockerfile")
+	s.logger.Warn("skip unreadable path", "path", s.context+path, "error", err)
+	s.writeField(s.h, string(InputUnreadable), unreadableValue)
+	s.input(Input{Kind: InputUnreadable, Path: path, Value: unreadableValue})
+	return nil
+}
+
+func (s *checksummer) skip(path string) bool {
+	if s.filter.skip(path) {
+		s.logger.Debug("skip path", "path", path)
+		return true
+	}
+	return false
+}
+
+// writeMetadata writes the mode of a file to the final hash, and its owner
+// if includeOwner is set.
+func (s *checksummer) writeMetadata(path string, info fs.FileInfo) {
+	metadata := info.Mode().String()
+	if s.includeOwner {
+		uid, gid := owner(info)
+		metadata += fmt.Sprintf(" %d:%d", uid, gid)
 	}
 
-	workdir := os.DirFS(c.Workdir)
+	s.writeField(s.h, string(InputMetadata), metadata)
+	s.input(Input{Kind: InputMetadata, Path: path, Value: metadata})
+}
 
-	var h hash.Hash
+// emptyDirValue is written for an empty directory, as hash version 1 writes
+// nothing for a field without values.
+const emptyDirValue = "empty directory"
 
-	switch c.Hash {
-	case "sha1":
-		h = sha1.New()
-	case "md5":
-		h = md5.New()
-	case "sha256":
-		h = sha256.New()
-	default:
-		panic(fmt.Sprintf("unknown hash algorithm %s", c.Hash))
+// fileSha writes the digest of a file's content to the final hash. The
+// digest is taken from cache if the file hasn't changed since last run.
+func (s *checksummer) fileSha(path string, info fs.FileInfo) (err error) {
+	// async is set if the digests are read in the background, and the span
+	// ends once they're written.
+	var async bool
+	span := trace.SpanFromContext(s.ctx)
+	end := func(error) {}
+	if span.IsRecording() {
+		_, span = tracer.Start(s.ctx, "hash file", trace.WithAttributes(
+			attribute.String("path", path),
+			attribute.Int64("size", info.Size()),
+		))
+		end = func(err error) { endSpan(span, err) }
+		defer func() {
+			if !async {
+				end(err)
+			}
+		}()
 	}
+	// source is where the digest comes from.
+	source := func(source string) {
+		span.SetAttributes(attribute.String("source", source))
+	}
+	s.stats.Files.Add(1)
 
-	if c.Debug {
-		h = newHashWithLog(h, c.logger)
+	conversion, err := s.conversion(path)
+	if err != nil {
+		return err
 	}
 
-	// Add dockerfile to checksum
-	c.logger.Debug(
-		"add dockerfile to checksum",
-		"workdir", workdir,
-		"dockerfile", c.Dockerfile,
-	)
-	must(h.Write(content))
+	if s.hashesContent(info) {
+		// Content is written to the final hash as it's read, after the
+		// digests of large files in chunks that are still read.
+		if err := s.waitReads(); err != nil {
+			return err
+		}
+		source("content")
+		return s.fileContentSha(path, info, conversion)
+	}
 
-	// Add copied source to checksum
-	paths := PathsFromDockerfile(res, c.BuildArgs)
-	for _, path := range paths {
-		c.logger.Debug("calculate checksum for path", "path", path)
-		if strings.HasPrefix(path, "./") {
-			path = must(filepath.Rel(".", path))
+	if digests, ok := s.known[s.context+path]; ok {
+		source("result")
+		return s.writeFileDigest(path, info.Size(), digests)
+	}
+
+	if s.blobs != nil {
+		if digest, ok := s.blobs.digests[path]; ok {
+			s.logger.Debug("use git blob digest", "path", path)
+			source("git-blob")
+			return s.writeFileDigest(path, info.Size(), repeat(digest, len(s.algorithms)))
 		}
+	}
+
+	if digest, ok := s.largeFileDigest(info); ok {
+		s.logger.Debug("use metadata of large file", "path", path)
+		source("metadata")
+		return s.writeFileDigest(path, info.Size(), repeat(digest, len(s.algorithms)))
+	}
 
-		for _, file := range must(fs.Glob(workdir, path)) {
-			must(io.WriteString(h, file))
-			must0(pathSha(workdir, file, h))
+	// Hard links of a file that's already hashed have its digests, unless
+	// they have other git attributes.
+	id, linked := hardlinkID(info)
+	linked = linked && conversion == ""
+	if digests, ok := s.links[id]; linked && ok {
+		s.logger.Debug("use digest of hard link", "path", path)
+		source("hardlink")
+		return s.writeFileDigest(path, info.Size(), digests)
+	}
+	link := func(digests []string) {
+		if linked {
+			s.links[id] = digests
 		}
 	}
 
-	addMapToHash(h, c.BuildArgs)
+	var keys []string
+	if s.cache != nil {
+		algorithms := s.algorithms
+		if s.blobs != nil {
+			algorithms = []string{"git-" + s.blobs.format}
+		}
+		keys = make([]string, len(algorithms))
+		for i, algorithm := range algorithms {
+			algorithm = s.keyAlgorithm(algorithm, info, conversion)
+			keys[i] = cacheKey(
+				algorithm, filepath.Join(s.realWorkdir, path), info,
+			)
+		}
+		if digests, ok := s.cachedDigests(keys); ok {
+			s.logger.Debug("use cached digest", "path", path)
+			source("cache")
+			s.stats.CacheHits.Add(1)
+			link(digests)
+			return s.writeFileDigest(path, info.Size(), digests)
+		}
+	}
 
-	addSliceToHash(h, c.Platforms)
+	remoteKeys := s.remoteKeys(path, info, conversion)
+	read := func() ([]string, bool, error) {
+		if digests, ok := s.remoteDigests(remoteKeys); ok {
+			return digests, true, nil
+		}
+		digests, err := s.fileDigests(path, info, conversion)
+		return digests, false, err
+	}
+	written := func(digests []string, remote bool, err error) error {
+		if err != nil {
+			return err
+		}
 
-	addMapToHash(h, c.Labels)
+		if remote {
+			s.logger.Debug("use remote cached digest", "path", path)
+			source("remote-cache")
+			s.stats.CacheHits.Add(1)
+		} else {
+			source("content")
+			s.stats.HashedFiles.Add(1)
+			s.stats.HashedBytes.Add(info.Size())
+			if s.cache != nil || s.remote != nil {
+				s.stats.CacheMisses.Add(1)
+			}
+			for i, key := range remoteKeys {
+				s.remote.put(key, digests[i])
+			}
+		}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
+		for i, key := range keys {
+			s.cache.put(key, digests[i])
+		}
+		link(digests)
 
-func addMapToHash(h hash.Hash, m map[string]string) {
-	keys := maps.Keys(m)
-	sort.Strings(keys)
-	for _, key := range keys {
-		must(io.WriteString(h, key))
-		must(io.WriteString(h, m[key]))
+		return s.writeFileDigest(path, info.Size(), digests)
 	}
-}
 
-func addSliceToHash(h hash.Hash, s []string) {
-	sort.Strings(s)
-	for _, platform := range s {
-		must(io.WriteString(h, platform))
+	if s.concurrency <= 1 {
+		return written(read())
+	}
+
+	// Hard links of a file that's still read wait for its digests.
+	if r, ok := s.reading[id]; linked && ok {
+		s.logger.Debug("use digest of hard link", "path", path)
+		read = func() ([]string, bool, error) {
+			digests, _, err := r.wait()
+			return digests, false, err
+		}
+		written = func(digests []string, _ bool, err error) error {
+			if err != nil {
+				return err
+			}
+			source("hardlink")
+			return s.writeFileDigest(path, info.Size(), digests)
+		}
 	}
-}
 
-func pathSha(fsys fs.FS, path string, h hash.Hash) error {
-	stat, err := fs.Stat(fsys, path)
+	// Errors are wrapped as in the walk once the digests are written.
+	dirs := slices.Clone(s.dirs)
+	r, err := s.readAsync(read, func(digests []string, remote bool, err error) error {
+		err = s.unreadable(path, written(digests, remote, err))
+		end(err)
+		if err != nil {
+			return walkError(dirs, path, err)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	async = true
+	if linked {
+		s.reading[id] = r
+	}
+	return nil
+}
 
-	if !stat.IsDir() {
-		return fileSha(fsys, path, h)
+// remoteKeys returns the keys of a file in the remote cache for each
+// algorithm, or nil if it's not unchanged in git. Digests of content that's
+// converted or hashed in chunks have other keys.
+func (s *checksummer) remoteKeys(path string, info fs.FileInfo, conversion string) []string {
+	if s.objects == nil {
+		return nil
+	}
+	object, ok := s.objects.digests[path]
+	if !ok {
+		return nil
 	}
 
-	return dirSha(fsys, path, h)
+	keys := make([]string, len(s.algorithms))
+	for i, algorithm := range s.algorithms {
+		algorithm = s.keyAlgorithm(algorithm, info, conversion)
+		keys[i] = remoteCacheKey(algorithm, s.objects.format, object)
+	}
+	return keys
 }
 
-func dirSha(fsys fs.FS, path string, h hash.Hash) error {
-	children, err := fs.ReadDir(fsys, path)
-	if err != nil {
-		return fmt.Errorf("fs.ReadDir: %w", err)
+// keyAlgorithm is the name of algorithm in cache keys of a file's digests,
+// which is another for content that's converted or hashed in chunks.
+func (s *checksummer) keyAlgorithm(algorithm string, info fs.FileInfo, conversion string) string {
+	switch {
+	case conversion != "":
+		return eolAlgorithm(algorithm, conversion)
+	case s.chunked(info, conversion):
+		return chunkedAlgorithm(algorithm, s.largeFileChunkSize)
+	default:
+		return algorithm
 	}
+}
 
-	for _, child := range children {
-		childPath := filepath.Join(path, child.Name())
-		io.WriteString(h, childPath)
+// remoteDigests returns digests for all keys from the remote cache, or false
+// if any is missing.
+func (s *checksummer) remoteDigests(keys []string) ([]string, bool) {
+	if len(keys) == 0 {
+		return nil, false
+	}
 
-		err := pathSha(fsys, childPath, h)
+	res := make([]string, len(keys))
+	for i, key := range keys {
+		digest, ok, err := s.remote.get(key)
 		if err != nil {
-			return fmt.Errorf(
-				"calculating hash for %s: %w", childPath, err,
-			)
+			s.logger.Warn("remote cache not used", "key", key, "error", err)
+			return nil, false
+		}
+		if !ok {
+			return nil, false
 		}
+		res[i] = digest
 	}
+	return res, true
+}
 
-	return nil
+// cachedDigests returns digests for all keys, or false if any is missing.
+// A single key is used for every algorithm if git blobs are used.
+func (s *checksummer) cachedDigests(keys []string) ([]string, bool) {
+	res := make([]string, len(keys))
+	for i, key := range keys {
+		digest, ok := s.cache.get(key)
+		if !ok {
+			return nil, false
+		}
+		res[i] = digest
+	}
+	if len(res) != len(s.algorithms) {
+		res = repeat(res[0], len(s.algorithms))
+	}
+	return res, true
+}
+
+// hashesContent reports whether the content of a file is written to the
+// final hash instead of its digest. HashVersion1 writes the content, as it
+// always has, so cached digests can't stand in for reading the file. Git
+// blobs, metadata and chunks of large files are digests in every version.
+func (s *checksummer) hashesContent(info fs.FileInfo) bool {
+	if s.version == HashVersion2 || s.blobs != nil {
+		return false
+	}
+	if s.largeFileMode == LargeFileChunked && info.Size() > s.largeFileThreshold {
+		return false
+	}
+	_, ok := s.largeFileDigest(info)
+	return !ok
 }
 
-func fileSha(fsys fs.FS, path string, h hash.Hash) error {
-	f, err := fsys.Open(path)
+// fileContentSha writes the content of a file, converted with conversion,
+// to the final hash, and records its digests.
+func (s *checksummer) fileContentSha(path string, info fs.FileInfo, conversion string) error {
+	f, err := s.open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	if _, err := io.Copy(h, f); err != nil {
+	content, err := convert(f, conversion)
+	if err != nil {
 		return err
 	}
+	digests, err := digests(s.algorithms, io.TeeReader(content, s.h))
+	if err != nil {
+		return err
+	}
+	s.stats.HashedFiles.Add(1)
+	s.stats.HashedBytes.Add(info.Size())
+
+	s.recordFile(path, info.Size(), digests)
+	return nil
+}
 
+// writeFileDigest writes the digest of each algorithm to its final hash.
+func (s *checksummer) writeFileDigest(path string, size int64, digests []string) error {
+	for i, h := range s.hashes {
+		s.writeField(h, string(InputFile), digests[i])
+	}
+	s.recordFile(path, size, digests)
 	return nil
 }
 
-// PathsFromDockerfile returns paths added to a dockerfile.
+// recordFile reports a file written to the final hash with its digests.
+func (s *checksummer) recordFile(path string, size int64, digests []string) {
+	s.input(Input{Kind: InputFile, Path: path, Digest: digests[0], Size: size})
+	if s.digests != nil {
+		s.digests[s.context+path] = digests
+	}
+}
+
+// fileDigests returns the digest of a file's content, converted with
+// conversion, with each algorithm, or its git object id for all of them if
+// git blobs are used.
+func (s *checksummer) fileDigests(path string, info fs.FileInfo, conversion string) ([]string, error) {
+	if s.chunked(info, conversion) {
+		return s.chunkedDigests(path, info)
+	}
+
+	f, err := s.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if s.blobs != nil {
+		digest, err := gitBlobDigest(s.blobs.format, f, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		return repeat(digest, len(s.algorithms)), nil
+	}
+
+	content, err := convert(f, conversion)
+	if err != nil {
+		return nil, err
+	}
+	return digests(s.algorithms, content)
+}
+
+// sources returns sources of the dockerfile that are used to build the
+// target stage, with extra paths.
+func (c Config) sources(
+	res *parser.Result,
+	buildArgs map[string]string,
+) (sources, error) {
+	if c.ArgsFromEnv {
+		argsFromEnv(res, buildArgs)
+	}
+
+	src, err := c.platformSources(res, buildArgs)
+	if err != nil {
+		return sources{}, err
+	}
+	if !c.AllStages {
+		src, err = src.prune(c.Target)
+		if err != nil {
+			return sources{}, err
+		}
+	}
+
+	if len(c.ExtraPaths) > 0 {
+		for _, path := range slashPaths(c.ExtraPaths) {
+			src.paths = append(src.paths, path)
+			if _, ok := src.origins[path]; !ok {
+				src.origins[path] = "--extra-path"
+			}
+		}
+		sort.Strings(src.paths)
+	}
+
+	return src, nil
+}
+
+// PathsFromDockerfile returns paths added to a dockerfile by all stages. It
+// panics if build args can't be expanded, SourcePaths returns the error.
 func PathsFromDockerfile(
 	res *parser.Result,
 	buildArgs map[string]string,
 ) []string {
+	return must(parseSources(res, buildArgs, false)).paths
+}
+
+// sources is what a dockerfile adds to the build from outside.
+type sources struct {
+	// paths are source paths in the build context.
+	paths []string
+	// images are external images used by FROM.
+	images []image
+	// external are sources used by COPY --from or RUN --mount=from that
+	// don't refer to a stage. They're either named contexts or images.
+	external []externalSource
+	// origins maps paths to the instructions that use them.
+	origins map[string]string
+
+	// stages are sources of each stage.
+	stages []stage
+}
+
+// stage is what a stage of a dockerfile uses.
+type stage struct {
+	name string
+	// code is the source code of the stage, including heredocs.
+	code []string
+	// deps are indexes of previous stages used by the stage, including its
+	// base.
+	deps []int
+	// images are the external base image of the stage, if any, for each
+	// platform if it depends on the platform.
+	images []image
+
+	paths    []string
+	external []externalSource
+	// origins maps paths to the instructions that use them.
+	origins map[string]string
+}
+
+// addPaths adds source paths used by an instruction.
+func (st *stage) addPaths(origin string, paths ...string) {
+	if st.origins == nil {
+		st.origins = map[string]string{}
+	}
+	for _, path := range paths {
+		st.paths = append(st.paths, path)
+		if _, ok := st.origins[path]; !ok {
+			st.origins[path] = origin
+		}
+	}
+}
+
+// externalSource is a source from outside of the dockerfile and the build
+// context.
+type externalSource struct {
+	from string
+	// paths are the source paths in from, if from is a named context.
+	paths []string
+	// origin is the instruction that uses the source.
+	origin string
+}
+
+// resolveExternal separates external sources from local named contexts and
+// images. Paths from local named contexts are returned by context name.
+func (src sources) resolveExternal(
+	contexts map[string]string,
+) (map[string][]string, []image, error) {
+	contextPaths := map[string][]string{}
+	var images []image
+
+	for _, ext := range src.external {
+		target, ok := contexts[ext.from]
+		switch {
+		case !ok:
+			images = append(images, image{ref: ext.from})
+		case strings.HasPrefix(target, "docker-image://"):
+			images = append(images, image{
+				ref: strings.TrimPrefix(target, "docker-image://"),
+			})
+		case strings.Contains(target, "://"):
+			return nil, nil, errors.Errorf(
+				"unsupported build context %s=%s", ext.from, target,
+			)
+		case len(ext.paths) > 0:
+			contextPaths[ext.from] = append(contextPaths[ext.from], ext.paths...)
+		}
+	}
+
+	for _, paths := range contextPaths {
+		sort.Strings(paths)
+	}
+
+	return contextPaths, images, nil
+}
+
+// image is an external image used by a dockerfile.
+type image struct {
+	ref string
+	// platform is set if the dockerfile specifies the platform of the image.
+	platform string
+}
+
+// argsFromEnv sets args declared in the dockerfile that aren't in buildArgs
+// from the environment.
+func argsFromEnv(res *parser.Result, buildArgs map[string]string) {
+	for _, node := range res.AST.Children {
+		if !strings.EqualFold(node.Value, "arg") {
+			continue
+		}
+
+		for next := node.Next; next != nil; next = next.Next {
+			key, _, _ := strings.Cut(next.Value, "=")
+			if _, ok := buildArgs[key]; ok {
+				continue
+			}
+			if value, ok := os.LookupEnv(key); ok {
+				buildArgs[key] = value
+			}
+		}
+	}
+}
+
+// parseSources returns sources of the dockerfile, updating buildArgs with
+// ARG defaults and ENV. Sources of ONBUILD triggers are added if onbuild is
+// set.
+func parseSources(
+	res *parser.Result,
+	buildArgs map[string]string,
+	onbuild bool,
+) (sources, error) {
 	shlex := shell.NewLex(res.EscapeToken)
 
 	var expandBuildArgs instructions.SingleWordExpander = func(
@@ -190,8 +1926,10 @@ func PathsFromDockerfile(
 		return shlex.ProcessWordWithMap(key, buildArgs)
 	}
 
-	stages, argCommands, err := instructions.Parse(res.AST)
-	must0(err)
+	stages, argCommands, err := instructions.Parse(withoutBuildahFlags(res.AST))
+	if err != nil {
+		return sources{}, newParseError(err)
+	}
 
 	for _, argCmd := range argCommands {
 		for _, arg := range argCmd.Args {
@@ -201,39 +1939,298 @@ func PathsFromDockerfile(
 		}
 	}
 
-	var paths []string
+	// FROM can only use args declared before the first stage.
+	metaArgs := maps.Clone(buildArgs)
+
+	var src sources
+
+	stageIndexes := map[string]int{}
+	for i, instStage := range stages {
+		st := stage{name: instStage.Name, code: []string{instStage.SourceCode}}
+		if st.name == "" {
+			st.name = strconv.Itoa(i)
+		}
 
-	for _, stage := range stages {
-		for _, iCmd := range stage.Commands {
+		base, err := shlex.ProcessWordWithMap(instStage.BaseName, metaArgs)
+		if err != nil {
+			return sources{}, expandError(err, instStage.Location)
+		}
+		if index, ok := stageIndexes[strings.ToLower(base)]; ok {
+			st.deps = append(st.deps, index)
+		} else if base != "scratch" {
+			platform, err := shlex.ProcessWordWithMap(instStage.Platform, metaArgs)
+			if err != nil {
+				return sources{}, expandError(err, instStage.Location)
+			}
+			st.images = []image{{ref: base, platform: platform}}
+		}
+
+		for _, iCmd := range instStage.Commands {
 			if expandable, ok := iCmd.(instructions.SupportsSingleWordExpansion); ok {
-				must0(expandable.Expand(expandBuildArgs))
+				if err := expandable.Expand(expandBuildArgs); err != nil {
+					return sources{}, expandError(err, iCmd.Location())
+				}
+			}
+
+			origin := iCmd.Name()
+			if code, ok := iCmd.(fmt.Stringer); ok {
+				st.code = append(st.code, code.String())
+				origin = code.String()
+			}
+			if location := iCmd.Location(); len(location) > 0 {
+				origin = fmt.Sprintf("line %d: %s", location[0].Start.Line, origin)
 			}
 
+			// Heredoc sources are in SourceContents instead of SourcePaths,
+			// and are already part of the dockerfile content.
 			switch cmd := iCmd.(type) {
 			case *instructions.CopyCommand:
+				st.code = append(st.code, heredocs(cmd.SourceContents)...)
 				if cmd.From == "" {
-					paths = append(paths, cmd.SourcePaths...)
+					st.addPaths(origin, slashPaths(cmd.SourcePaths)...)
+					break
+				}
+				from, err := expandBuildArgs(cmd.From)
+				if err != nil {
+					return sources{}, expandError(err, iCmd.Location())
+				}
+				if isStage(from, stageIndexes, i) {
+					st.deps = append(st.deps, stageIndex(from, stageIndexes, i))
+				} else {
+					st.external = append(st.external, externalSource{
+						from:   from,
+						paths:  slashPaths(cmd.SourcePaths),
+						origin: origin,
+					})
 				}
 			case *instructions.AddCommand:
-				paths = append(paths, cmd.SourcePaths...)
+				st.code = append(st.code, heredocs(cmd.SourceContents)...)
+				st.addPaths(origin, slashPaths(cmd.SourcePaths)...)
+			case *instructions.OnbuildCommand:
+				if onbuild {
+					paths, err := onbuildPaths(cmd.Expression, res.EscapeToken, expandBuildArgs)
+					if err != nil {
+						return sources{}, expandError(err, iCmd.Location())
+					}
+					st.addPaths(origin, slashPaths(paths)...)
+				}
 			case *instructions.EnvCommand:
 				for _, env := range cmd.Env {
 					buildArgs[env.Key] = env.Value
 				}
 			case *instructions.RunCommand:
+				for _, file := range cmd.Files {
+					st.code = append(st.code, file.Data)
+				}
+
 				for _, mount := range instructions.GetMounts(cmd) {
-					if mount.From == "" &&
-						mount.Type == instructions.MountTypeBind {
-						paths = append(paths, mount.Source)
+					if mount.From != "" && isStage(mount.From, stageIndexes, i) {
+						st.deps = append(st.deps, stageIndex(mount.From, stageIndexes, i))
+						continue
+					}
+
+					var paths []string
+					if mount.Type == instructions.MountTypeBind {
+						// Bind mounts without source mount the whole context.
+						source := mount.Source
+						if source == "" {
+							source = "."
+						}
+						paths = []string{source}
+					}
+
+					paths = slashPaths(paths)
+					if mount.From == "" {
+						st.addPaths(origin, paths...)
+					} else {
+						st.external = append(st.external, externalSource{
+							from:   mount.From,
+							paths:  paths,
+							origin: origin,
+						})
 					}
 				}
 			}
 		}
+
+		if instStage.Name != "" {
+			stageIndexes[strings.ToLower(instStage.Name)] = i
+		}
+		src.stages = append(src.stages, st)
+	}
+
+	return collectSources(src.stages, nil), nil
+}
+
+// onbuildPaths returns local source paths of an ONBUILD COPY or ADD
+// trigger.
+func onbuildPaths(
+	expression string,
+	escape rune,
+	expand instructions.SingleWordExpander,
+) ([]string, error) {
+	dockerfile := expression
+	if escape != '\\' {
+		dockerfile = "# escape=" + string(escape) + "\n" + expression
+	}
+	res, err := parser.Parse(strings.NewReader(dockerfile))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse ONBUILD trigger")
+	}
+
+	node := withoutBuildahFlags(res.AST).Children[0]
+	inst, err := instructions.ParseInstruction(node)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse ONBUILD trigger")
+	}
+	if expandable, ok := inst.(instructions.SupportsSingleWordExpansion); ok {
+		if err := expandable.Expand(expand); err != nil {
+			return nil, err
+		}
+	}
+
+	switch cmd := inst.(type) {
+	case *instructions.CopyCommand:
+		if cmd.From == "" {
+			return cmd.SourcePaths, nil
+		}
+	case *instructions.AddCommand:
+		return cmd.SourcePaths, nil
+	}
+	return nil, nil
+}
+
+// buildahFlags are flags of COPY and ADD that Buildah supports but BuildKit
+// doesn't. They don't change which sources are used, except --exclude, whose
+// files are kept as sources.
+var buildahFlags = []string{"--exclude", "--parents"}
+
+// withoutBuildahFlags returns a copy of ast without buildahFlags, so
+// Containerfiles written for Podman can be parsed.
+func withoutBuildahFlags(ast *parser.Node) *parser.Node {
+	res := *ast
+	res.Children = make([]*parser.Node, len(ast.Children))
+	for i, node := range ast.Children {
+		res.Children[i] = node
+
+		var flags []string
+		for _, flag := range node.Flags {
+			name, _, _ := strings.Cut(flag, "=")
+			if !slices.Contains(buildahFlags, name) {
+				flags = append(flags, flag)
+			}
+		}
+		if len(flags) != len(node.Flags) {
+			n := *node
+			n.Flags = flags
+			res.Children[i] = &n
+		}
+	}
+	return &res
+}
+
+// slashPaths replaces backslashes in source paths with forward slashes, so a
+// dockerfile written for Windows has the same sources on every OS. URLs are
+// kept as is.
+func slashPaths(paths []string) []string {
+	res := make([]string, len(paths))
+	for i, path := range paths {
+		if isURL(path) {
+			res[i] = path
+		} else {
+			res[i] = strings.ReplaceAll(path, `\`, "/")
+		}
+	}
+	return res
+}
+
+// collectSources returns sources of stages. Only stages in include are used
+// if it's not nil.
+func collectSources(stages []stage, include map[int]bool) sources {
+	src := sources{stages: stages, origins: map[string]string{}}
+
+	for i, st := range stages {
+		if include != nil && !include[i] {
+			continue
+		}
+
+		for path, origin := range st.origins {
+			if _, ok := src.origins[path]; !ok {
+				src.origins[path] = origin
+			}
+		}
+		src.paths = append(src.paths, st.paths...)
+		src.external = append(src.external, st.external...)
+		src.images = append(src.images, st.images...)
+	}
+
+	sort.Strings(src.paths)
+
+	return src
+}
+
+// prune returns sources of the target stage and stages it depends on. The
+// last stage is the target if target is empty.
+func (src sources) prune(target string) (sources, error) {
+	if len(src.stages) == 0 {
+		return src, nil
+	}
+
+	start := len(src.stages) - 1
+	if target != "" {
+		start = -1
+		for i, st := range src.stages {
+			if strings.EqualFold(st.name, target) {
+				start = i
+			}
+		}
+		if start < 0 {
+			return sources{}, errors.Errorf("target stage %s not found", target)
+		}
+	}
+
+	reachable := map[int]bool{}
+	var visit func(int)
+	visit = func(i int) {
+		if reachable[i] {
+			return
+		}
+		reachable[i] = true
+		for _, dep := range src.stages[i].deps {
+			visit(dep)
+		}
+	}
+	visit(start)
+
+	return collectSources(src.stages, reachable), nil
+}
+
+func heredocs(contents []instructions.SourceContent) []string {
+	var res []string
+	for _, content := range contents {
+		res = append(res, content.Data)
 	}
+	return res
+}
 
-	sort.Strings(paths)
+// isStage reports whether from refers to a stage before the current one, by
+// name or index.
+func isStage(from string, stageIndexes map[string]int, current int) bool {
+	return stageIndex(from, stageIndexes, current) >= 0
+}
 
-	return paths
+// stageIndex returns the index of the stage before the current one that from
+// refers to, by name or index, or -1 if it doesn't refer to a stage.
+func stageIndex(from string, stageIndexes map[string]int, current int) int {
+	if index, err := strconv.Atoi(from); err == nil {
+		if index >= 0 && index < current {
+			return index
+		}
+	}
+	if index, ok := stageIndexes[strings.ToLower(from)]; ok {
+		return index
+	}
+	return -1
 }
 
 type LoggingHash struct {
@@ -0,0 +1,55 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// HashVersion1 writes fields to the hash one after another, as is. It's
+	// the default, for checksums to stay the same as older versions.
+	HashVersion1 = 1
+	// HashVersion2 writes the kind of each field and each of its values
+	// prefixed with their length, so different fields never hash the same.
+	HashVersion2 = 2
+)
+
+// HashVersions are the supported hash versions, oldest first.
+var HashVersions = []int{HashVersion1, HashVersion2}
+
+func checkHashVersion(version int) error {
+	switch version {
+	case 0, HashVersion1, HashVersion2:
+		return nil
+	default:
+		return Mark(errors.Errorf("unknown hash version %d", version), ErrUnsupportedHash)
+	}
+}
+
+// writeField writes a field to w, encoded with the hash version, after the
+// files that are read in the background.
+func (s *checksummer) writeField(w io.Writer, kind string, values ...string) {
+	if s.deferred(func() { s.writeField(w, kind, values...) }) {
+		return
+	}
+
+	if s.version != HashVersion2 {
+		for _, value := range values {
+			must(io.WriteString(w, value))
+		}
+		return
+	}
+
+	writeLengthPrefixed(w, kind)
+	must(w.Write(binary.AppendUvarint(nil, uint64(len(values)))))
+	for _, value := range values {
+		writeLengthPrefixed(w, value)
+	}
+}
+
+func writeLengthPrefixed(w io.Writer, value string) {
+	must(w.Write(binary.AppendUvarint(nil, uint64(len(value)))))
+	must(io.WriteString(w, value))
+}
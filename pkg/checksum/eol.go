@@ -0,0 +1,228 @@
+package checksum
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// binaryPeek is how much of a file is looked at for a NUL byte to tell
+// whether it's binary, as git does.
+const binaryPeek = 8000
+
+// Conversions of a file's content with NormalizeEOL, from its git
+// attributes, as git converts files when they're added to the index.
+const (
+	// eolAuto normalizes CRLF in files that aren't binary, for text=auto or
+	// files without attributes.
+	eolAuto = "auto"
+	// eolText normalizes CRLF, for text or eol.
+	eolText = "text"
+	// eolBinary leaves the content as is, for -text or binary.
+	eolBinary = "binary"
+	// identSuffix is added to a conversion to collapse $Id$ keywords, for
+	// ident.
+	identSuffix = "+ident"
+)
+
+// eolAlgorithm is the name of algorithm in cache keys of digests of content
+// converted with conversion, so they're not mistaken for digests of the
+// content as is, or with other attributes.
+func eolAlgorithm(algorithm, conversion string) string {
+	return algorithm + "+eol-" + conversion
+}
+
+// conversion returns how the content of a file is converted, or empty if
+// it's hashed as is.
+func (s *checksummer) conversion(path string) (string, error) {
+	if !s.normalizeEOL {
+		return "", nil
+	}
+
+	attrs, err := s.gitAttributes().get(path)
+	if err != nil {
+		return "", err
+	}
+
+	conversion := eolAuto
+	switch {
+	case attrs["text"] == "unset":
+		conversion = eolBinary
+	case attrs["text"] == "set", attrs["text"] != "auto" && (attrs["eol"] == "lf" || attrs["eol"] == "crlf"):
+		conversion = eolText
+	}
+	if attrs["ident"] == "set" {
+		conversion += identSuffix
+	}
+	return conversion, nil
+}
+
+// convert returns r converted with conversion.
+func convert(r io.Reader, conversion string) (io.Reader, error) {
+	if conversion == "" {
+		return r, nil
+	}
+
+	conversion, ident := strings.CutSuffix(conversion, identSuffix)
+
+	switch conversion {
+	case eolAuto:
+		r = normalizeEOL(r)
+	case eolText:
+		r = &crlfReader{r: bufio.NewReader(r)}
+	}
+
+	if !ident {
+		return r, nil
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(collapseIdent(content)), nil
+}
+
+// normalizeEOL returns r with CRLF replaced by LF if it's text. It's binary
+// if it has a NUL byte near the start, and returned as is.
+func normalizeEOL(r io.Reader) io.Reader {
+	br := bufio.NewReaderSize(r, binaryPeek)
+	peek, _ := br.Peek(binaryPeek)
+	if bytes.IndexByte(peek, 0) >= 0 {
+		return br
+	}
+	return &crlfReader{r: br}
+}
+
+// crlfReader drops every CR that's followed by LF.
+type crlfReader struct {
+	r *bufio.Reader
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b == '\r' {
+			if next, err := c.r.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+		}
+		p[n] = b
+		n++
+
+		// Don't wait for more than is buffered, as reads of a file do.
+		if c.r.Buffered() == 0 {
+			break
+		}
+	}
+	return n, nil
+}
+
+var identPattern = regexp.MustCompile(`\$Id:[^$\n]*\$`)
+
+// collapseIdent replaces expanded $Id: ...$ keywords with $Id$, as they're
+// in the index.
+func collapseIdent(content []byte) []byte {
+	return identPattern.ReplaceAllLiteral(content, []byte("$Id$"))
+}
+
+// eolAttributes are the git attributes that change how content is
+// normalized.
+var eolAttributes = []string{"text", "eol", "ident"}
+
+// gitAttributes looks up attributes of files in a git worktree, with a
+// single git check-attr process. It has no attributes outside of git.
+type gitAttributes struct {
+	cmd *exec.Cmd
+	w   io.WriteCloser
+	r   *bufio.Reader
+}
+
+// gitAttributes returns the attributes of files in dir, which are looked up
+// once for the calculation.
+func (s *checksummer) gitAttributes() *gitAttributes {
+	if attrs, ok := s.attributes[s.dir]; ok {
+		return attrs
+	}
+
+	attrs, err := openGitAttributes(s.dir)
+	if err != nil {
+		s.logger.Debug("no git attributes", "dir", s.dir, "error", err)
+	}
+	s.attributes[s.dir] = attrs
+	return attrs
+}
+
+func openGitAttributes(dir string) (*gitAttributes, error) {
+	if dir == "" {
+		return nil, errors.New("context is not a directory")
+	}
+	if _, err := git(dir, "rev-parse", "--git-dir"); err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"-C", dir, "check-attr", "--stdin", "-z"}, eolAttributes...)
+	cmd := exec.Command("git", args...)
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "git check-attr")
+	}
+	return &gitAttributes{cmd: cmd, w: w, r: bufio.NewReader(r)}, nil
+}
+
+// get returns eolAttributes of a file, set, unset, unspecified or a value.
+func (a *gitAttributes) get(path string) (map[string]string, error) {
+	attrs := map[string]string{}
+	if a == nil {
+		for _, name := range eolAttributes {
+			attrs[name] = "unspecified"
+		}
+		return attrs, nil
+	}
+
+	if _, err := io.WriteString(a.w, path+"\x00"); err != nil {
+		return nil, errors.Wrap(err, "git check-attr")
+	}
+	for range eolAttributes {
+		// <path> NUL <attribute> NUL <info> NUL
+		var fields [3]string
+		for i := range fields {
+			field, err := a.r.ReadString(0)
+			if err != nil {
+				return nil, errors.Wrap(err, "git check-attr")
+			}
+			fields[i] = field[:len(field)-1]
+		}
+		attrs[fields[1]] = fields[2]
+	}
+	return attrs, nil
+}
+
+// closeAttributes ends the git check-attr processes of the calculation.
+func (s *checksummer) closeAttributes() {
+	for _, attrs := range s.attributes {
+		attrs.close()
+	}
+}
+
+func (a *gitAttributes) close() {
+	if a != nil {
+		a.w.Close()
+		a.cmd.Wait()
+	}
+}
@@ -0,0 +1,115 @@
+package checksum
+
+import (
+	"fmt"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// Errors returned by the package can be matched with errors.Is. They're
+// wrapped with the details of the failure, so the messages are unchanged.
+var (
+	// ErrDockerfileNotFound is returned when the dockerfile doesn't exist.
+	ErrDockerfileNotFound = errors.New("dockerfile not found")
+	// ErrUnsupportedHash is returned for unknown hash algorithms and hash
+	// versions.
+	ErrUnsupportedHash = errors.New("unsupported hash")
+	// ErrSourceMissing is returned in strict mode when a source of the
+	// dockerfile doesn't exist, or a pattern matches nothing. The error is
+	// a *SourceError with the path.
+	ErrSourceMissing = errors.New("source missing")
+	// ErrLimitExceeded is returned when sources are nested deeper than
+	// MaxDepth, or there are more than MaxFiles.
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrParse is returned when the dockerfile can't be parsed. The error
+	// is a *ParseError with the line.
+	ErrParse = errors.New("parse dockerfile")
+)
+
+// markedError is an error that also matches a sentinel error.
+type markedError struct {
+	err      error
+	sentinel error
+}
+
+// Mark returns err, also matching sentinel with errors.Is, so errors from
+// elsewhere can be matched like errors of the package.
+func Mark(err, sentinel error) error {
+	if err == nil {
+		return nil
+	}
+	return &markedError{err: err, sentinel: sentinel}
+}
+
+func (e *markedError) Error() string { return e.err.Error() }
+
+func (e *markedError) Unwrap() error { return e.err }
+
+func (e *markedError) Is(target error) bool { return target == e.sentinel }
+
+// SourceError is a source of the dockerfile that's missing in strict mode.
+// It matches ErrSourceMissing.
+type SourceError struct {
+	// Origin is the instruction adding the source, e.g.
+	// "line 3: COPY ./a /app".
+	Origin string
+	// Path is the source as it's written in the instruction.
+	Path string
+	// Pattern is whether Path has wildcards, which match nothing.
+	Pattern bool
+}
+
+func (e *SourceError) Error() string {
+	if e.Pattern {
+		return fmt.Sprintf("%s: %s matches no files", e.Origin, e.Path)
+	}
+	return fmt.Sprintf("%s: %s does not exist", e.Origin, e.Path)
+}
+
+func (e *SourceError) Is(target error) bool { return target == ErrSourceMissing }
+
+// ParseError is an error parsing the dockerfile. It matches ErrParse.
+type ParseError struct {
+	// Dockerfile is the path of the dockerfile, or empty if its content is
+	// given.
+	Dockerfile string
+	// Line is the line of the dockerfile with the error, starting at 1, or
+	// 0 if it's unknown.
+	Line int
+	Err  error
+}
+
+// newParseError returns a *ParseError for an error of the dockerfile
+// parser, with the line it reports.
+func newParseError(err error) error {
+	e := &ParseError{Err: err}
+	var location *parser.ErrorLocation
+	if errors.As(err, &location) && len(location.Location) > 0 {
+		e.Line = location.Location[0].Start.Line
+	}
+	return e
+}
+
+// expandError returns a *ParseError for an error expanding build args in
+// the instruction at location.
+func expandError(err error, location []parser.Range) error {
+	return newParseError(parser.WithLocation(err, location))
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse dockerfile: %s", e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+func (e *ParseError) Is(target error) bool { return target == ErrParse }
+
+// withDockerfile sets the dockerfile of c in a *ParseError.
+func (c Config) withDockerfile(err error) error {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) && c.DockerfileContent == nil {
+		parseErr.Dockerfile = c.Dockerfile
+	}
+	return err
+}
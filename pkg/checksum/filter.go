@@ -0,0 +1,63 @@
+package checksum
+
+import (
+	"github.com/moby/patternmatcher"
+	"github.com/pkg/errors"
+)
+
+// pathFilter decides which source paths in a context are left out of the
+// checksum.
+type pathFilter struct {
+	// exclude matches paths to skip, nil if nothing is excluded.
+	exclude *patternmatcher.PatternMatcher
+	// tracked is the set of paths tracked by git, and their parent
+	// directories. Every path is used if it's nil.
+	tracked map[string]bool
+
+	gitTrackedOnly bool
+}
+
+// newPathFilter returns the filter for the context in dir.
+func newPathFilter(c Config, dir string) (*pathFilter, error) {
+	if c.GitTrackedOnly && c.ContextFS != nil {
+		return nil, errors.New("git tracked files can't be used with this build context")
+	}
+
+	f := &pathFilter{gitTrackedOnly: c.GitTrackedOnly}
+
+	if len(c.Exclude) > 0 {
+		pm, err := patternmatcher.New(c.Exclude)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse exclude patterns")
+		}
+		f.exclude = pm
+	}
+
+	return f.forDir(dir)
+}
+
+// forDir returns the filter with the same patterns for another context.
+func (f *pathFilter) forDir(dir string) (*pathFilter, error) {
+	res := *f
+	if f.gitTrackedOnly {
+		tracked, err := gitTrackedPaths(dir)
+		if err != nil {
+			return nil, err
+		}
+		res.tracked = tracked
+	}
+	return &res, nil
+}
+
+// skip reports whether path is left out.
+func (f *pathFilter) skip(path string) bool {
+	if f.tracked != nil && !f.tracked[path] {
+		return true
+	}
+
+	if f.exclude == nil {
+		return false
+	}
+	ok, err := f.exclude.MatchesOrParentMatches(path)
+	return ok && err == nil
+}
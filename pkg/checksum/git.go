@@ -0,0 +1,220 @@
+package checksum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/exp/maps"
+)
+
+// gitTrackedPaths returns paths of files tracked by git in dir, relative to
+// dir, along with their parent directories.
+func gitTrackedPaths(dir string) (map[string]bool, error) {
+	out, err := git(dir, "ls-files", "-z", "--recurse-submodules")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]bool{".": true}
+	for _, file := range bytes.Split(out, []byte{0}) {
+		for p := string(file); p != "" && p != "." && !paths[p]; p = pathpkg.Dir(p) {
+			paths[p] = true
+		}
+	}
+
+	return paths, nil
+}
+
+// gitBlobs holds git object ids of files in a worktree that are the same as
+// in the index.
+type gitBlobs struct {
+	// format is the object format of the repository, sha1 or sha256.
+	format  string
+	digests map[string]string
+}
+
+// readGitBlobs returns object ids of files under dir that have no changes
+// in the worktree, keyed by paths relative to dir. Symlinks and submodules
+// are left out, since their objects don't hold the content of a file.
+func readGitBlobs(dir string) (*gitBlobs, error) {
+	format, err := git(dir, "rev-parse", "--show-object-format")
+	if err != nil {
+		return nil, err
+	}
+
+	staged, err := git(dir, "ls-files", "-s", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	modified, err := git(dir, "diff-files", "--name-only", "--relative", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := &gitBlobs{
+		format:  string(bytes.TrimSpace(format)),
+		digests: map[string]string{},
+	}
+
+	for _, entry := range bytes.Split(staged, []byte{0}) {
+		// <mode> <object> <stage>\t<path>
+		info, path, ok := bytes.Cut(entry, []byte{'\t'})
+		if !ok {
+			continue
+		}
+		fields := bytes.Fields(info)
+		if len(fields) != 3 || !bytes.HasPrefix(fields[0], []byte("100")) {
+			continue
+		}
+		blobs.digests[string(path)] = string(fields[1])
+	}
+
+	for _, path := range bytes.Split(modified, []byte{0}) {
+		delete(blobs.digests, string(path))
+	}
+
+	return blobs, nil
+}
+
+// gitBlobDigest returns the git object id of a blob with the content in r.
+func gitBlobDigest(format string, r io.Reader, size int64) (string, error) {
+	h, err := newHash(format)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(h, "blob %d\x00", size)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// git runs a git command in dir and returns its output.
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "git %s in %s: %s",
+			args[0], dir, bytes.TrimSpace(stderr.Bytes()),
+		)
+	}
+	return out, nil
+}
+
+// ChangedFiles returns files used by the dockerfile that changed in git
+// between since and until, or between since and the worktree if until is
+// empty. Paths are relative to the root of the repository. Untracked files
+// are not reported.
+func ChangedFiles(c Config, since, until string) ([]string, error) {
+	pathspecs, err := gitPathspecs(c)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"diff", "--name-only", "-z", since}
+	if until != "" {
+		args = append(args, until)
+	}
+	args = append(args, "--")
+	args = append(args, pathspecs...)
+
+	out, err := git(c.Workdir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range bytes.Split(out, []byte{0}) {
+		if len(file) > 0 {
+			files = append(files, string(file))
+		}
+	}
+
+	return files, nil
+}
+
+// gitPathspecs returns git pathspecs relative to the workdir that match the
+// dockerfile and its sources, including sources from named contexts.
+func gitPathspecs(c Config) ([]string, error) {
+	_, res, err := c.readDockerfile()
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := c.sources(res, cloneMap(c.BuildArgs))
+	if err != nil {
+		return nil, err
+	}
+
+	contextPaths, _, err := src.resolveExternal(c.BuildContexts)
+	if err != nil {
+		return nil, err
+	}
+
+	var pathspecs []string
+	if c.DockerfileContent == nil {
+		dockerfile, err := relativeTo(c.Workdir, c.Dockerfile)
+		if err != nil {
+			return nil, err
+		}
+		pathspecs = append(pathspecs, ":(literal)"+dockerfile)
+	}
+
+	add := func(dir string, paths []string) {
+		for _, path := range paths {
+			if isURL(path) {
+				continue
+			}
+			path = strings.TrimPrefix(path, "/")
+			pathspecs = append(pathspecs, ":(glob)"+pathpkg.Join(dir, path))
+		}
+		for _, pattern := range c.Exclude {
+			pathspecs = append(pathspecs, ":(exclude,glob)"+pathpkg.Join(dir, pattern))
+		}
+	}
+
+	add(".", src.paths)
+
+	names := maps.Keys(contextPaths)
+	sort.Strings(names)
+	for _, name := range names {
+		dir, err := relativeTo(c.Workdir, c.BuildContexts[name])
+		if err != nil {
+			return nil, err
+		}
+		add(dir, contextPaths[name])
+	}
+
+	return pathspecs, nil
+}
+
+// relativeTo returns path relative to dir, with forward slashes.
+func relativeTo(dir, path string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve %s", dir)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve %s", path)
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve %s", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
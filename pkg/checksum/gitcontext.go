@@ -0,0 +1,86 @@
+package checksum
+
+import (
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IsGitURL reports whether a build context is a git repository, as docker
+// build decides it: git@ and git:// addresses, github.com/ paths, and
+// http, https, ssh or file URLs of a .git repository. A fragment selects the
+// ref and the subdirectory, as in https://github.com/org/repo.git#ref:dir.
+func IsGitURL(context string) bool {
+	switch {
+	case strings.HasPrefix(context, "git@"),
+		strings.HasPrefix(context, "git://"),
+		strings.HasPrefix(context, "github.com/"):
+		return true
+	}
+
+	for _, scheme := range []string{"http://", "https://", "ssh://", "file://"} {
+		if strings.HasPrefix(context, scheme) {
+			repo, _, _ := strings.Cut(context, "#")
+			return strings.HasSuffix(repo, ".git")
+		}
+	}
+	return false
+}
+
+// gitContext is a git build context.
+type gitContext struct {
+	remote string
+	// ref is the branch, tag or commit to check out, the default branch if
+	// it's empty.
+	ref    string
+	subdir string
+}
+
+func parseGitContext(context string) (gitContext, error) {
+	remote, fragment, _ := strings.Cut(context, "#")
+	if strings.HasPrefix(remote, "github.com/") {
+		remote = "https://" + remote
+	}
+
+	ref, subdir, _ := strings.Cut(fragment, ":")
+
+	subdir = pathpkg.Clean(subdir)
+	if subdir == ".." || strings.HasPrefix(subdir, "../") || pathpkg.IsAbs(subdir) {
+		return gitContext{}, errors.Errorf(
+			"subdirectory of git context %s is outside of the repository",
+			context,
+		)
+	}
+
+	return gitContext{remote: remote, ref: ref, subdir: subdir}, nil
+}
+
+// CloneGitContext makes a shallow clone of a git build context into dir,
+// with its submodules, and returns the directory of the context in it.
+func CloneGitContext(context, dir string) (string, error) {
+	c, err := parseGitContext(context)
+	if err != nil {
+		return "", err
+	}
+
+	ref := c.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", c.remote},
+		{"fetch", "--quiet", "--depth", "1", "origin", ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+		{"submodule", "update", "--quiet", "--init", "--recursive", "--depth", "1"},
+	} {
+		if _, err := git(dir, args...); err != nil {
+			return "", errors.Wrapf(err, "clone %s", context)
+		}
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(c.subdir)), nil
+}
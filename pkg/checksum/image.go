@@ -0,0 +1,91 @@
+package checksum
+
+import (
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// imagesSha writes the digest of each image for each platform to the final
+// hash. Images that specify their own platform are only resolved for that
+// platform.
+func (s *checksummer) imagesSha(images []image, platforms []string) error {
+	resolved := map[string]bool{}
+
+	for _, img := range images {
+		imgPlatforms := platforms
+		if img.platform != "" {
+			imgPlatforms = []string{img.platform}
+		}
+
+		for _, platform := range imgPlatforms {
+			key := img.ref + " " + platform
+			if resolved[key] {
+				continue
+			}
+			resolved[key] = true
+
+			digest, err := imageDigest(img.ref, platform)
+			if err != nil {
+				return errors.Wrapf(err, "resolve image %s", img.ref)
+			}
+
+			s.logger.Debug(
+				"resolve image",
+				"image", img.ref, "platform", platform, "digest", digest,
+			)
+
+			s.writeField(s.h, string(InputImage), img.ref, platform, digest)
+			s.input(Input{
+				Kind:   InputImage,
+				Key:    img.ref,
+				Value:  platform,
+				Digest: digest,
+			})
+		}
+	}
+
+	return nil
+}
+
+// imageDigest returns the digest of the image manifest of ref for platform,
+// using credentials from the docker config. If platform is empty, the
+// registry's default is used.
+func imageDigest(ref, platform string) (string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	opts := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+	if platform != "" {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return "", err
+		}
+		opts = append(opts, remote.WithPlatform(*p))
+	}
+
+	desc, err := remote.Get(r, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	if !desc.MediaType.IsIndex() {
+		return desc.Digest.String(), nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return digest.String(), nil
+}
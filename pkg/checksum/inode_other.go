@@ -0,0 +1,13 @@
+//go:build !unix
+
+package checksum
+
+import "io/fs"
+
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
+
+func hardlinkID(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
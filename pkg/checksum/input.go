@@ -0,0 +1,88 @@
+package checksum
+
+// InputKind is the kind of an Input.
+type InputKind string
+
+const (
+	// InputSalt is the salt the checksum is namespaced with.
+	InputSalt InputKind = "salt"
+	// InputDockerfile is the content of the dockerfile.
+	InputDockerfile InputKind = "dockerfile"
+	// InputPath is the path of a source file or directory.
+	InputPath InputKind = "path"
+	// InputFile is the digest of a source file's content.
+	InputFile InputKind = "file"
+	// InputMetadata is the mode of a source file or directory, followed by
+	// its uid and gid if owners are included.
+	InputMetadata InputKind = "metadata"
+	// InputUnreadable is a source file or directory that can't be read,
+	// added in its place with SkipUnreadable.
+	InputUnreadable InputKind = "unreadable"
+	// InputSpecial is the type of a source that isn't a regular file or a
+	// directory, e.g. a socket or a named pipe, which isn't read.
+	InputSpecial InputKind = "special"
+	// InputEmptyDir is a source directory without files, added with
+	// IncludeEmptyDirs.
+	InputEmptyDir InputKind = "empty-dir"
+	// InputXattr is an extended attribute of a source file or directory,
+	// hex encoded.
+	InputXattr InputKind = "xattr"
+	// InputContext is the name of a named build context. Path and file inputs
+	// after it are from that context.
+	InputContext InputKind = "context"
+	// InputURL is a digest identifying the content of a URL in ADD.
+	InputURL InputKind = "url"
+	// InputImage is the registry digest of an external image for a
+	// platform.
+	InputImage InputKind = "image"
+	// InputBuildArg is a build arg, including ARG defaults and ENV.
+	InputBuildArg InputKind = "build-arg"
+	// InputPlatform is a target platform.
+	InputPlatform InputKind = "platform"
+	// InputLabel is an image label.
+	InputLabel InputKind = "label"
+)
+
+// Input is something written to the hash when calculating the checksum.
+type Input struct {
+	Kind InputKind `json:"kind"`
+	// Path is set for dockerfile, path, file, metadata, xattr, unreadable,
+	// special, empty-dir and url inputs, and is the directory of context
+	// inputs.
+	Path string `json:"path,omitempty"`
+	// Digest is the digest of the content, set for dockerfile, file, url and
+	// image inputs.
+	Digest string `json:"digest,omitempty"`
+	// Key is set for build-arg and label inputs, and is the name of xattr
+	// inputs, the image reference for image inputs, or the name of a context
+	// input.
+	Key string `json:"key,omitempty"`
+	// Size is the size in bytes of the file, set for file inputs.
+	Size int64 `json:"size,omitempty"`
+	// Value is set for salt, build-arg, label, metadata, xattr and platform
+	// inputs, is the error of unreadable inputs, the type of special inputs,
+	// and the platform for image inputs.
+	Value string `json:"value,omitempty"`
+}
+
+// String returns a human readable representation of the input.
+func (in Input) String() string {
+	switch in.Kind {
+	case InputDockerfile, InputFile, InputURL:
+		return string(in.Kind) + " " + in.Path + " " + in.Digest
+	case InputPath, InputEmptyDir:
+		return string(in.Kind) + " " + in.Path
+	case InputMetadata, InputUnreadable, InputSpecial:
+		return string(in.Kind) + " " + in.Path + " " + in.Value
+	case InputXattr:
+		return string(in.Kind) + " " + in.Path + " " + in.Key + "=" + in.Value
+	case InputContext:
+		return string(in.Kind) + " " + in.Key + "=" + in.Path
+	case InputImage:
+		return string(in.Kind) + " " + in.Key + " " + in.Value + " " + in.Digest
+	case InputBuildArg, InputLabel:
+		return string(in.Kind) + " " + in.Key + "=" + in.Value
+	default:
+		return string(in.Kind) + " " + in.Value
+	}
+}
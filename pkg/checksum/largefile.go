@@ -0,0 +1,39 @@
+package checksum
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LargeFileContent adds the digest of the content of large files, as
+	// for any other file.
+	LargeFileContent = "content"
+	// LargeFileMetadata adds the size and modification time of large files
+	// instead of reading them.
+	LargeFileMetadata = "metadata"
+	// LargeFileChunked adds the digest of the digests of chunks of large
+	// files, which are read at the same time, instead of the digest of
+	// their content.
+	LargeFileChunked = "chunked"
+)
+
+func checkLargeFileMode(mode string) error {
+	switch mode {
+	case "", LargeFileContent, LargeFileMetadata, LargeFileChunked:
+		return nil
+	}
+	return errors.Errorf("unknown large file mode %s", mode)
+}
+
+// largeFileDigest returns a digest made of the size and modification time of
+// a file, if it's above the large file threshold and large files are added
+// by their metadata.
+func (s *checksummer) largeFileDigest(info fs.FileInfo) (string, bool) {
+	if s.largeFileMode != LargeFileMetadata || info.Size() <= s.largeFileThreshold {
+		return "", false
+	}
+	return fmt.Sprintf("size:%d,mtime:%d", info.Size(), info.ModTime().UnixNano()), true
+}
@@ -0,0 +1,220 @@
+package checksum
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Manifest records everything that contributes to a checksum, so checksums
+// from different builds can be compared.
+type Manifest struct {
+	Checksum string `json:"checksum"`
+	Hash     string `json:"hash"`
+	Salt     string `json:"salt,omitempty"`
+	// HashVersion is only set for versions after HashVersion1.
+	HashVersion int    `json:"hashVersion,omitempty"`
+	Dockerfile  string `json:"dockerfile"`
+	// DockerfileDigest is the digest of the dockerfile content.
+	DockerfileDigest string            `json:"dockerfileDigest"`
+	BuildArgs        map[string]string `json:"buildArgs,omitempty"`
+	Platforms        []string          `json:"platforms,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	// Files maps paths of source files and URLs to digests of their content.
+	// Paths from named contexts are prefixed with the context name and a
+	// colon.
+	Files map[string]string `json:"files"`
+	// Metadata maps paths of source files and directories to their mode and
+	// owner, if metadata is included. Paths are prefixed as in Files.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// NewManifest calculates the checksum for a dockerfile and returns its
+// manifest.
+func NewManifest(c Config) (*Manifest, error) {
+	sum, inputs, err := ExplainDockerfileChecksum(c)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Checksum:   sum,
+		Hash:       c.Algorithm(),
+		Dockerfile: c.Dockerfile,
+		Files:      map[string]string{},
+	}
+	if c.HashVersion > HashVersion1 {
+		m.HashVersion = c.HashVersion
+	}
+
+	var context string
+	for _, in := range inputs {
+		switch in.Kind {
+		case InputSalt:
+			m.Salt = in.Value
+		case InputDockerfile:
+			m.DockerfileDigest = in.Digest
+		case InputContext:
+			context = in.Key + ":"
+		case InputFile:
+			m.Files[context+in.Path] = in.Digest
+		case InputMetadata:
+			if m.Metadata == nil {
+				m.Metadata = map[string]string{}
+			}
+			m.Metadata[context+in.Path] = in.Value
+		case InputURL:
+			m.Files[in.Path] = in.Digest
+		case InputBuildArg:
+			if m.BuildArgs == nil {
+				m.BuildArgs = map[string]string{}
+			}
+			m.BuildArgs[in.Key] = in.Value
+		case InputPlatform:
+			m.Platforms = append(m.Platforms, in.Value)
+		case InputLabel:
+			if m.Labels == nil {
+				m.Labels = map[string]string{}
+			}
+			m.Labels[in.Key] = in.Value
+		}
+	}
+
+	return m, nil
+}
+
+// ReadManifest reads a manifest written by WriteFile.
+func ReadManifest(path string) (*Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, errors.Wrapf(err, "decode manifest %s", path)
+	}
+
+	return &m, nil
+}
+
+// WriteFile writes the manifest to path as JSON.
+func (m *Manifest) WriteFile(path string) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode manifest")
+	}
+
+	return errors.Wrap(
+		os.WriteFile(path, append(content, '\n'), 0o644),
+		"write manifest",
+	)
+}
+
+// ManifestDiff is the difference between two manifests.
+type ManifestDiff struct {
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+	// Config lists changes other than source files, e.g. the dockerfile or
+	// build args.
+	Config []string `json:"config,omitempty"`
+}
+
+// Empty reports whether there's no difference.
+func (d ManifestDiff) Empty() bool {
+	return len(d.Added) == 0 &&
+		len(d.Removed) == 0 &&
+		len(d.Modified) == 0 &&
+		len(d.Config) == 0
+}
+
+// DiffManifests returns what has changed from old to new.
+func DiffManifests(old, new *Manifest) ManifestDiff {
+	var d ManifestDiff
+
+	for path, digest := range new.Files {
+		oldDigest, ok := old.Files[path]
+		if !ok {
+			d.Added = append(d.Added, path)
+		} else if oldDigest != digest {
+			d.Modified = append(d.Modified, path)
+		}
+	}
+
+	for path := range old.Files {
+		if _, ok := new.Files[path]; !ok {
+			d.Removed = append(d.Removed, path)
+		}
+	}
+
+	if old.Hash != new.Hash {
+		d.Config = append(d.Config, fmt.Sprintf(
+			"hash: %s -> %s", old.Hash, new.Hash,
+		))
+	}
+
+	if old.HashVersion != new.HashVersion {
+		d.Config = append(d.Config, fmt.Sprintf(
+			"hash version: %d -> %d", old.HashVersion, new.HashVersion,
+		))
+	}
+
+	if old.Salt != new.Salt {
+		d.Config = append(d.Config, fmt.Sprintf(
+			"salt: %q -> %q", old.Salt, new.Salt,
+		))
+	}
+
+	if old.DockerfileDigest != new.DockerfileDigest {
+		d.Config = append(d.Config, "dockerfile: content changed")
+	}
+
+	d.Config = append(d.Config, diffMap("build-arg", old.BuildArgs, new.BuildArgs)...)
+	d.Config = append(d.Config, diffMap("label", old.Labels, new.Labels)...)
+	d.Config = append(d.Config, diffMap("metadata", old.Metadata, new.Metadata)...)
+
+	if !slices.Equal(old.Platforms, new.Platforms) {
+		d.Config = append(d.Config, fmt.Sprintf(
+			"platform: %v -> %v", old.Platforms, new.Platforms,
+		))
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+
+	return d
+}
+
+func diffMap(name string, old, new map[string]string) []string {
+	keys := maps.Keys(old)
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var res []string
+	for _, key := range keys {
+		oldValue, oldOk := old[key]
+		newValue, newOk := new[key]
+		switch {
+		case !oldOk:
+			res = append(res, fmt.Sprintf("%s %s: added %q", name, key, newValue))
+		case !newOk:
+			res = append(res, fmt.Sprintf("%s %s: removed", name, key))
+		case oldValue != newValue:
+			res = append(res, fmt.Sprintf(
+				"%s %s: %q -> %q", name, key, oldValue, newValue,
+			))
+		}
+	}
+	return res
+}
@@ -0,0 +1,143 @@
+package checksum
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"golang.org/x/exp/slices"
+)
+
+// normalizeDockerfile returns the dockerfile without comments and
+// insignificant whitespace, so reformatting it doesn't change the checksum.
+// Parser directives come first, then each instruction on a single line,
+// followed by its heredocs as is.
+func normalizeDockerfile(content []byte, res *parser.Result) []byte {
+	var b strings.Builder
+
+	if syntax, _, _, ok := parser.DetectSyntax(content); ok {
+		b.WriteString("# syntax=" + syntax + "\n")
+	}
+	if res.EscapeToken != '\\' {
+		b.WriteString("# escape=" + string(res.EscapeToken) + "\n")
+	}
+
+	for _, node := range res.AST.Children {
+		b.WriteString(collapseWhitespace(node.Original, res.EscapeToken))
+		b.WriteByte('\n')
+		for _, heredoc := range node.Heredocs {
+			b.WriteString(heredoc.Content)
+			b.WriteString(heredoc.Name + "\n")
+		}
+	}
+
+	return []byte(b.String())
+}
+
+// collapseWhitespace trims s and replaces each run of whitespace outside
+// quotes with a single space. Escaped characters are kept as is.
+func collapseWhitespace(s string, escape rune) string {
+	var (
+		b       strings.Builder
+		quote   rune
+		escaped bool
+		space   bool
+	)
+
+	for _, r := range strings.TrimSpace(s) {
+		switch {
+		case escaped:
+			escaped = false
+		case r == escape && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// canonicalInstruction is an instruction of a dockerfile as parsed.
+type canonicalInstruction struct {
+	Name     string             `json:"name"`
+	Flags    []string           `json:"flags,omitempty"`
+	Args     []string           `json:"args,omitempty"`
+	JSON     bool               `json:"json,omitempty"`
+	Heredocs []canonicalHeredoc `json:"heredocs,omitempty"`
+}
+
+type canonicalHeredoc struct {
+	Name    string `json:"name"`
+	Expand  bool   `json:"expand,omitempty"`
+	Chomp   bool   `json:"chomp,omitempty"`
+	Content string `json:"content"`
+}
+
+// canonicalDockerfile returns a serialization of the parsed dockerfile, so
+// dockerfiles with the same instructions have the same checksum however
+// they're formatted. Instruction names are lowercased and flags are sorted,
+// as neither case nor order matter, and whitespace in arguments is collapsed
+// as in normalizeDockerfile, except in JSON form.
+func canonicalDockerfile(content []byte, res *parser.Result) []byte {
+	directives := map[string]string{}
+	if syntax, _, _, ok := parser.DetectSyntax(content); ok {
+		directives["syntax"] = syntax
+	}
+	if res.EscapeToken != '\\' {
+		directives["escape"] = string(res.EscapeToken)
+	}
+
+	instructions := make([]canonicalInstruction, 0, len(res.AST.Children))
+	for _, node := range res.AST.Children {
+		in := canonicalInstruction{
+			Name:  strings.ToLower(node.Value),
+			Flags: slices.Clone(node.Flags),
+			JSON:  node.Attributes["json"],
+		}
+		slices.Sort(in.Flags)
+
+		for next := node.Next; next != nil; next = next.Next {
+			arg := next.Value
+			if !in.JSON {
+				arg = collapseWhitespace(arg, res.EscapeToken)
+			}
+			in.Args = append(in.Args, arg)
+		}
+		// The AS keyword of FROM is case insensitive.
+		if in.Name == "from" && len(in.Args) == 3 && strings.EqualFold(in.Args[1], "as") {
+			in.Args[1] = "as"
+		}
+
+		for _, heredoc := range node.Heredocs {
+			in.Heredocs = append(in.Heredocs, canonicalHeredoc{
+				Name:    heredoc.Name,
+				Expand:  heredoc.Expand,
+				Chomp:   heredoc.Chomp,
+				Content: heredoc.Content,
+			})
+		}
+
+		instructions = append(instructions, in)
+	}
+
+	// Map keys are sorted when encoded, so the result is stable.
+	return must(json.Marshal(map[string]any{
+		"directives":   directives,
+		"instructions": instructions,
+	}))
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package checksum
+
+import (
+	"archive/tar"
+	"io/fs"
+)
+
+func owner(info fs.FileInfo) (uid, gid uint32) {
+	if header, ok := info.Sys().(*tar.Header); ok {
+		return uint32(header.Uid), uint32(header.Gid)
+	}
+	return 0, 0
+}
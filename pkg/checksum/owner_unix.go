@@ -0,0 +1,19 @@
+//go:build unix
+
+package checksum
+
+import (
+	"archive/tar"
+	"io/fs"
+	"syscall"
+)
+
+func owner(info fs.FileInfo) (uid, gid uint32) {
+	if header, ok := info.Sys().(*tar.Header); ok {
+		return uint32(header.Uid), uint32(header.Gid)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Uid, stat.Gid
+	}
+	return 0, 0
+}
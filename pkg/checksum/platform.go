@@ -0,0 +1,188 @@
+package checksum
+
+import (
+	"runtime"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+)
+
+// PlatformChecksum is the checksum of a dockerfile for a single platform.
+type PlatformChecksum struct {
+	Platform string `json:"platform"`
+	Checksum string `json:"checksum"`
+}
+
+// CalculatePlatformChecksums returns the checksum of a dockerfile for each
+// platform on its own, in order. A platform checksum only changes if sources
+// of that platform change, e.g. with COPY dist/${TARGETARCH}.
+func CalculatePlatformChecksums(c Config) ([]PlatformChecksum, error) {
+	cache := c.Cache
+	if cache == nil && c.CacheDir != "" {
+		var err error
+		cache, err = OpenDigestCache(c.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sums := make([]PlatformChecksum, len(c.Platforms))
+	for i, platform := range c.Platforms {
+		pc := c
+		pc.Platforms = []string{platform}
+		pc.Cache = cache
+
+		sum, err := CalculateDockerfileChecksum(pc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "platform %s", platform)
+		}
+		sums[i] = PlatformChecksum{Platform: platform, Checksum: sum}
+	}
+
+	if c.Cache == nil && cache != nil {
+		if err := cache.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sums, nil
+}
+
+// platformSources returns sources of the dockerfile for every platform,
+// with the platform args BuildKit sets, e.g. TARGETARCH, so sources can
+// depend on the platform. buildArgs are updated as in parseSources, for the
+// first platform.
+func (c Config) platformSources(
+	res *parser.Result,
+	buildArgs map[string]string,
+) (sources, error) {
+	if len(c.Platforms) == 0 {
+		src, err := parseSources(res, buildArgs, c.IncludeOnbuild)
+		return src, c.withDockerfile(err)
+	}
+
+	given := cloneMap(buildArgs)
+
+	var stages []stage
+	for i, platform := range c.Platforms {
+		implicit, err := platformArgs(platform)
+		if err != nil {
+			return sources{}, err
+		}
+
+		args := buildArgs
+		if i > 0 {
+			args = cloneMap(given)
+		}
+		// Build args that are given explicitly take precedence.
+		for key, value := range implicit {
+			if _, ok := given[key]; !ok {
+				args[key] = value
+			}
+		}
+
+		src, err := parseSources(res, args, c.IncludeOnbuild)
+		if err != nil {
+			return sources{}, c.withDockerfile(err)
+		}
+		if i > 0 {
+			mergeStages(stages, src.stages)
+			continue
+		}
+		stages = src.stages
+
+		// Platform args are part of the checksum through platforms, not
+		// as build args.
+		for key := range implicit {
+			if _, ok := given[key]; !ok {
+				delete(buildArgs, key)
+			}
+		}
+	}
+
+	return collectSources(stages, nil), nil
+}
+
+// mergeStages adds sources of other to stages, where other are the same
+// stages parsed for another platform.
+func mergeStages(stages, other []stage) {
+	for i := range stages {
+		st, o := &stages[i], other[i]
+
+		for _, path := range o.paths {
+			if !slices.Contains(st.paths, path) {
+				st.addPaths(o.origins[path], path)
+			}
+		}
+
+		for _, ext := range o.external {
+			if !slices.ContainsFunc(st.external, func(e externalSource) bool {
+				return e.from == ext.from && slices.Equal(e.paths, ext.paths)
+			}) {
+				st.external = append(st.external, ext)
+			}
+		}
+
+		for _, img := range o.images {
+			if !slices.Contains(st.images, img) {
+				st.images = append(st.images, img)
+			}
+		}
+	}
+}
+
+// platformArgs returns the args BuildKit sets for a target platform. The
+// build platform is the platform of this machine.
+func platformArgs(platform string) (map[string]string, error) {
+	target, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse platform %s", platform)
+	}
+	normalizePlatform(target)
+
+	build := &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if runtime.GOARCH == "arm" {
+		build.Variant = "v7"
+	}
+
+	args := map[string]string{}
+	for prefix, p := range map[string]*v1.Platform{"TARGET": target, "BUILD": build} {
+		args[prefix+"PLATFORM"] = p.String()
+		args[prefix+"OS"] = p.OS
+		args[prefix+"ARCH"] = p.Architecture
+		args[prefix+"VARIANT"] = p.Variant
+	}
+	return args, nil
+}
+
+// normalizePlatform normalizes architectures and variants as containerd,
+// e.g. linux/arm64/v8 is linux/arm64 and linux/arm is linux/arm/v7.
+func normalizePlatform(p *v1.Platform) {
+	switch p.Architecture {
+	case "x86_64", "x86-64", "amd64":
+		p.Architecture = "amd64"
+		if p.Variant == "v1" {
+			p.Variant = ""
+		}
+	case "aarch64", "arm64":
+		p.Architecture = "arm64"
+		if p.Variant == "8" || p.Variant == "v8" {
+			p.Variant = ""
+		}
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	case "arm":
+		switch p.Variant {
+		case "", "7":
+			p.Variant = "v7"
+		case "5", "6", "8":
+			p.Variant = "v" + p.Variant
+		}
+	case "i386":
+		p.Architecture = "386"
+	}
+}
@@ -0,0 +1,156 @@
+package checksum
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RemoteAddOff ignores URLs in ADD.
+	RemoteAddOff = "off"
+	// RemoteAddHead adds the ETag or Last-Modified header of URLs in ADD,
+	// falling back to RemoteAddFetch if the server sends neither.
+	RemoteAddHead = "head"
+	// RemoteAddFetch downloads URLs in ADD and adds the digest of their
+	// content.
+	RemoteAddFetch = "fetch"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Minute}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") ||
+		strings.HasPrefix(path, "https://")
+}
+
+// urlSha writes the URL and a digest identifying its content to the final
+// hash.
+func (s *checksummer) urlSha(url string) error {
+	var (
+		digests []string
+		err     error
+	)
+
+	switch s.remoteAdd {
+	case "", RemoteAddOff:
+		s.logger.Debug("ignore url", "url", url)
+		return nil
+	case RemoteAddHead:
+		digests, err = s.urlHeadDigests(url)
+	case RemoteAddFetch:
+		digests, err = s.urlFetchDigests(url)
+	default:
+		return errors.Errorf("unknown remote add mode %s", s.remoteAdd)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.writePath(url)
+
+	for i, h := range s.hashes {
+		s.writeField(h, string(InputURL), digests[i])
+	}
+	s.input(Input{Kind: InputURL, Path: url, Digest: digests[0]})
+
+	return nil
+}
+
+func (s *checksummer) urlHeadDigests(url string) ([]string, error) {
+	etag, lastModified, err := headURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case etag != "":
+		return repeat("etag:"+etag, len(s.algorithms)), nil
+	case lastModified != "":
+		return repeat("last-modified:"+lastModified, len(s.algorithms)), nil
+	default:
+		s.logger.Debug("no etag or last-modified, fetch url", "url", url)
+		return s.urlFetchDigests(url)
+	}
+}
+
+// urlFetchDigests downloads url and returns the digest of its content with
+// each algorithm. If the server sends an ETag, digests are cached and reused
+// for as long as the ETag stays the same.
+func (s *checksummer) urlFetchDigests(url string) ([]string, error) {
+	var keys []string
+	if s.cache != nil {
+		etag, _, err := headURL(url)
+		if err != nil {
+			return nil, err
+		}
+
+		if etag != "" {
+			for _, algorithm := range s.algorithms {
+				keys = append(keys, urlCacheKey(algorithm, url, etag))
+			}
+			if digests, ok := s.cachedDigests(keys); ok {
+				s.logger.Debug("use cached digest", "url", url)
+				return digests, nil
+			}
+		}
+	}
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch url")
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	res, err := digests(s.algorithms, resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch url")
+	}
+
+	for i, key := range keys {
+		s.cache.put(key, res[i])
+	}
+
+	return res, nil
+}
+
+// headURL returns the ETag and Last-Modified headers of url. Servers that
+// reject HEAD, e.g. presigned URLs only valid for GET, are sent a GET whose
+// body isn't read.
+func headURL(url string) (etag, lastModified string, err error) {
+	resp, err := httpClient.Head(url)
+	if err != nil {
+		return "", "", errors.Wrap(err, "head url")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusMethodNotAllowed {
+		resp, err = httpClient.Get(url)
+		if err != nil {
+			return "", "", errors.Wrap(err, "head url")
+		}
+		resp.Body.Close()
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return "", "", err
+	}
+
+	return resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf(
+			"%s %s: unexpected status %s",
+			resp.Request.Method, resp.Request.URL, resp.Status,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package checksum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// remoteCacheUploads is how many entries are uploaded to a remote cache at
+// the same time.
+const remoteCacheUploads = 8
+
+// remoteCacheTimeout is how long a request to a remote cache may take. It's
+// much shorter than for downloads of URL sources, since a slow cache only
+// costs time.
+const remoteCacheTimeout = 10 * time.Second
+
+var remoteCacheClient = &http.Client{Timeout: remoteCacheTimeout}
+
+// RemoteCache shares file digests between machines, e.g. ephemeral CI
+// runners. Unlike DigestCache, entries are keyed by the content of files,
+// so they're found again in a fresh checkout. The content address of a file
+// is its git object id, so only files that are unchanged in git are looked
+// up.
+//
+// Errors of the remote store are logged and the file is hashed, since a
+// missing cache only costs time. After the first error the remote cache is
+// disabled, so an unreachable store doesn't slow down every file.
+type RemoteCache struct {
+	store    remoteStore
+	disabled atomic.Bool
+
+	mu sync.Mutex
+	// pending holds entries that aren't uploaded yet.
+	pending map[string]string
+}
+
+// remoteStore is a key-value store of a remote cache.
+type remoteStore interface {
+	// get returns the value of key, or false if there's none.
+	get(key string) (string, bool, error)
+	put(key, value string) error
+}
+
+// OpenRemoteCache returns the remote cache at a URL:
+//
+//   - http:// or https:// for an HTTP server, with entries read by GET and
+//     written by PUT to the URL joined with the key.
+//   - s3://bucket/prefix for an S3 bucket, with credentials and region from
+//     AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+//     AWS_REGION, and AWS_ENDPOINT_URL for other S3 compatible stores.
+//   - redis://[user:password@]host:port[/db] for a Redis server.
+func OpenRemoteCache(rawURL string) (*RemoteCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse remote cache url")
+	}
+
+	var store remoteStore
+	switch u.Scheme {
+	case "http", "https":
+		store = &httpStore{base: strings.TrimSuffix(rawURL, "/")}
+	case "s3":
+		store, err = newS3Store(u)
+	case "redis":
+		store, err = newRedisStore(u)
+	default:
+		return nil, errors.Errorf("unknown remote cache %s", rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteCache{store: store, pending: map[string]string{}}, nil
+}
+
+// remoteCacheKey is the key of the digest with algorithm of a git object.
+func remoteCacheKey(algorithm, format, object string) string {
+	return fmt.Sprintf("%s-git-%s-%s", algorithm, format, object)
+}
+
+func (c *RemoteCache) get(key string) (string, bool, error) {
+	c.mu.Lock()
+	digest, ok := c.pending[key]
+	c.mu.Unlock()
+	if ok {
+		return digest, true, nil
+	}
+
+	if c.disabled.Load() {
+		return "", false, nil
+	}
+
+	digest, ok, err := c.store.get(key)
+	if err != nil {
+		// Only the first error is returned, lookups running at the same time
+		// are misses.
+		if c.disabled.Swap(true) {
+			return "", false, nil
+		}
+		return "", false, errors.Wrap(err, "read remote cache, disabled for this run")
+	}
+	return digest, ok, nil
+}
+
+func (c *RemoteCache) put(key, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[key] = digest
+}
+
+// Save uploads new entries. Nothing is uploaded if the remote cache is
+// disabled.
+func (c *RemoteCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.disabled.Load() {
+		c.pending = map[string]string{}
+		return nil
+	}
+
+	keys := make([]string, 0, len(c.pending))
+	for key := range c.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var g errgroup.Group
+	g.SetLimit(remoteCacheUploads)
+	for _, key := range keys {
+		key, digest := key, c.pending[key]
+		g.Go(func() error { return c.store.put(key, digest) })
+	}
+	if err := g.Wait(); err != nil {
+		return errors.Wrap(err, "save remote cache")
+	}
+
+	c.pending = map[string]string{}
+	return nil
+}
+
+// httpStore is an HTTP server that stores the body of a PUT, as the HTTP
+// caches of Bazel or Gradle.
+type httpStore struct {
+	base string
+}
+
+func (s *httpStore) get(key string) (string, bool, error) {
+	return doStoreRequest(http.MethodGet, s.base+"/"+key, nil, nil)
+}
+
+func (s *httpStore) put(key, value string) error {
+	_, _, err := doStoreRequest(http.MethodPut, s.base+"/"+key, []byte(value), nil)
+	return err
+}
+
+// doStoreRequest sends a request to a remote store, after sign if it's set.
+// A GET returns the body, or false if it's not found.
+func doStoreRequest(
+	method, url string,
+	body []byte,
+	sign func(*http.Request, []byte),
+) (string, bool, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return "", false, err
+	}
+	if sign != nil {
+		sign(req, body)
+	}
+
+	resp, err := remoteCacheClient.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", false, errors.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(content), true, nil
+}
+
+// s3Store is an S3 bucket, addressed by path. Requests are signed with
+// signature version 4. The credentials need s3:ListBucket, or S3 answers
+// 403 instead of 404 for missing entries.
+type s3Store struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Store(u *url.URL) (*s3Store, error) {
+	s := &s3Store{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.endpoint == "" {
+		s.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	s.endpoint = strings.TrimSuffix(s.endpoint, "/")
+
+	if s.bucket == "" {
+		return nil, errors.Errorf("no bucket in remote cache %s", u)
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New(
+			"remote cache on s3 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+		)
+	}
+	return s, nil
+}
+
+func (s *s3Store) url(key string) string {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	return s.endpoint + "/" + s.bucket + "/" + key
+}
+
+func (s *s3Store) get(key string) (string, bool, error) {
+	return doStoreRequest(http.MethodGet, s.url(key), nil, s.sign)
+}
+
+func (s *s3Store) put(key, value string) error {
+	_, _, err := doStoreRequest(http.MethodPut, s.url(key), []byte(value), s.sign)
+	return err
+}
+
+// sign adds the signature version 4 headers to a request.
+func (s *s3Store) sign(req *http.Request, body []byte) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign)),
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// redisStore is a Redis server, spoken to with a single connection.
+type redisStore struct {
+	addr     string
+	user     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisStore(u *url.URL) (*redisStore, error) {
+	s := &redisStore{addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		var err error
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, errors.Errorf("invalid redis database %s", db)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisStore) get(key string) (string, bool, error) {
+	return s.do("GET", key)
+}
+
+func (s *redisStore) put(key, value string) error {
+	_, _, err := s.do("SET", key, value)
+	return err
+}
+
+// do sends a command and returns its reply, or false for a nil reply. The
+// connection is made on the first command.
+func (s *redisStore) do(args ...string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return "", false, err
+		}
+	}
+
+	reply, ok, err := s.command(args...)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return reply, ok, err
+}
+
+func (s *redisStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, remoteCacheTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	switch {
+	case s.user != "" && s.password != "":
+		setup = append(setup, []string{"AUTH", s.user, s.password})
+	case s.user != "" || s.password != "":
+		// redis://:password@host and redis://password@host both only
+		// give a password.
+		setup = append(setup, []string{"AUTH", s.user + s.password})
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+
+	for _, args := range setup {
+		if _, _, err := s.command(args...); err != nil {
+			conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// command writes a command in RESP and reads a simple, bulk or error reply.
+func (s *redisStore) command(args ...string) (string, bool, error) {
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&req, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	s.conn.SetDeadline(time.Now().Add(remoteCacheTimeout))
+	if _, err := s.conn.Write(req.Bytes()); err != nil {
+		return "", false, err
+	}
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", false, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], true, nil
+	case '-':
+		return "", false, errors.Errorf("redis: %s", line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, errors.Errorf("invalid redis reply %q", line)
+		}
+		if size < 0 {
+			return "", false, nil
+		}
+		content := make([]byte, size+2)
+		if _, err := io.ReadFull(s.r, content); err != nil {
+			return "", false, err
+		}
+		return string(content[:size]), true, nil
+	}
+	return "", false, errors.Errorf("unexpected redis reply %q", line)
+}
@@ -0,0 +1,140 @@
+package checksum
+
+import (
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// Result is the checksum of a dockerfile along with what it's calculated
+// from.
+type Result struct {
+	// Checksum is the checksum with Algorithm, the first algorithm in Hash.
+	Checksum  string `json:"checksum"`
+	Algorithm string `json:"algorithm"`
+	// HashVersion is the hash version the checksum is calculated with.
+	HashVersion int `json:"hashVersion"`
+	// Checksums has the checksum with each algorithm in Hash, in order.
+	Checksums []string `json:"checksums"`
+	// Files are the source files, in the order they're hashed. Paths from
+	// named contexts are prefixed with the context name and a colon, as in
+	// Manifest.
+	Files []FileResult `json:"files"`
+	// Paths are the source files and directories the source paths of the
+	// dockerfile resolved to, prefixed as in Files.
+	Paths   []string `json:"paths"`
+	Timings Timings  `json:"timings"`
+
+	config Config
+	// digests are the digests of each file with every algorithm, keyed as
+	// in Files.
+	digests map[string][]string
+}
+
+// FileResult is a source file of a Result.
+type FileResult struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Digest is the digest of the file with the first algorithm, as in
+	// explain.
+	Digest string `json:"digest"`
+}
+
+// Timings are how long each step of a calculation took.
+type Timings struct {
+	// Parse is reading and parsing the dockerfile.
+	Parse time.Duration `json:"parse"`
+	// Resolve is finding the source paths of the dockerfile.
+	Resolve time.Duration `json:"resolve"`
+	// Hash is hashing the sources and everything else.
+	Hash  time.Duration `json:"hash"`
+	Total time.Duration `json:"total"`
+}
+
+// Calculate calculates the checksum for a dockerfile and returns it with the
+// files it's calculated from. CalculateDockerfileChecksum only returns the
+// checksum.
+func Calculate(c Config) (*Result, error) {
+	return calculateResult(c, nil)
+}
+
+// Update calculates the checksum again after files at the changed paths
+// changed, only reading those files with HashVersion2. HashVersion1 hashes
+// the content of every file, so every file is read. Paths are relative to the build
+// context, or prefixed with the name of a named context and a colon as in
+// Files, and a changed directory changes every file in it.
+//
+// Sources are resolved again, so added and removed files are picked up,
+// but every other file is expected to be unchanged. The result is only
+// updated if there's no error.
+func (r *Result) Update(changed []string) error {
+	known := maps.Clone(r.digests)
+	for path := range known {
+		for _, c := range changed {
+			if isUnder(path, c) {
+				delete(known, path)
+				break
+			}
+		}
+	}
+
+	res, err := calculateResult(r.config, known)
+	if err != nil {
+		return err
+	}
+	*r = *res
+	return nil
+}
+
+// isUnder reports whether path is dir or a path in it.
+func isUnder(path, dir string) bool {
+	dir = pathpkg.Clean(filepath.ToSlash(dir))
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func calculateResult(c Config, known map[string][]string) (*Result, error) {
+	res := &Result{
+		Algorithm:   c.Algorithm(),
+		HashVersion: c.HashVersion,
+		Files:       []FileResult{},
+		Paths:       []string{},
+		config:      c,
+		digests:     map[string][]string{},
+	}
+	if res.HashVersion == 0 {
+		res.HashVersion = HashVersion1
+	}
+
+	var context string
+	onInput := func(in Input) {
+		switch in.Kind {
+		case InputContext:
+			context = in.Key + ":"
+		case InputPath:
+			res.Paths = append(res.Paths, context+in.Path)
+		case InputFile:
+			res.Files = append(res.Files, FileResult{
+				Path:   context + in.Path,
+				Size:   in.Size,
+				Digest: in.Digest,
+			})
+		}
+	}
+
+	sums, err := calculate(c, calculation{
+		onInput: onInput,
+		timings: &res.Timings,
+		known:   known,
+		digests: res.digests,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res.Checksum = sums[0]
+	res.Checksums = sums
+	return res, nil
+}
@@ -0,0 +1,138 @@
+package checksum
+
+import (
+	"encoding/hex"
+	"sort"
+
+	"golang.org/x/exp/maps"
+)
+
+// sbomTool is the name of this tool in SBOM documents, and the namespace of
+// their properties.
+const sbomTool = "dockerfile-source-checksum"
+
+// CycloneDX is a CycloneDX BOM of the source files of a checksum, as file
+// components with their digests. The checksum is the version of the
+// metadata component. It has no serial number or timestamp, so the same
+// sources give the same document.
+type CycloneDX struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    CycloneDXMetadata    `json:"metadata"`
+	Components  []CycloneDXComponent `json:"components"`
+}
+
+// CycloneDXMetadata describes the BOM and what it is for.
+type CycloneDXMetadata struct {
+	Tools     CycloneDXTools     `json:"tools"`
+	Component CycloneDXComponent `json:"component"`
+}
+
+// CycloneDXTools lists the tools that made the BOM.
+type CycloneDXTools struct {
+	Components []CycloneDXComponent `json:"components"`
+}
+
+// CycloneDXComponent is a component of a BOM.
+type CycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	Hashes     []CycloneDXHash     `json:"hashes,omitempty"`
+	Properties []CycloneDXProperty `json:"properties,omitempty"`
+}
+
+// CycloneDXHash is a digest of a component.
+type CycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// CycloneDXProperty is a name and value pair of a component.
+type CycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// cycloneDXAlgorithms maps hash algorithms to their names in CycloneDX.
+var cycloneDXAlgorithms = map[string]string{
+	"md5":    "MD5",
+	"sha1":   "SHA-1",
+	"sha256": "SHA-256",
+	"blake3": "BLAKE3",
+}
+
+// NewCycloneDX calculates the checksum for a dockerfile and returns the BOM
+// of its sources. Digests that aren't a hash of the content of a file, e.g.
+// git object ids or the ETag of a URL, are properties instead of hashes.
+func NewCycloneDX(c Config) (*CycloneDX, error) {
+	m, err := NewManifest(c)
+	if err != nil {
+		return nil, err
+	}
+
+	bom := &CycloneDX{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: CycloneDXMetadata{
+			Tools: CycloneDXTools{Components: []CycloneDXComponent{
+				{Type: "application", Name: sbomTool},
+			}},
+			Component: CycloneDXComponent{
+				Type:    "container",
+				Name:    m.Dockerfile,
+				Version: m.Checksum,
+				Properties: []CycloneDXProperty{
+					{Name: sbomTool + ":hash", Value: m.Hash},
+					{Name: sbomTool + ":dockerfile-digest", Value: m.DockerfileDigest},
+				},
+			},
+		},
+		Components: []CycloneDXComponent{},
+	}
+
+	paths := maps.Keys(m.Files)
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		component := CycloneDXComponent{
+			Type:   "file",
+			BOMRef: "file:" + path,
+			Name:   path,
+		}
+
+		// Algorithms CycloneDX has no name for, like xxh3, are properties too.
+		digest := m.Files[path]
+		if algorithm, ok := cycloneDXAlgorithms[m.Hash]; ok && isContentDigest(c, m.Hash, digest) {
+			component.Hashes = []CycloneDXHash{
+				{Alg: algorithm, Content: digest},
+			}
+		} else {
+			component.Properties = []CycloneDXProperty{
+				{Name: sbomTool + ":digest", Value: digest},
+			}
+		}
+
+		bom.Components = append(bom.Components, component)
+	}
+
+	return bom, nil
+}
+
+// isContentDigest reports whether digest is the hash of the content of a
+// file with algorithm.
+func isContentDigest(c Config, algorithm, digest string) bool {
+	if c.GitBlobs {
+		return false
+	}
+
+	h, err := newHash(algorithm)
+	if err != nil {
+		return false
+	}
+	b, err := hex.DecodeString(digest)
+	return err == nil && len(b) == h.Size()
+}
@@ -0,0 +1,142 @@
+package checksum
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// SPDX is an SPDX 2.3 document of the source files of a checksum. The
+// files are contained by a package of the dockerfile, whose version is the
+// checksum.
+type SPDX struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SPDXCreationInfo   `json:"creationInfo"`
+	Packages          []SPDXPackage      `json:"packages"`
+	Files             []SPDXFile         `json:"files"`
+	Relationships     []SPDXRelationship `json:"relationships"`
+}
+
+// SPDXCreationInfo describes who made the document and when.
+type SPDXCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// SPDXPackage is a package of a document.
+type SPDXPackage struct {
+	SPDXID           string `json:"SPDXID"`
+	Name             string `json:"name"`
+	VersionInfo      string `json:"versionInfo"`
+	DownloadLocation string `json:"downloadLocation"`
+	FilesAnalyzed    bool   `json:"filesAnalyzed"`
+	Comment          string `json:"comment,omitempty"`
+}
+
+// SPDXFile is a file of a document.
+type SPDXFile struct {
+	SPDXID    string         `json:"SPDXID"`
+	FileName  string         `json:"fileName"`
+	Checksums []SPDXChecksum `json:"checksums,omitempty"`
+	Comment   string         `json:"comment,omitempty"`
+}
+
+// SPDXChecksum is a digest of a file.
+type SPDXChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+// SPDXRelationship relates two elements of a document.
+type SPDXRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxAlgorithms maps hash algorithms to their names in SPDX.
+var spdxAlgorithms = map[string]string{
+	"md5":    "MD5",
+	"sha1":   "SHA1",
+	"sha256": "SHA256",
+	"blake3": "BLAKE3",
+}
+
+// NewSPDX calculates the checksum for a dockerfile and returns the SPDX
+// document of its sources. Digests that aren't a hash of the content of a
+// file are comments instead of checksums. SPDX expects a SHA1 checksum of
+// every file, which is only there if sha1 is the first hash algorithm.
+func NewSPDX(c Config) (*SPDX, error) {
+	m, err := NewManifest(c)
+	if err != nil {
+		return nil, err
+	}
+
+	const packageID = "SPDXRef-Package-dockerfile"
+
+	doc := &SPDX{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        m.Dockerfile,
+		DocumentNamespace: fmt.Sprintf(
+			"https://github.com/inoc603/dockerfile-source-checksum/spdx/%s/%s",
+			m.Hash, m.Checksum,
+		),
+		CreationInfo: SPDXCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: " + sbomTool},
+		},
+		Packages: []SPDXPackage{{
+			SPDXID:           packageID,
+			Name:             m.Dockerfile,
+			VersionInfo:      m.Checksum,
+			DownloadLocation: "NOASSERTION",
+			Comment: fmt.Sprintf(
+				"%s checksum of the sources, dockerfile digest %s",
+				m.Hash, m.DockerfileDigest,
+			),
+		}},
+		Files: []SPDXFile{},
+		Relationships: []SPDXRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: packageID,
+		}},
+	}
+
+	paths := maps.Keys(m.Files)
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		file := SPDXFile{
+			SPDXID:   fmt.Sprintf("SPDXRef-File-%d", i),
+			FileName: path,
+		}
+
+		// Algorithms SPDX has no name for, like xxh3, are comments too.
+		digest := m.Files[path]
+		if algorithm, ok := spdxAlgorithms[m.Hash]; ok && isContentDigest(c, m.Hash, digest) {
+			file.Checksums = []SPDXChecksum{
+				{Algorithm: algorithm, ChecksumValue: digest},
+			}
+		} else {
+			file.Comment = sbomTool + " digest " + digest
+		}
+
+		doc.Files = append(doc.Files, file)
+		doc.Relationships = append(doc.Relationships, SPDXRelationship{
+			SPDXElementID:      packageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: file.SPDXID,
+		})
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,116 @@
+package checksum
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+)
+
+// StageChecksum is the checksum of a stage in a dockerfile.
+type StageChecksum struct {
+	// Name is the name of the stage, or its index if it has no name.
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+}
+
+// CalculateStageChecksums returns the checksum of each stage in a
+// dockerfile, in order. A stage checksum is calculated from the instructions
+// of the stage, its sources and checksums of the stages it uses, so it only
+// changes if the stage or a stage it depends on changes. Labels only apply
+// to the final image and are not included, but the salt is. Only the first hash algorithm is
+// used.
+func CalculateStageChecksums(c Config) ([]StageChecksum, error) {
+	c.BuildArgs = cloneMap(c.BuildArgs)
+	c.Hash = c.Algorithm()
+
+	_, res, err := c.readDockerfile()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newChecksummer(c, c.contextFS(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeAttributes()
+
+	if c.ArgsFromEnv {
+		argsFromEnv(res, c.BuildArgs)
+	}
+	src, err := c.platformSources(res, c.BuildArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make([]StageChecksum, len(src.stages))
+	for i, st := range src.stages {
+		sum, err := s.stageSha(c, st, sums)
+		if err != nil {
+			return nil, errors.Wrapf(err, "calculate checksum for stage %s", st.name)
+		}
+		sums[i] = StageChecksum{Name: st.name, Checksum: sum}
+	}
+
+	if err := s.saveCache(c); err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
+
+// stageSha returns the checksum of a stage, given checksums of the stages
+// before it.
+func (s *checksummer) stageSha(
+	c Config,
+	st stage,
+	sums []StageChecksum,
+) (string, error) {
+	cs := *s
+	if err := cs.resetHashes(); err != nil {
+		return "", err
+	}
+
+	cs.writeSalt(c.Salt)
+
+	for _, code := range st.code {
+		cs.writeField(cs.h, "instruction", code)
+	}
+
+	for _, dep := range st.deps {
+		cs.writeField(cs.h, "stage", sums[dep].Checksum)
+	}
+
+	if c.PinFrom && len(st.images) > 0 {
+		if err := cs.imagesSha(st.images, c.Platforms); err != nil {
+			return "", err
+		}
+	}
+
+	paths := slices.Clone(st.paths)
+	sort.Strings(paths)
+	if err := cs.pathsSha(paths); err != nil {
+		return "", err
+	}
+
+	contextPaths, images, err := sources{external: st.external}.
+		resolveExternal(c.BuildContexts)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cs.contextsSha(c.BuildContexts, contextPaths); err != nil {
+		return "", err
+	}
+
+	if c.PinCopyFrom {
+		if err := cs.imagesSha(images, c.Platforms); err != nil {
+			return "", err
+		}
+	}
+
+	cs.writeMap(InputBuildArg, c.hashedBuildArgs())
+	cs.writeSlice(InputPlatform, c.hashedPlatforms())
+
+	return cs.sums()[0], nil
+}
@@ -0,0 +1,19 @@
+package checksum
+
+import "sync/atomic"
+
+// Stats counts the work of calculations. It's safe for concurrent use, so
+// it can be shared between calculations.
+type Stats struct {
+	// Files is the number of source files added to checksums.
+	Files atomic.Int64
+	// HashedFiles is the number of files whose content was read, and
+	// HashedBytes their total size.
+	HashedFiles atomic.Int64
+	HashedBytes atomic.Int64
+	// CacheHits is the number of files whose digests were found in the
+	// local or remote cache, and CacheMisses the number of files read
+	// while a cache is used.
+	CacheHits   atomic.Int64
+	CacheMisses atomic.Int64
+}
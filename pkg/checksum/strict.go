@@ -0,0 +1,64 @@
+package checksum
+
+import (
+	"io/fs"
+	"os"
+	"sort"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// check returns an error naming the instruction if a source path doesn't
+// exist in its context, or a pattern matches nothing.
+func (src sources) check(
+	fsys fs.FS,
+	contexts map[string]string,
+	contextPaths map[string][]string,
+) error {
+	for _, path := range src.paths {
+		if isURL(path) {
+			continue
+		}
+		if err := checkPath(fsys, path, src.origins[path]); err != nil {
+			return err
+		}
+	}
+
+	names := maps.Keys(contextPaths)
+	sort.Strings(names)
+
+	for _, name := range names {
+		contextFS := os.DirFS(contexts[name])
+		for _, path := range contextPaths[name] {
+			if err := checkPath(contextFS, path, src.externalOrigin(name, path)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// externalOrigin returns the instruction that uses path from a named
+// context.
+func (src sources) externalOrigin(from, path string) string {
+	for _, ext := range src.external {
+		if ext.from == from && slices.Contains(ext.paths, path) {
+			return ext.origin
+		}
+	}
+	return from
+}
+
+func checkPath(fsys fs.FS, path, origin string) error {
+	files, err := globPath(fsys, path)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		return nil
+	}
+	return &SourceError{Origin: origin, Path: path, Pattern: hasWildcard(path)}
+}
@@ -0,0 +1,372 @@
+package checksum
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IsTarContext reports whether a build context is a tar archive, by its
+// extension.
+func IsTarContext(context string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2"} {
+		if strings.HasSuffix(context, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenTarContext opens a tar archive, optionally compressed with gzip or
+// bzip2, as a file system. Files of an uncompressed archive are read from it
+// when they're opened, while a compressed archive is read into memory. The
+// returned closer closes the archive.
+func OpenTarContext(path string) (fs.FS, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open tar context")
+	}
+
+	compressed, err := isCompressed(f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "read tar context %s", path)
+	}
+
+	var fsys *tarFS
+	if compressed {
+		fsys, err = readTar(f, nil)
+	} else {
+		fsys, err = readTar(f, f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "read tar context %s", path)
+	}
+
+	return fsys, f, nil
+}
+
+// ReadTarContext reads a tar stream, optionally compressed with gzip or
+// bzip2, as a file system. The stream is read once, with the content of its
+// files kept in memory.
+func ReadTarContext(r io.Reader) (fs.FS, error) {
+	fsys, err := readTar(r, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "read tar context")
+	}
+	return fsys, nil
+}
+
+func isCompressed(r io.Reader) (bool, error) {
+	magic := make([]byte, 3)
+	if _, err := io.ReadFull(r, magic); err != nil &&
+		!errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) ||
+		bytes.HasPrefix(magic, []byte("BZh")), nil
+}
+
+// decompress returns the content of r, decompressed if it's a gzip or bzip2
+// stream.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(3)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
+}
+
+// tarFS is a read-only file system of the entries of a tar archive.
+// Symlinks are followed inside the archive, and directories that only
+// appear in the paths of other entries are added.
+type tarFS struct {
+	entries map[string]*tarEntry
+}
+
+type tarEntry struct {
+	header *tar.Header
+	// content returns the content of a regular file.
+	content  func() io.Reader
+	children []string
+}
+
+// readTar reads the entries of a tar archive in r. If ra is set, it's the
+// uncompressed archive, and file contents are read from it on open instead
+// of kept in memory.
+func readTar(r io.Reader, ra io.ReaderAt) (*tarFS, error) {
+	if ra == nil {
+		var err error
+		r, err = decompress(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := &tarFS{entries: map[string]*tarEntry{}}
+	t.entries["."] = &tarEntry{header: &tar.Header{
+		Name:     ".",
+		Typeflag: tar.TypeDir,
+		Mode:     0o755,
+	}}
+
+	seeker, _ := r.(io.Seeker)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := pathpkg.Clean("/" + header.Name)[1:]
+		if name == "" {
+			continue
+		}
+
+		e := &tarEntry{header: header}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			if ra != nil && seeker != nil && !isSparse(header) {
+				offset, err := seeker.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return nil, err
+				}
+				size := header.Size
+				e.content = func() io.Reader {
+					return io.NewSectionReader(ra, offset, size)
+				}
+			} else {
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				e.content = func() io.Reader { return bytes.NewReader(data) }
+			}
+		case tar.TypeLink:
+			target := pathpkg.Clean("/" + header.Linkname)[1:]
+			if linked, ok := t.entries[target]; ok {
+				e.content = linked.content
+				h := *header
+				h.Typeflag = tar.TypeReg
+				h.Size = linked.header.Size
+				e.header = &h
+			}
+		}
+
+		t.add(name, e)
+	}
+
+	for _, e := range t.entries {
+		sort.Strings(e.children)
+	}
+	return t, nil
+}
+
+// isSparse reports whether a file is sparse, so its content can't be read
+// from the archive as is.
+func isSparse(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeGNUSparse ||
+		header.PAXRecords["GNU.sparse.major"] != ""
+}
+
+// add adds an entry and its missing parent directories.
+func (t *tarFS) add(name string, e *tarEntry) {
+	if old, ok := t.entries[name]; ok {
+		// A later entry replaces an earlier one, but a directory keeps
+		// its children.
+		e.children = old.children
+		t.entries[name] = e
+		return
+	}
+	t.entries[name] = e
+
+	for name != "." {
+		dir := pathpkg.Dir(name)
+		parent, ok := t.entries[dir]
+		if !ok {
+			parent = &tarEntry{header: &tar.Header{
+				Name:     dir,
+				Typeflag: tar.TypeDir,
+				Mode:     0o755,
+			}}
+			t.entries[dir] = parent
+		}
+		parent.children = append(parent.children, pathpkg.Base(name))
+		if ok {
+			return
+		}
+		name = dir
+	}
+}
+
+// maxSymlinks is how many symlinks are followed to open a path, as on
+// Linux.
+const maxSymlinks = 40
+
+// resolve returns the entry of name, with symlinks in any component
+// followed.
+func (t *tarFS) resolve(name string, links *int) (string, *tarEntry, error) {
+	resolved := "."
+	parts := strings.Split(name, "/")
+	if name == "." {
+		parts = nil
+	}
+
+	for i, part := range parts {
+		p := pathpkg.Join(resolved, part)
+		e, ok := t.entries[p]
+		if !ok {
+			return "", nil, fs.ErrNotExist
+		}
+
+		if e.header.Typeflag == tar.TypeSymlink {
+			*links++
+			if *links > maxSymlinks {
+				return "", nil, errors.Errorf("too many levels of symbolic links")
+			}
+
+			target := e.header.Linkname
+			if !pathpkg.IsAbs(target) {
+				target = pathpkg.Join(resolved, target)
+			}
+			// Links can't point out of the archive, as in a build
+			// context.
+			target = pathpkg.Clean("/" + target)[1:]
+			if target == "" {
+				target = "."
+			}
+
+			var err error
+			p, e, err = t.resolve(target, links)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+
+		if i < len(parts)-1 && e.header.Typeflag != tar.TypeDir {
+			return "", nil, fs.ErrNotExist
+		}
+		resolved = p
+	}
+
+	return resolved, t.entries[resolved], nil
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	var links int
+	resolved, e, err := t.resolve(name, &links)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	info := tarFileInfo{name: pathpkg.Base(name), header: e.header}
+	if e.header.Typeflag == tar.TypeDir {
+		return &tarDir{fsys: t, path: resolved, info: info, children: e.children}, nil
+	}
+
+	content := e.content
+	if content == nil {
+		content = func() io.Reader { return bytes.NewReader(nil) }
+	}
+	return &tarFile{info: info, r: content()}, nil
+}
+
+type tarFileInfo struct {
+	name   string
+	header *tar.Header
+}
+
+func (i tarFileInfo) Name() string { return i.name }
+
+func (i tarFileInfo) Size() int64 {
+	if i.header.Typeflag == tar.TypeDir {
+		return 0
+	}
+	return i.header.Size
+}
+
+func (i tarFileInfo) Mode() fs.FileMode { return i.header.FileInfo().Mode() }
+
+func (i tarFileInfo) ModTime() time.Time { return i.header.ModTime }
+
+func (i tarFileInfo) IsDir() bool { return i.header.Typeflag == tar.TypeDir }
+
+// Sys returns the tar header.
+func (i tarFileInfo) Sys() any { return i.header }
+
+type tarFile struct {
+	info tarFileInfo
+	r    io.Reader
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *tarFile) Read(b []byte) (int, error) { return f.r.Read(b) }
+
+func (f *tarFile) Close() error { return nil }
+
+type tarDir struct {
+	fsys     *tarFS
+	path     string
+	info     tarFileInfo
+	children []string
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: fs.ErrInvalid}
+}
+
+func (d *tarDir) Close() error { return nil }
+
+// ReadDir returns the children of the directory. Symlinks aren't followed,
+// as with os.ReadDir.
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n > 0 && len(d.children) == 0 {
+		return nil, io.EOF
+	}
+
+	children := d.children
+	if n > 0 && n < len(children) {
+		children = children[:n]
+	}
+	d.children = d.children[len(children):]
+
+	entries := make([]fs.DirEntry, len(children))
+	for i, name := range children {
+		e := d.fsys.entries[pathpkg.Join(d.path, name)]
+		entries[i] = fs.FileInfoToDirEntry(tarFileInfo{name: name, header: e.header})
+	}
+	return entries, nil
+}
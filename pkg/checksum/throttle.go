@@ -0,0 +1,63 @@
+package checksum
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// readBurst is how many bytes may be read at once from source files with a
+// ReadLimiter from NewReadLimiter.
+const readBurst = 256 << 10
+
+// NewReadLimiter returns a ReadLimiter for reads of source files of up to
+// bytesPerSecond.
+func NewReadLimiter(bytesPerSecond int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), readBurst)
+}
+
+// open opens a source file to read its content, throttled by readLimiter.
+func (s *checksummer) open(path string) (io.ReadCloser, error) {
+	f, err := s.fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.readLimiter == nil {
+		return f, nil
+	}
+	return throttledFile{
+		ReadCloser: f,
+		r:          &throttledReader{r: f, limiter: s.readLimiter, ctx: s.ctx},
+	}, nil
+}
+
+type throttledFile struct {
+	io.ReadCloser
+	r io.Reader
+}
+
+func (f throttledFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+// throttledReader waits for what it reads from limiter, so every reader
+// sharing it reads at its rate altogether.
+type throttledReader struct {
+	r       io.Reader
+	limiter *rate.Limiter
+	ctx     context.Context
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,35 @@
+package checksum
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes spans of calculations with the global tracer provider, so
+// nothing is recorded unless the program using the package sets one.
+var tracer = otel.Tracer("github.com/inoc603/dockerfile-source-checksum/pkg/checksum")
+
+// SetContext sets the context of calculations, which is the parent of their
+// spans.
+func (c *Config) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+func (c Config) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// endSpan ends a span, with an error status if err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,46 @@
+package checksum
+
+import (
+	"sort"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// hashedPath returns path as it's written to the hash, in NFC if
+// normalizeUnicode is set, as macOS may keep names in NFD, and case folded
+// if foldCase is set.
+func (s *checksummer) hashedPath(path string) string {
+	if s.normalizeUnicode {
+		path = norm.NFC.String(path)
+	}
+	if s.foldCase {
+		path = cases.Fold().String(path)
+	}
+	return path
+}
+
+// sortPaths sorts paths by hashedPath, so names that are sorted differently
+// in NFD or another case are hashed in the same order. Paths that only
+// differ in case are logged, as only one of them can be checked out on a
+// case-insensitive filesystem.
+func (s *checksummer) sortPaths(paths []string) {
+	if !s.normalizeUnicode && !s.foldCase {
+		return
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return s.hashedPath(paths[i]) < s.hashedPath(paths[j])
+	})
+
+	if !s.foldCase {
+		return
+	}
+	for i := 1; i < len(paths); i++ {
+		if s.hashedPath(paths[i-1]) == s.hashedPath(paths[i]) {
+			s.logger.Warn(
+				"paths only differ in case",
+				"path", s.context+paths[i-1], "other", s.context+paths[i],
+			)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package checksum
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"io/fs"
+	"path/filepath"
+)
+
+// writeXattrs writes the extended attributes of a file in includeXattrs
+// that it has to the final hash, hex encoded, as they're binary.
+func (s *checksummer) writeXattrs(path string, info fs.FileInfo) error {
+	for _, name := range s.includeXattrs {
+		value, ok, err := s.xattr(path, info, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		encoded := hex.EncodeToString(value)
+		s.writeField(s.h, string(InputXattr), name, encoded)
+		s.input(Input{Kind: InputXattr, Path: path, Key: name, Value: encoded})
+	}
+	return nil
+}
+
+// xattr returns an extended attribute of a file, or false if it's not set.
+// Attributes of files in a tar archive are read from its PAX records.
+func (s *checksummer) xattr(path string, info fs.FileInfo, name string) ([]byte, bool, error) {
+	if header, ok := info.Sys().(*tar.Header); ok {
+		value, ok := header.PAXRecords["SCHILY.xattr."+name]
+		return []byte(value), ok, nil
+	}
+	if s.dir == "" {
+		return nil, false, nil
+	}
+	return osXattr(filepath.Join(s.dir, filepath.FromSlash(path)), name)
+}
@@ -0,0 +1,29 @@
+package checksum
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func osXattr(path, name string) ([]byte, bool, error) {
+	for {
+		size, err := unix.Getxattr(path, name, nil)
+		if errors.Is(err, unix.ENODATA) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "read extended attribute %s of %s", name, path)
+		}
+
+		value := make([]byte, size)
+		n, err := unix.Getxattr(path, name, value)
+		// The attribute grew since its size was read.
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "read extended attribute %s of %s", name, path)
+		}
+		return value[:n], true, nil
+	}
+}
@@ -0,0 +1,5 @@
+// Package checksumpb is the gRPC interface of the checksum service, generated
+// from proto/checksum.proto.
+package checksumpb
+
+//go:generate protoc -I ../../proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative checksum.proto
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdPlatforms() *cobra.Command {
+	cmdPlatforms := &cobra.Command{
+		Use:   "platforms <context>",
+		Short: "Print the checksum for each platform, and the combined checksum",
+		Long: "Print the checksum of the dockerfile for each platform on its " +
+			"own, followed by the checksum for all platforms. A platform " +
+			"checksum only changes if sources of that platform change, e.g. " +
+			"with COPY dist/${TARGETARCH}, so multi-platform builds can skip " +
+			"platforms that didn't change.",
+		Args: cobra.ExactArgs(1),
+		Run:  handlerPlatforms,
+	}
+	cmdPlatforms.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdPlatforms
+}
+
+type platformsResult struct {
+	Platforms []checksum.PlatformChecksum `json:"platforms"`
+	Combined  string                      `json:"combined"`
+}
+
+func handlerPlatforms(cmd *cobra.Command, args []string) {
+	config := loadConfig(cmd, args[0])
+	config.Cache = openSharedCache(config)
+
+	res := platformsResult{
+		Platforms: must(checksum.CalculatePlatformChecksums(config)),
+		Combined:  must(checksum.CalculateDockerfileChecksum(config)),
+	}
+
+	must0(config.Cache.Save())
+
+	for i := range res.Platforms {
+		res.Platforms[i].Checksum = displayChecksum(cmd, config, res.Platforms[i].Checksum)
+	}
+	res.Combined = displayChecksum(cmd, config, res.Combined)
+	printOutput(cmd, res, func(out io.Writer) {
+		for _, sum := range res.Platforms {
+			fmt.Fprintln(out, sum.Platform, sum.Checksum)
+		}
+		fmt.Fprintln(out, "combined", res.Combined)
+	})
+}
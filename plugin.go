@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// dockerPluginName is the name of the docker command when the binary is
+// installed as a docker CLI plugin, i.e. as docker-checksum in a cli-plugins
+// directory.
+const dockerPluginName = "checksum"
+
+// dockerPluginMetadata is what docker reads from a plugin to list it.
+type dockerPluginMetadata struct {
+	SchemaVersion    string
+	Vendor           string
+	Version          string
+	ShortDescription string
+	URL              string
+}
+
+func newCmdDockerPluginMetadata() *cobra.Command {
+	return &cobra.Command{
+		Use:    "docker-cli-plugin-metadata",
+		Short:  "Print the metadata of the docker CLI plugin",
+		Args:   cobra.NoArgs,
+		Hidden: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			must0(enc.Encode(dockerPluginMetadata{
+				SchemaVersion:    "0.1.0",
+				Vendor:           "inoc603",
+				Version:          buildVersion(),
+				ShortDescription: "Print a checksum of the sources of a dockerfile",
+				URL:              "https://github.com/inoc603/dockerfile-source-checksum",
+			}))
+		},
+	}
+}
+
+// dockerPluginArgs returns the arguments of the command if the binary is
+// run by docker as a plugin, which passes the name of the plugin first, e.g.
+// docker-checksum checksum -f Dockerfile . for docker checksum -f Dockerfile .
+func dockerPluginArgs(args []string) ([]string, bool) {
+	name := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	if name != "docker-"+dockerPluginName || len(args) < 2 || args[1] != dockerPluginName {
+		return nil, false
+	}
+	return args[2:], true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// startProfiling starts a CPU profile into --cpuprofile, and writes a heap
+// profile into --memprofile when the command finishes. Errors are runErrors,
+// as they aren't about how the binary is called.
+func startProfiling(cmd *cobra.Command, args []string) (err error) {
+	defer func() {
+		if err != nil {
+			cmd.SilenceUsage = true
+		}
+	}()
+
+	cpuprofile, err := cmd.Flags().GetString("cpuprofile")
+	if err != nil {
+		return err
+	}
+	memprofile, err := cmd.Flags().GetString("memprofile")
+	if err != nil {
+		return err
+	}
+
+	if cpuprofile != "" {
+		f, err := os.Create(cpuprofile)
+		if err != nil {
+			return runError{errors.Wrap(err, "create cpu profile")}
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return runError{errors.Wrap(err, "start cpu profile")}
+		}
+		cleanups = append(cleanups, func() {
+			pprof.StopCPUProfile()
+			if err := f.Close(); err != nil {
+				logger.Warn("write cpu profile", "error", err)
+			}
+		})
+	}
+
+	if memprofile != "" {
+		cleanups = append(cleanups, func() {
+			if err := writeHeapProfile(memprofile); err != nil {
+				logger.Warn("write memory profile", "error", err)
+			}
+		})
+	}
+	return nil
+}
+
+// writeHeapProfile writes a heap profile into path, after a garbage
+// collection so it's up to date.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// addPprofFlag adds --pprof-addr to a command that keeps running, whose
+// profiles are only written when it exits.
+func addPprofFlag(cmd *cobra.Command) {
+	cmd.Flags().String(
+		"pprof-addr",
+		"",
+		"address to serve net/http/pprof profiles on at /debug/pprof/, e.g. 127.0.0.1:6060",
+	)
+}
+
+// servePprof serves pprofHandler on --pprof-addr, if it's set.
+func servePprof(cmd *cobra.Command) {
+	addr := must(cmd.Flags().GetString("pprof-addr"))
+	if addr == "" {
+		return
+	}
+
+	listener := must(net.Listen("tcp", addr))
+	logger.Info("serve pprof", "address", listener.Addr().String())
+	go func() {
+		if err := http.Serve(listener, pprofHandler()); err != nil {
+			logger.Warn("serve pprof", "error", err)
+		}
+	}()
+}
+
+// pprofHandler serves the profiles of net/http/pprof at /debug/pprof/.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	return mux
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/pkg/errors"
+)
+
+const (
+	progressNone = "none"
+	// progressAuto is progressTTY if stderr is a terminal, and progressPlain
+	// otherwise.
+	progressAuto = "auto"
+	// progressPlain prints a line every few seconds, e.g. for CI logs.
+	progressPlain = "plain"
+	// progressTTY updates a single line.
+	progressTTY = "tty"
+)
+
+var progressIntervals = map[string]time.Duration{
+	progressPlain: 5 * time.Second,
+	progressTTY:   100 * time.Millisecond,
+}
+
+// startProgress reports the files and bytes counted by stats to w until the
+// returned function is called, which prints a summary.
+func startProgress(mode string, w io.Writer, stats *checksum.Stats) (func(), error) {
+	if mode == progressAuto {
+		mode = progressPlain
+		if f, ok := w.(*os.File); ok && isTerminal(f) {
+			mode = progressTTY
+		}
+	}
+
+	interval, ok := progressIntervals[mode]
+	if !ok {
+		return nil, errors.Errorf("unknown progress mode %s", mode)
+	}
+
+	start := time.Now()
+	line := func() string {
+		elapsed := time.Since(start)
+		bytes := stats.HashedBytes.Load()
+		return fmt.Sprintf(
+			"%d files, %s read, %s/s",
+			stats.Files.Load(),
+			units.HumanSize(float64(bytes)),
+			units.HumanSize(float64(bytes)/elapsed.Seconds()),
+		)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if mode == progressTTY {
+					fmt.Fprint(w, "\r\x1b[Kprogress: "+line())
+				} else {
+					fmt.Fprintln(w, "progress: "+line())
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		if mode == progressTTY {
+			fmt.Fprint(w, "\r\x1b[K")
+		}
+		fmt.Fprintf(w, "done: %s in %s\n", line(), time.Since(start).Round(time.Millisecond))
+	}, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
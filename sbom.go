@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdSBOM() *cobra.Command {
+	cmdSBOM := &cobra.Command{
+		Use:   "sbom [context]",
+		Short: "Print the source files of the checksum as an SBOM",
+		Long: "Calculate the checksum and print the source files that " +
+			"contribute to it, with their digests, as an SBOM document.",
+		Args: cobra.MaximumNArgs(1),
+		Run:  handlerSBOM,
+	}
+	cmdSBOM.Flags().String("format", "cyclonedx", "SBOM format: cyclonedx or spdx")
+	cmdSBOM.Flags().String("output-file", "", "write the SBOM to a file instead of stdout")
+	return cmdSBOM
+}
+
+func handlerSBOM(cmd *cobra.Command, args []string) {
+	context := "."
+	if len(args) > 0 {
+		context = args[0]
+	}
+	config := loadConfig(cmd, context)
+
+	var doc any
+	switch format := must(cmd.Flags().GetString("format")); format {
+	case "cyclonedx":
+		doc = must(checksum.NewCycloneDX(config))
+	case "spdx":
+		doc = must(checksum.NewSPDX(config))
+	default:
+		must0(usageErrorf("unknown SBOM format %s", format))
+	}
+
+	content := must(json.MarshalIndent(doc, "", "  "))
+	writeRootOutput(cmd, string(content)+"\n")
+}
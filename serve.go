@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksumpb"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+)
+
+func newCmdServe() *cobra.Command {
+	cmdServe := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve checksums over HTTP or gRPC",
+		Long: "Serve an HTTP API to calculate checksums, so digests of files " +
+			"stay cached between requests. POST /checksum takes a JSON body " +
+			"with the context, dockerfile, build args, build contexts, labels, " +
+			"platforms and target. With --grpc, the ChecksumService in " +
+			"proto/checksum.proto is served instead. Flags are used as " +
+			"defaults for every request. Any path readable by the server can " +
+			"be requested, so it listens on localhost by default. Prometheus " +
+			"metrics are served at /metrics, or on --metrics-listen with --grpc.",
+		Args: cobra.NoArgs,
+		Run:  handlerServe,
+	}
+	cmdServe.Flags().String("listen", "127.0.0.1:8080", "address to listen on")
+	cmdServe.Flags().Bool("grpc", false, "serve gRPC instead of HTTP")
+	cmdServe.Flags().String(
+		"metrics-listen",
+		"",
+		"address to serve Prometheus metrics on with --grpc",
+	)
+	addPprofFlag(cmdServe)
+	return cmdServe
+}
+
+func handlerServe(cmd *cobra.Command, args []string) {
+	base := loadConfig(cmd, ".")
+	base.Cache = openSharedCache(base)
+
+	metrics := newServerMetrics()
+	servePprof(cmd)
+
+	listener := must(net.Listen("tcp", must(cmd.Flags().GetString("listen"))))
+	logger.Info("serve checksums", "address", listener.Addr().String())
+
+	if must(cmd.Flags().GetBool("grpc")) {
+		if addr := must(cmd.Flags().GetString("metrics-listen")); addr != "" {
+			metricsListener := must(net.Listen("tcp", addr))
+			logger.Info("serve metrics", "address", metricsListener.Addr().String())
+			go func() {
+				if err := http.Serve(metricsListener, metrics.handler()); err != nil {
+					logger.Warn("serve metrics", "error", err)
+				}
+			}()
+		}
+
+		server := newGRPCServer()
+		checksumpb.RegisterChecksumServiceServer(
+			server, &checksumServer{base: base, metrics: metrics},
+		)
+		must0(server.Serve(listener))
+		return
+	}
+
+	must0(http.Serve(listener, newChecksumHandler(base, metrics)))
+}
+
+type checksumRequest struct {
+	// Context is the build context directory.
+	Context string `json:"context"`
+	// Dockerfile is relative to the context, Dockerfile by default.
+	Dockerfile    string            `json:"dockerfile"`
+	BuildArgs     map[string]string `json:"buildArgs"`
+	BuildContexts map[string]string `json:"buildContexts"`
+	Labels        map[string]string `json:"labels"`
+	Platforms     []string          `json:"platforms"`
+	Target        string            `json:"target"`
+}
+
+// config returns the checksum config for the request, with fields that are
+// not set taken from base.
+func (r checksumRequest) config(base checksum.Config) checksum.Config {
+	// Requests are calculated concurrently, so none shares slices of base.
+	config := base
+	config.Platforms = slices.Clone(base.Platforms)
+	config.ExtraPaths = slices.Clone(base.ExtraPaths)
+	config.Exclude = slices.Clone(base.Exclude)
+	config.IncludeXattrs = slices.Clone(base.IncludeXattrs)
+	config.Workdir = r.Context
+	config.Dockerfile = defaultDockerfile(r.Context)
+	if r.Dockerfile != "" {
+		config.Dockerfile = joinRelative(r.Context, r.Dockerfile)
+	}
+	config.BuildArgs = mergeMap(base.BuildArgs, r.BuildArgs)
+	config.BuildContexts = mergeMap(base.BuildContexts, r.BuildContexts)
+	config.Labels = mergeMap(base.Labels, r.Labels)
+	if r.Platforms != nil {
+		config.Platforms = r.Platforms
+	}
+	if r.Target != "" {
+		config.Target = r.Target
+	}
+	return config
+}
+
+// newChecksumHandler returns the handler of the HTTP API. base.Cache is
+// shared by every request and saved after each of them.
+func newChecksumHandler(base checksum.Config, metrics *serverMetrics) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/checksum", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+
+		var req checksumRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "decode request"))
+			return
+		}
+		if req.Context == "" {
+			writeError(w, http.StatusBadRequest, errors.New("context is required"))
+			return
+		}
+
+		config := req.config(base)
+		config.Stats = &checksum.Stats{}
+		config.SetContext(r.Context())
+
+		start := time.Now()
+		sum, err := checksum.CalculateDockerfileChecksum(config)
+		metrics.observe("http", start, config.Stats, err)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		if err := base.Cache.Save(); err != nil {
+			logger.Warn("save digest cache", "error", err)
+		}
+
+		writeJSON(w, http.StatusOK, newChecksumResult(config, config.Algorithm(), sum))
+	})
+
+	mux.Handle("/metrics", metrics.handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
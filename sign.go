@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sigstore/cosign/v2/cmd/cosign/cli/generate"
+	"github.com/sigstore/cosign/v2/cmd/cosign/cli/options"
+	"github.com/sigstore/cosign/v2/cmd/cosign/cli/sign"
+	"github.com/sigstore/cosign/v2/cmd/cosign/cli/verify"
+	"github.com/spf13/cobra"
+)
+
+func newCmdSign() *cobra.Command {
+	cmdSign := &cobra.Command{
+		Use:   "sign <file>",
+		Short: "Sign a manifest or attestation with cosign",
+		Long: "Sign a file written by this tool, e.g. a manifest, lockfile or " +
+			"attestation, as cosign sign-blob does. The signature, and the " +
+			"certificate for keyless signing, are written to a bundle next to " +
+			"the file and uploaded to the Rekor transparency log. Signing is " +
+			"keyless unless --key is given, and the password of a key is read " +
+			"from COSIGN_PASSWORD or the terminal.",
+		Args:         cobra.ExactArgs(1),
+		RunE:         handlerSign,
+		SilenceUsage: true,
+	}
+	cmdSign.Flags().String("key", "", "private key or KMS URI to sign with, keyless by default")
+	cmdSign.Flags().Bool("tlog-upload", true, "upload the signature to the transparency log")
+	addCosignFlags(cmdSign)
+	return cmdSign
+}
+
+func newCmdVerifySignature() *cobra.Command {
+	cmdVerify := &cobra.Command{
+		Use:   "verify-signature <file>",
+		Short: "Verify the cosign signature of a manifest or attestation",
+		Long: "Verify the bundle written by sign, as cosign verify-blob " +
+			"does. Give --key for a keyed signature, or " +
+			"--certificate-identity and --certificate-oidc-issuer for a keyless " +
+			"one.",
+		Args:         cobra.ExactArgs(1),
+		RunE:         handlerVerifySignature,
+		SilenceUsage: true,
+	}
+	cmdVerify.Flags().String("key", "", "public key or KMS URI to verify with")
+	cmdVerify.Flags().String(
+		"certificate-identity",
+		"",
+		"identity of the keyless signer, e.g. an email or a workflow URL",
+	)
+	cmdVerify.Flags().String(
+		"certificate-oidc-issuer",
+		"",
+		"OIDC issuer of the keyless signer, e.g. https://token.actions.githubusercontent.com",
+	)
+	cmdVerify.Flags().Bool(
+		"insecure-ignore-tlog",
+		false,
+		"do not check that the signature is in the transparency log",
+	)
+	addCosignFlags(cmdVerify)
+	return cmdVerify
+}
+
+func addCosignFlags(cmd *cobra.Command) {
+	cmd.Flags().String("bundle", "", "path of the sigstore bundle, <file>.sigstore.json by default")
+	cmd.Flags().String("rekor-url", options.DefaultRekorURL, "URL of the Rekor transparency log")
+}
+
+func handlerSign(cmd *cobra.Command, args []string) error {
+	ko := cosignKeyOpts(cmd, args[0])
+	ko.PassFunc = generate.GetPass
+	ko.FulcioURL = options.DefaultFulcioURL
+	ko.OIDCIssuer = options.DefaultOIDCIssuerURL
+	ko.OIDCClientID = "sigstore"
+	ko.SkipConfirmation = true
+
+	_, err := sign.SignBlobCmd(
+		&options.RootOptions{Timeout: options.DefaultTimeout},
+		ko,
+		args[0],
+		true,
+		"",
+		"",
+		must(cmd.Flags().GetBool("tlog-upload")),
+	)
+	return errors.Wrap(err, "sign")
+}
+
+func handlerVerifySignature(cmd *cobra.Command, args []string) error {
+	v := &verify.VerifyBlobCmd{
+		KeyOpts:    cosignKeyOpts(cmd, args[0]),
+		IgnoreTlog: must(cmd.Flags().GetBool("insecure-ignore-tlog")),
+	}
+
+	identity := must(cmd.Flags().GetString("certificate-identity"))
+	issuer := must(cmd.Flags().GetString("certificate-oidc-issuer"))
+	switch {
+	case v.KeyRef != "":
+		// Only certificates of keyless signatures have an SCT.
+		v.IgnoreSCT = true
+	case identity != "" && issuer != "":
+		v.CertIdentity, v.CertOidcIssuer = identity, issuer
+	default:
+		return usageErrorf(
+			"verify-signature needs --key, or --certificate-identity and --certificate-oidc-issuer",
+		)
+	}
+
+	return errors.Wrap(v.Exec(cmd.Context(), args[0]), "verify signature")
+}
+
+// cosignKeyOpts returns the options of sign and verify-signature shared by
+// cosign.
+func cosignKeyOpts(cmd *cobra.Command, file string) options.KeyOpts {
+	return options.KeyOpts{
+		KeyRef:     must(cmd.Flags().GetString("key")),
+		BundlePath: bundlePath(cmd, file),
+		RekorURL:   must(cmd.Flags().GetString("rekor-url")),
+	}
+}
+
+func bundlePath(cmd *cobra.Command, file string) string {
+	if bundle := must(cmd.Flags().GetString("bundle")); bundle != "" {
+		return bundle
+	}
+	return file + ".sigstore.json"
+}
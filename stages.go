@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdStages() *cobra.Command {
+	cmdStages := &cobra.Command{
+		Use:   "stages <context>",
+		Short: "Print the checksum of each stage in the dockerfile",
+		Long: "Print the checksum of each stage in the dockerfile. A stage " +
+			"checksum only changes if the stage or a stage it depends on " +
+			"changes, so it can be used as a cache key for the stage.",
+		Args: cobra.ExactArgs(1),
+		Run:  handlerStages,
+	}
+	cmdStages.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdStages
+}
+
+func handlerStages(cmd *cobra.Command, args []string) {
+	config := loadConfig(cmd, args[0])
+
+	sums := must(checksum.CalculateStageChecksums(config))
+	for i := range sums {
+		sums[i].Checksum = displayChecksum(cmd, config, sums[i].Checksum)
+	}
+
+	printOutput(cmd, sums, func(out io.Writer) {
+		for _, sum := range sums {
+			fmt.Fprintln(out, sum.Name, sum.Checksum)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+// statsOutput is the summary of a calculation printed with --stats.
+type statsOutput struct {
+	// Files is the number of source files, of which HashedFiles were read,
+	// e.g. as they weren't in the cache.
+	Files       int64 `json:"files"`
+	HashedFiles int64 `json:"hashedFiles"`
+	HashedBytes int64 `json:"hashedBytes"`
+	CacheHits   int64 `json:"cacheHits"`
+	CacheMisses int64 `json:"cacheMisses"`
+	// Timings are in nanoseconds.
+	Timings checksum.Timings `json:"timings"`
+}
+
+// calculateStats returns the checksum for a dockerfile with each algorithm,
+// and a summary of the calculation. Stats of config, e.g. for --progress,
+// still count the calculation.
+func calculateStats(config checksum.Config) ([]string, *statsOutput) {
+	if config.Stats == nil {
+		config.Stats = &checksum.Stats{}
+	}
+	before := countStats(config.Stats)
+	res := must(checksum.Calculate(config))
+	after := countStats(config.Stats)
+
+	return res.Checksums, &statsOutput{
+		Files:       after.Files - before.Files,
+		HashedFiles: after.HashedFiles - before.HashedFiles,
+		HashedBytes: after.HashedBytes - before.HashedBytes,
+		CacheHits:   after.CacheHits - before.CacheHits,
+		CacheMisses: after.CacheMisses - before.CacheMisses,
+		Timings:     res.Timings,
+	}
+}
+
+// countStats returns the counts of stats so far.
+func countStats(stats *checksum.Stats) statsOutput {
+	return statsOutput{
+		Files:       stats.Files.Load(),
+		HashedFiles: stats.HashedFiles.Load(),
+		HashedBytes: stats.HashedBytes.Load(),
+		CacheHits:   stats.CacheHits.Load(),
+		CacheMisses: stats.CacheMisses.Load(),
+	}
+}
+
+// String returns the summary on a line, e.g. "10 files, 4 read (2.3MB), 6
+// cache hits, 4 cache misses; parse 1ms, resolve 2ms, hash 30ms, total
+// 33ms".
+func (s statsOutput) String() string {
+	round := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	return fmt.Sprintf(
+		"%d files, %d read (%s), %d cache hits, %d cache misses; parse %s, resolve %s, hash %s, total %s",
+		s.Files,
+		s.HashedFiles,
+		units.HumanSize(float64(s.HashedBytes)),
+		s.CacheHits,
+		s.CacheMisses,
+		round(s.Timings.Parse),
+		round(s.Timings.Resolve),
+		round(s.Timings.Hash),
+		round(s.Timings.Total),
+	)
+}
+
+// printStats prints stats on stderr after prefix, unless they're nil or
+// --quiet is set.
+func printStats(cmd *cobra.Command, prefix string, stats *statsOutput) {
+	if stats == nil || must(cmd.Flags().GetBool("quiet")) {
+		return
+	}
+	fmt.Fprintln(cmd.ErrOrStderr(), prefix+"stats: "+stats.String())
+}
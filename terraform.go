@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// terraformQuery parses the query of a Terraform external data source. Its
+// keys are context, dockerfile, target and platforms, separated by commas,
+// with build args, labels and build contexts as build_arg.<name>,
+// label.<name> and build_context.<name>. Every value is a string, as
+// Terraform only sends strings.
+func terraformQuery(query map[string]string) (checksumRequest, error) {
+	var req checksumRequest
+	for key, value := range query {
+		prefix, name, _ := strings.Cut(key, ".")
+		switch {
+		case key == "context":
+			req.Context = value
+		case key == "dockerfile":
+			req.Dockerfile = value
+		case key == "target":
+			req.Target = value
+		case key == "platforms":
+			req.Platforms = strings.Split(value, ",")
+		case prefix == "build_arg" && name != "":
+			req.BuildArgs = mergeMap(req.BuildArgs, map[string]string{name: value})
+		case prefix == "label" && name != "":
+			req.Labels = mergeMap(req.Labels, map[string]string{name: value})
+		case prefix == "build_context" && name != "":
+			req.BuildContexts = mergeMap(req.BuildContexts, map[string]string{name: value})
+		default:
+			return req, errors.Errorf("unknown query key %s", key)
+		}
+	}
+	return req, nil
+}
+
+// handlerTerraformExternal reads the query of a Terraform external data
+// source from stdin, and writes the checksum as {"checksum": "..."}. The
+// context defaults to the argument, or the current directory.
+func handlerTerraformExternal(cmd *cobra.Command, args []string) {
+	var query map[string]string
+	must0(errors.Wrap(json.NewDecoder(cmd.InOrStdin()).Decode(&query), "decode query"))
+	req := must(terraformQuery(query))
+
+	if req.Context == "" {
+		req.Context = "."
+		if len(args) > 0 {
+			req.Context = args[0]
+		}
+	}
+
+	// The context is resolved once, as it may be cloned.
+	base := loadConfig(cmd, req.Context)
+	config := req.config(base)
+	config.Workdir = base.Workdir
+	config.Dockerfile, config.DockerfileContent = base.Dockerfile, base.DockerfileContent
+	if req.Dockerfile != "" {
+		config.Dockerfile = joinRelative(base.Workdir, req.Dockerfile)
+		config.DockerfileContent = nil
+	}
+
+	_, display, _ := rootChecksums(cmd, config)
+	must0(json.NewEncoder(cmd.OutOrStdout()).Encode(map[string]string{
+		"checksum": display[0],
+	}))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+const serviceName = "dockerfile-source-checksum"
+
+// tracingEnv are the environment variables that enable tracing. Spans are
+// exported as the standard OTEL variables configure, e.g. OTEL_TRACES_EXPORTER
+// and OTEL_EXPORTER_OTLP_ENDPOINT, but only if one of these is set, so runs
+// don't try to reach a collector that isn't there.
+var tracingEnv = []string{
+	"OTEL_TRACES_EXPORTER",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+}
+
+// setupTracing installs the global tracer provider if tracing is enabled.
+// Spans are flushed when the command finishes.
+func setupTracing() {
+	enabled := false
+	for _, name := range tracingEnv {
+		if os.Getenv(name) != "" {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return
+	}
+
+	ctx := context.Background()
+	exporter, err := autoexport.NewSpanExporter(ctx)
+	if err != nil {
+		logger.Warn("disable tracing", "error", err)
+		return
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		logger.Warn("incomplete tracing resource", "error", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	cleanups = append(cleanups, func() {
+		if err := provider.Shutdown(ctx); err != nil {
+			logger.Warn("export spans", "error", err)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+// version is the version of the binary, set at build time with
+// -ldflags "-X main.version=v1.2.3". The module version is used otherwise.
+var version string
+
+// versionInfo is what a binary is built from.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+	// HashVersion is the default hash version, and HashVersions the
+	// supported ones.
+	HashVersion  int   `json:"hashVersion"`
+	HashVersions []int `json:"hashVersions"`
+}
+
+func newCmdVersion() *cobra.Command {
+	cmdVersion := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version of the binary and the hash versions it supports",
+		Args:  cobra.NoArgs,
+		Run:   handlerVersion,
+	}
+	cmdVersion.Flags().StringP("output", "o", "text", "output format: text or json")
+	return cmdVersion
+}
+
+func handlerVersion(cmd *cobra.Command, args []string) {
+	info := buildInfo()
+	printOutput(cmd, info, func(out io.Writer) {
+		fmt.Fprintln(out, "version:", info.Version)
+		if info.Revision != "" {
+			revision := info.Revision
+			if info.Modified {
+				revision += " (modified)"
+			}
+			fmt.Fprintln(out, "revision:", revision)
+		}
+		if info.Time != "" {
+			fmt.Fprintln(out, "time:", info.Time)
+		}
+		fmt.Fprintln(out, "go:", info.GoVersion)
+		fmt.Fprintf(out, "hash version: v%d, supports", info.HashVersion)
+		for _, v := range info.HashVersions {
+			fmt.Fprintf(out, " v%d", v)
+		}
+		fmt.Fprintln(out)
+	})
+}
+
+// buildInfo returns the version of the binary along with the VCS revision
+// it's built from, if it's built in a repository.
+func buildInfo() versionInfo {
+	info := versionInfo{
+		Version:      buildVersion(),
+		GoVersion:    runtime.Version(),
+		HashVersion:  checksum.HashVersion1,
+		HashVersions: checksum.HashVersions,
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// buildVersion returns the version set at build time, or the version of the
+// module the binary was built from.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
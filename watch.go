@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/inoc603/dockerfile-source-checksum/pkg/checksum"
+	"github.com/spf13/cobra"
+)
+
+func newCmdWatch() *cobra.Command {
+	cmdWatch := &cobra.Command{
+		Use:   "watch <context> [-- command [args...]]",
+		Short: "Print the checksum again whenever a source changes",
+		Long: "Watch the dockerfile and its sources, and print the checksum " +
+			"whenever it changes. If a command is given after --, it's run " +
+			"after each change with the checksum in the " +
+			"DOCKER_SOURCE_CHECKSUM environment variable, without the scheme prefix.",
+		Args: argsWithCommand(cobra.ExactArgs(1)),
+		Run:  handlerWatch,
+	}
+	cmdWatch.Flags().Duration(
+		"debounce",
+		200*time.Millisecond,
+		"time to wait for changes to settle before recalculating",
+	)
+	return cmdWatch
+}
+
+// argsWithCommand validates args before --, leaving the rest as a command.
+func argsWithCommand(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+			args = args[:dash]
+		}
+		return validate(cmd, args)
+	}
+}
+
+func handlerWatch(cmd *cobra.Command, args []string) {
+	config := loadConfig(cmd, args[0])
+
+	var command []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		command = args[dash:]
+	}
+
+	debounce := must(cmd.Flags().GetDuration("debounce"))
+
+	watcher := must(fsnotify.NewWatcher())
+	defer watcher.Close()
+
+	var last string
+	recalculate := func() {
+		if err := watchSources(watcher, config); err != nil {
+			logger.Warn("watch sources", "error", err)
+		}
+
+		sum, err := checksum.CalculateDockerfileChecksum(config)
+		if err != nil {
+			logger.Error("calculate checksum", "error", err)
+			return
+		}
+
+		if sum == last {
+			return
+		}
+		last = sum
+
+		fmt.Fprintln(cmd.OutOrStdout(), displayChecksum(cmd, config, sum))
+
+		if len(command) > 0 {
+			if err := runWithChecksum(cmd, command, sum); err != nil {
+				logger.Error("run command", "error", err)
+			}
+		}
+	}
+
+	recalculate()
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			logger.Debug("source changed", "event", event)
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("watch sources", "error", err)
+		case <-timer.C:
+			recalculate()
+		}
+	}
+}
+
+// watchSources adds the dockerfile, the workdir, every directory that
+// contains a source of the dockerfile and every directory of local named
+// contexts to watcher. fsnotify doesn't watch recursively, so directories
+// under a source directory are added one by one, except excluded ones.
+func watchSources(watcher *fsnotify.Watcher, config checksum.Config) error {
+	var dirs []string
+	seen := map[string]bool{}
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	add(config.Workdir)
+	add(filepath.Dir(config.Dockerfile))
+
+	addDirs := func(root string) fs.WalkDirFunc {
+		return func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				p = filepath.Dir(p)
+			}
+			add(filepath.Join(root, p))
+			return nil
+		}
+	}
+
+	if err := checksum.WalkSourcePaths(config, addDirs(config.Workdir)); err != nil {
+		return err
+	}
+
+	// Sources of named contexts are only known while calculating, so all
+	// of each context is watched.
+	for _, dir := range localContexts(config) {
+		if err := filepath.WalkDir(dir, addDirs("")); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// localContexts returns the named contexts of config that are directories,
+// by name.
+func localContexts(config checksum.Config) map[string]string {
+	dirs := map[string]string{}
+	for name, target := range config.BuildContexts {
+		if !strings.Contains(target, "://") {
+			dirs[name] = target
+		}
+	}
+	return dirs
+}
+
+func runWithChecksum(cmd *cobra.Command, command []string, sum string) error {
+	c := exec.CommandContext(cmd.Context(), command[0], command[1:]...)
+	c.Env = append(os.Environ(), "DOCKER_SOURCE_CHECKSUM="+sum)
+	c.Stdout = cmd.OutOrStdout()
+	c.Stderr = cmd.ErrOrStderr()
+	return c.Run()
+}